@@ -0,0 +1,307 @@
+package topfew
+
+// Compressed input is recognized by the magic numbers at the start of the file or stream. gzip and bzip2
+//  are decompressed on the fly. Decompression is inherently sequential, but some compressed files are made
+//  of a series of independent members: BGZF files, as written by bgzip, are gzip members of at most 64K,
+//  each of which says how long it is, and pbzip2 writes a series of complete bzip2 streams. For these, we
+//  find the members and divide them among parallel segments just as with uncompressed files. The only
+//  twist is that a segment can't tell whether the data before it ended with a newline; so each segment
+//  except the first discards everything up to and including its first newline, and each segment except
+//  the last finishes off by reading on into the next member as far as the first newline.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+type compression int
+
+const (
+	uncompressed compression = iota
+	gzipped
+	bzipped
+)
+
+var (
+	// gzip's magic number followed by the deflate compression method
+	gzipMagic = []byte{0x1f, 0x8b, 0x08}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+
+	// a bzip2 stream header is "BZh", a block size digit, then either the first block's magic number or,
+	//  for an empty stream, the end-of-stream magic number
+	bzip2Magic       = []byte("BZh")
+	bzip2BlockMagic  = []byte{0x31, 0x41, 0x59, 0x26, 0x53, 0x59}
+	bzip2StreamMagic = []byte{0x17, 0x72, 0x45, 0x38, 0x50, 0x90}
+)
+
+// sniffLength is how many bytes sniffCompression needs to see
+const sniffLength = 10
+
+// sniffCompression looks at the first few bytes of input to see how it's compressed
+func sniffCompression(start []byte) (compression, error) {
+	switch {
+	case bytes.HasPrefix(start, gzipMagic):
+		return gzipped, nil
+	case isBzip2Header(start):
+		return bzipped, nil
+	case bytes.HasPrefix(start, zstdMagic):
+		return uncompressed, errors.New("zstd-compressed input isn't supported, try piping from zstd -dc")
+	case bytes.HasPrefix(start, xzMagic):
+		return uncompressed, errors.New("xz-compressed input isn't supported, try piping from xz -dc")
+	}
+	return uncompressed, nil
+}
+
+func isBzip2Header(b []byte) bool {
+	return len(b) >= sniffLength && bytes.HasPrefix(b, bzip2Magic) && b[3] >= '1' && b[3] <= '9' &&
+		(bytes.Equal(b[4:10], bzip2BlockMagic) || bytes.Equal(b[4:10], bzip2StreamMagic))
+}
+
+func newDecompressor(kind compression, r io.Reader) (io.Reader, error) {
+	if kind == gzipped {
+		return gzip.NewReader(r)
+	}
+	return bzip2.NewReader(r), nil
+}
+
+// decompressStream returns a reader which decompresses the stream if it turns out to be compressed
+func decompressStream(instream io.Reader) (io.Reader, error) {
+	reader := bufio.NewReader(instream)
+	start, err := reader.Peek(sniffLength)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, bufio.ErrBufferFull) {
+		return nil, err
+	}
+	kind, err := sniffCompression(start)
+	if err != nil || kind == uncompressed {
+		return reader, err
+	}
+	return newDecompressor(kind, reader)
+}
+
+// fileCompression reads the start of the named file to see how it's compressed
+func fileCompression(fname string) (compression, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return uncompressed, err
+	}
+	//noinspection ALL
+	defer file.Close()
+	start := make([]byte, sniffLength)
+	n, err := io.ReadFull(file, start)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return uncompressed, err
+	}
+	return sniffCompression(start[:n])
+}
+
+// compressedMembers returns the offsets at which independently-decompressible members of the file begin;
+// always at least one, at offset 0
+func compressedMembers(file *os.File, kind compression, fileSize int64) ([]int64, error) {
+	if kind == gzipped {
+		return bgzfMembers(file, fileSize)
+	}
+	return bzip2Streams(file)
+}
+
+// bgzfMembers walks through the members of a BGZF file, whose gzip headers each have a "BC" extra field
+// giving the member's size. If the file isn't BGZF, it's treated as a single member.
+func bgzfMembers(file *os.File, fileSize int64) ([]int64, error) {
+	members := []int64{0}
+	header := make([]byte, 18)
+	offset := int64(0)
+	for {
+		if _, err := file.ReadAt(header, offset); err != nil {
+			return []int64{0}, nil
+		}
+		// gzip magic, deflate, FEXTRA flag set, XLEN 6, and a BC subfield of length 2
+		if header[0] != 0x1f || header[1] != 0x8b || header[2] != 8 || header[3]&4 == 0 ||
+			binary.LittleEndian.Uint16(header[10:]) != 6 || header[12] != 'B' || header[13] != 'C' ||
+			binary.LittleEndian.Uint16(header[14:]) != 2 {
+			return []int64{0}, nil
+		}
+		offset += int64(binary.LittleEndian.Uint16(header[16:])) + 1
+		if offset >= fileSize {
+			return members, nil
+		}
+		members = append(members, offset)
+	}
+}
+
+// bzip2Streams finds the starts of the concatenated bzip2 streams in the file, by looking for stream
+// headers. It's conceivable that the header byte pattern could show up in compressed data, but at ten
+// bytes long, vanishingly unlikely.
+func bzip2Streams(file *os.File) ([]int64, error) {
+	members := []int64{0}
+	const overlap = 9
+	buf := make([]byte, 256*1024)
+	carried := 0
+	base := int64(0) // file offset of buf[0]
+	for {
+		n, err := file.ReadAt(buf[carried:], base+int64(carried))
+		n += carried
+		for from := 1; from < n; {
+			at := bytes.Index(buf[from:n], bzip2Magic)
+			if at == -1 {
+				break
+			}
+			at += from
+			if at+10 > n {
+				break
+			}
+			if isBzip2Header(buf[at:at+10]) && base+int64(at) > members[len(members)-1] {
+				members = append(members, base+int64(at))
+			}
+			from = at + 1
+		}
+		if errors.Is(err, io.EOF) {
+			return members, nil
+		} else if err != nil {
+			return nil, err
+		}
+		// keep the end of the buffer in case a header straddles the boundary
+		copy(buf, buf[n-overlap:n])
+		base += int64(n - overlap)
+		carried = overlap
+	}
+}
+
+// compressedSegment is a run of members of a compressed file
+type compressedSegment struct {
+	start int64
+	end   int64
+	kind  compression
+	fname string
+}
+
+// compressedSegmentJobs is segmentFile for compressed files
+func compressedSegmentJobs(ctx context.Context, fname string, kind compression, segSize int64, filter *filters,
+	kf *keyFinder) ([]segmentJob, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	//noinspection ALL
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	fileSize := info.Size()
+
+	// CSV records can contain newlines, so we can't divide the file up by looking for them
+	members := []int64{0}
+	if kf.csv == nil {
+		members, err = compressedMembers(file, kind, fileSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// each segment gets at least one member, and then any more that start before its share of the file is
+	//  used up
+	var jobs []segmentJob
+	next := 0
+	for next < len(members) {
+		s := &compressedSegment{start: members[next], kind: kind, fname: fname}
+		next++
+		for next < len(members) && members[next] < s.start+segSize {
+			next++
+		}
+		if next == len(members) {
+			s.end = fileSize
+		} else {
+			s.end = members[next]
+		}
+		jobs = append(jobs, segmentJob{fname: fname, start: s.start, end: s.end,
+			read: func(segCounter segmentCounter) error {
+				return readCompressedSegment(ctx, s, fileSize, filter, kf, segCounter)
+			}})
+	}
+	return jobs, nil
+}
+
+func readCompressedSegment(ctx context.Context, s *compressedSegment, fileSize int64, filter *filters,
+	kf *keyFinder, segCounter recordCounter) error {
+	file, err := os.Open(s.fname)
+	if err != nil {
+		return err
+	}
+	//noinspection ALL
+	defer file.Close()
+	decompressor, err := newDecompressor(s.kind, io.NewSectionReader(file, s.start, s.end-s.start))
+	if err != nil {
+		return fmt.Errorf("can't decompress segment: %w", err)
+	}
+	reader := bufio.NewReaderSize(decompressor, 64*1024)
+	kf = kf.clone()
+	done := ctx.Done()
+
+	// the line that straddles the boundary with the previous segment belongs to that segment
+	if s.start > 0 {
+		for {
+			_, err = reader.ReadSlice('\n')
+			if !errors.Is(err, bufio.ErrBufferFull) {
+				break
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("can't read segment: %w", err)
+		}
+	}
+
+	for {
+		select {
+		case <-done:
+			return ctx.Err()
+		default:
+		}
+		record, err := readLine(reader)
+		if kf.csv != nil && err == nil && csvQuoteOpen(record) {
+			record, err = readCSVContinuation(reader, append([]byte(nil), record...))
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("can't read segment: %w", err)
+		}
+		if errors.Is(err, io.EOF) && s.end < fileSize {
+			// finish off the last line from the next segment's data
+			rest, err := readFirstLine(file, s.kind, s.end, fileSize)
+			if err != nil {
+				return fmt.Errorf("can't read segment: %w", err)
+			}
+			record = append(append([]byte(nil), record...), rest...)
+		}
+		if len(record) > 0 {
+			if err := countRecord(record, filter, kf, segCounter); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// readFirstLine decompresses from the member starting at offset as far as the first newline
+func readFirstLine(file *os.File, kind compression, offset int64, fileSize int64) ([]byte, error) {
+	decompressor, err := newDecompressor(kind, io.NewSectionReader(file, offset, fileSize-offset))
+	if err != nil {
+		return nil, err
+	}
+	line, err := bufio.NewReader(decompressor).ReadBytes('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return line, nil
+}
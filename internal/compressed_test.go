@@ -0,0 +1,167 @@
+package topfew
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// allCounts runs topfew with the supplied arguments and returns every key's count
+func allCounts(t *testing.T, args ...string) map[string]uint64 {
+	t.Helper()
+	c, err := Configure(append([]string{"-n", "100000"}, args...))
+	if err != nil {
+		t.Fatal("config: " + err.Error())
+	}
+	kc, err := Run(c, nil)
+	if err != nil {
+		t.Fatal("Run: " + err.Error())
+	}
+	counts := make(map[string]uint64)
+	for _, k := range kc {
+		counts[k.Key] = *k.Count
+	}
+	return counts
+}
+
+func assertCountsMatch(t *testing.T, label string, wanted map[string]uint64, got map[string]uint64) {
+	t.Helper()
+	if len(got) != len(wanted) {
+		t.Errorf("%s: got %d keys wanted %d", label, len(got), len(wanted))
+	}
+	for key, count := range wanted {
+		if got[key] != count {
+			t.Errorf("%s: count for %s is %d wanted %d", label, key, got[key], count)
+		}
+	}
+}
+
+// makeBGZF compresses data into BGZF members, each holding memberSize bytes of the input, and doesn't
+// bother splitting at line boundaries
+func makeBGZF(t *testing.T, data []byte, memberSize int) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > memberSize {
+			chunk = chunk[:memberSize]
+		}
+		data = data[len(chunk):]
+		var member bytes.Buffer
+		zw := gzip.NewWriter(&member)
+		zw.Extra = []byte{'B', 'C', 2, 0, 0, 0}
+		_, _ = zw.Write(chunk)
+		_ = zw.Close()
+		// fill in BSIZE, which is the member size minus one
+		memberBytes := member.Bytes()
+		binary.LittleEndian.PutUint16(memberBytes[16:], uint16(len(memberBytes)-1))
+		out.Write(memberBytes)
+	}
+	return out.Bytes()
+}
+
+func writeTemp(t *testing.T, suffix string, data []byte) string {
+	t.Helper()
+	name := fmt.Sprintf("/tmp/topfew-%d-%s", os.Getpid(), suffix)
+	if err := os.WriteFile(name, data, 0o600); err != nil {
+		t.Fatal("can't write tmpfile: " + err.Error())
+	}
+	return name
+}
+
+func TestCompressedFiles(t *testing.T) {
+	plain, err := os.ReadFile("../test/data/small")
+	if err != nil {
+		t.Fatal("can't read small: " + err.Error())
+	}
+	wanted := allCounts(t, "-f", "7", "../test/data/small")
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, _ = zw.Write(plain)
+	_ = zw.Close()
+	gzName := writeTemp(t, "gz", gz.Bytes())
+	defer func() { _ = os.Remove(gzName) }()
+	assertCountsMatch(t, "gzip", wanted, allCounts(t, "-f", "7", gzName))
+
+	bgzf := makeBGZF(t, plain, 7777)
+	bgzfName := writeTemp(t, "bgzf", bgzf)
+	defer func() { _ = os.Remove(bgzfName) }()
+	file, _ := os.Open(bgzfName)
+	members, err := bgzfMembers(file, int64(len(bgzf)))
+	_ = file.Close()
+	if err != nil || len(members) != (len(plain)+7776)/7777 {
+		t.Errorf("found %d BGZF members, wanted %d", len(members), (len(plain)+7776)/7777)
+	}
+	for _, width := range []string{"1", "2", "5", "40", "1000"} {
+		assertCountsMatch(t, "bgzf width "+width, wanted, allCounts(t, "-f", "7", "-w", width, bgzfName))
+	}
+
+	bz2Name := "../test/data/small-multi.bz2"
+	file, _ = os.Open(bz2Name)
+	members, err = bzip2Streams(file)
+	_ = file.Close()
+	if err != nil || len(members) != 4 {
+		t.Errorf("found %d bzip2 streams, wanted 4", len(members))
+	}
+	for _, width := range []string{"1", "2", "3", "8"} {
+		assertCountsMatch(t, "bzip2 width "+width, wanted, allCounts(t, "-f", "7", "-w", width, bz2Name))
+	}
+}
+
+func TestCompressedStreams(t *testing.T) {
+	input := "a\nb\nb\nc\nc\nc\n"
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, _ = zw.Write([]byte(input))
+	_ = zw.Close()
+
+	c, _ := Configure([]string{})
+	for _, stream := range []string{input, gz.String()} {
+		kc, err := Run(c, strings.NewReader(stream))
+		if err != nil {
+			t.Fatal("Run: " + err.Error())
+		}
+		wanted := []*keyCount{{Key: "c", Count: pv(3)}, {Key: "b", Count: pv(2)}, {Key: "a", Count: pv(1)}}
+		assertKeyCountsEqual(t, wanted, kc)
+	}
+
+	// too short to sniff, and text that starts like a bzip2 header
+	for _, stream := range []string{"a\n", "BZh9 is not bzip2\n"} {
+		kc, err := Run(c, strings.NewReader(stream))
+		if err != nil || len(kc) != 1 {
+			t.Errorf("on <%s>: %v %v", stream, kc, err)
+		}
+	}
+
+	zstd := "\x28\xb5\x2f\xfd" + input
+	if _, err := Run(c, strings.NewReader(zstd)); err == nil {
+		t.Error("accepted zstd stream")
+	}
+	zstdName := writeTemp(t, "zst", []byte(zstd))
+	defer func() { _ = os.Remove(zstdName) }()
+	c, _ = Configure([]string{zstdName})
+	if _, err := Run(c, nil); err == nil {
+		t.Error("accepted zstd file")
+	}
+
+	truncated := writeTemp(t, "trunc", gz.Bytes()[:len(gz.Bytes())-12])
+	defer func() { _ = os.Remove(truncated) }()
+	c, _ = Configure([]string{truncated})
+	if _, err := Run(c, nil); err == nil {
+		t.Error("accepted truncated gzip file")
+	}
+}
+
+func TestCompressedCSV(t *testing.T) {
+	input := "name,note\na,\"x\ny\"\nb,plain\nc,\"x\ny\"\n"
+	bgzf := makeBGZF(t, []byte(input), 5)
+	name := writeTemp(t, "csv-bgzf", bgzf)
+	defer func() { _ = os.Remove(name) }()
+	assertCountsMatch(t, "csv", map[string]uint64{"x\ny": 2, "plain": 1},
+		allCounts(t, "--csv", "-f", "note", "-w", "4", name))
+}
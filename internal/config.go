@@ -3,26 +3,72 @@ package topfew
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
-	"strings"
+	"time"
 )
 
 type config struct {
 	size           int
-	fields         []uint
+	fields         []fieldRange
+	jsonPaths      [][]jsonStep
+	missing        int
+	csv            *csvFormat
+	format         *logFormat
+	keyFormat      *formatFinder
+	sum            bool
+	sumFields      []fieldRange
+	sumPath        []jsonStep
+	sumCSV         *csvFormat
+	sumFormat      *formatFinder
+	nonNumeric     int
+	maxKeys        int
+	output         int
+	fieldNames     []string
+	follow         bool
+	interval       time.Duration
+	time           *fieldSpec
+	timeFormat     timeFormat
+	window         time.Duration
+	slide          time.Duration
+	groupBy        *fieldSpec
+	groups         int
+	distinct       *fieldSpec
+	bottom         bool
+	percent        bool
+	cumulative     bool
+	other          bool
+	value          *fieldSpec
+	extract        *regexp.Regexp
+	transforms     [][]keyTransform
+	where          []*whereClause
 	fieldSeparator *regexp.Regexp
-	Fname          string
+	fnames         []string
+	include        []string
+	exclude        []string
 	filter         filters
 	width          int
 	sample         bool
+	stats          bool
+	onError        int
+	maxWarnings    int
+	rejects        string
+	warnings       io.Writer
 	quotedFields   bool
 }
 
+// Configure turns command-line arguments into a config ready to Run.
 func Configure(args []string) (*config, error) {
 	// lifted out of main.go to facilitate testing
-	config := config{size: 10}
+	var opts Options
+	var fnames []string
+	var sample, follow, stats bool
+	interval := 2 * time.Second
+	intervalSet := false
+	output := outputText
 	var err error
 
 	i := 0
@@ -34,9 +80,9 @@ func Configure(args []string) (*config, error) {
 				err = errors.New("insufficient arguments for --number")
 			} else {
 				i++
-				config.size, err = strconv.Atoi(args[i])
-				if err == nil && config.size < 1 {
-					err = fmt.Errorf("invalid size %d", config.size)
+				opts.Number, err = strconv.Atoi(args[i])
+				if err == nil && opts.Number < 1 {
+					err = fmt.Errorf("invalid size %d", opts.Number)
 				}
 			}
 		case arg == "-f" || arg == "--fields":
@@ -44,40 +90,234 @@ func Configure(args []string) (*config, error) {
 				err = errors.New("insufficient arguments for --fields")
 			} else {
 				i++
-				config.fields, err = parseFields(args[i])
+				opts.Fields = args[i]
 			}
 		case arg == "-p" || arg == "--fieldseparator":
 			if (i + 1) >= len(args) {
 				err = errors.New("insufficient arguments for --fieldseparator")
 			} else {
 				i++
-				config.fieldSeparator, err = regexp.Compile(args[i])
+				opts.FieldSeparator = args[i]
+			}
+		case arg == "--extract":
+			if (i + 1) >= len(args) {
+				err = errors.New("insufficient arguments for --extract")
+			} else {
+				i++
+				opts.Extract = args[i]
+			}
+		case arg == "--where":
+			if (i + 1) >= len(args) {
+				err = errors.New("insufficient arguments for --where")
+			} else {
+				i++
+				opts.Where = append(opts.Where, args[i])
+			}
+		case arg == "--transform":
+			if (i + 1) >= len(args) {
+				err = errors.New("insufficient arguments for --transform")
+			} else {
+				i++
+				opts.Transform = append(opts.Transform, args[i])
 			}
 		case arg == "-g" || arg == "--grep":
 			if (i + 1) >= len(args) {
 				err = errors.New("insufficient arguments for --grep")
 			} else {
 				i++
-				err = config.filter.addGrep(args[i])
+				opts.Grep = append(opts.Grep, args[i])
 			}
 		case arg == "-v" || arg == "--vgrep":
 			if (i + 1) >= len(args) {
 				err = errors.New("insufficient arguments for --vgrep")
 			} else {
 				i++
-				err = config.filter.addVgrep(args[i])
+				opts.Vgrep = append(opts.Vgrep, args[i])
 			}
 		case arg == "-s" || arg == "--sed":
 			if (i + 2) >= len(args) {
 				err = errors.New("insufficient arguments for --sed")
 			} else {
-				err = config.filter.addSed(args[i+1], args[i+2])
+				opts.Sed = append(opts.Sed, Substitution{args[i+1], args[i+2]})
 				i += 2
 			}
+		case arg == "-j" || arg == "--json":
+			opts.JSON = true
+		case arg == "--missing":
+			if (i + 1) >= len(args) {
+				err = errors.New("insufficient arguments for --missing")
+			} else {
+				i++
+				opts.Missing = args[i]
+			}
+		case arg == "--format":
+			if (i + 1) >= len(args) {
+				err = errors.New("insufficient arguments for --format")
+			} else {
+				i++
+				opts.Format = args[i]
+			}
+		case arg == "--csv":
+			opts.CSV = true
+		case arg == "--tsv":
+			opts.TSV = true
+		case arg == "--header":
+			opts.Header = true
+		case arg == "--sum":
+			if (i + 1) >= len(args) {
+				err = errors.New("insufficient arguments for --sum")
+			} else {
+				i++
+				opts.Sum = args[i]
+			}
+		case arg == "--nonnumeric":
+			if (i + 1) >= len(args) {
+				err = errors.New("insufficient arguments for --nonnumeric")
+			} else {
+				i++
+				opts.NonNumeric = args[i]
+			}
+		case arg == "--max-keys":
+			if (i + 1) >= len(args) {
+				err = errors.New("insufficient arguments for --max-keys")
+			} else {
+				i++
+				opts.MaxKeys, err = strconv.Atoi(args[i])
+				if err == nil && opts.MaxKeys < 1 {
+					err = fmt.Errorf("invalid --max-keys %d", opts.MaxKeys)
+				}
+			}
+		case arg == "--include":
+			if (i + 1) >= len(args) {
+				err = errors.New("insufficient arguments for --include")
+			} else {
+				i++
+				opts.Include = append(opts.Include, args[i])
+			}
+		case arg == "--exclude":
+			if (i + 1) >= len(args) {
+				err = errors.New("insufficient arguments for --exclude")
+			} else {
+				i++
+				opts.Exclude = append(opts.Exclude, args[i])
+			}
+		case arg == "--output":
+			if (i + 1) >= len(args) {
+				err = errors.New("insufficient arguments for --output")
+			} else {
+				i++
+				output, err = parseOutput(args[i])
+			}
+		case arg == "--time":
+			if (i + 1) >= len(args) {
+				err = errors.New("insufficient arguments for --time")
+			} else {
+				i++
+				opts.Time = args[i]
+			}
+		case arg == "--time-format":
+			if (i + 1) >= len(args) {
+				err = errors.New("insufficient arguments for --time-format")
+			} else {
+				i++
+				opts.TimeFormat = args[i]
+			}
+		case arg == "--window":
+			if (i + 1) >= len(args) {
+				err = errors.New("insufficient arguments for --window")
+			} else {
+				i++
+				opts.Window, err = time.ParseDuration(args[i])
+			}
+		case arg == "--slide":
+			if (i + 1) >= len(args) {
+				err = errors.New("insufficient arguments for --slide")
+			} else {
+				i++
+				opts.Slide, err = time.ParseDuration(args[i])
+			}
+		case arg == "--group-by":
+			if (i + 1) >= len(args) {
+				err = errors.New("insufficient arguments for --group-by")
+			} else {
+				i++
+				opts.GroupBy = args[i]
+			}
+		case arg == "--groups":
+			if (i + 1) >= len(args) {
+				err = errors.New("insufficient arguments for --groups")
+			} else {
+				i++
+				opts.Groups, err = strconv.Atoi(args[i])
+				if err == nil && opts.Groups < 1 {
+					err = fmt.Errorf("invalid --groups %d", opts.Groups)
+				}
+			}
+		case arg == "--distinct":
+			if (i + 1) >= len(args) {
+				err = errors.New("insufficient arguments for --distinct")
+			} else {
+				i++
+				opts.Distinct = args[i]
+			}
+		case arg == "--value":
+			if (i + 1) >= len(args) {
+				err = errors.New("insufficient arguments for --value")
+			} else {
+				i++
+				opts.Value = args[i]
+			}
+		case arg == "--bottom" || arg == "--rarest":
+			opts.Bottom = true
+		case arg == "--percent":
+			opts.Percent = true
+		case arg == "--cumulative":
+			opts.Cumulative = true
+		case arg == "--other":
+			opts.Other = true
+		case arg == "--follow":
+			follow = true
+		case arg == "--stats":
+			stats = true
+		case arg == "--on-error":
+			if (i + 1) >= len(args) {
+				err = errors.New("insufficient arguments for --on-error")
+			} else {
+				i++
+				opts.OnError = args[i]
+			}
+		case arg == "--max-warnings":
+			if (i + 1) >= len(args) {
+				err = errors.New("insufficient arguments for --max-warnings")
+			} else {
+				i++
+				opts.MaxWarnings, err = strconv.Atoi(args[i])
+				if err == nil && opts.MaxWarnings < 1 {
+					err = fmt.Errorf("invalid --max-warnings %d", opts.MaxWarnings)
+				}
+			}
+		case arg == "--rejects":
+			if (i + 1) >= len(args) {
+				err = errors.New("insufficient arguments for --rejects")
+			} else {
+				i++
+				opts.Rejects = args[i]
+			}
+		case arg == "--interval":
+			if (i + 1) >= len(args) {
+				err = errors.New("insufficient arguments for --interval")
+			} else {
+				i++
+				interval, err = time.ParseDuration(args[i])
+				if err == nil && interval <= 0 {
+					err = fmt.Errorf("invalid interval %s", args[i])
+				}
+				intervalSet = true
+			}
 		case arg == "--sample":
-			config.sample = true
+			sample = true
 		case arg == "--quotedfields" || arg == "-q":
-			config.quotedFields = true
+			opts.QuotedFields = true
 		case arg == "-h" || arg == "-help" || arg == "--help":
 			fmt.Println(instructions)
 			os.Exit(0)
@@ -86,9 +326,9 @@ func Configure(args []string) (*config, error) {
 				err = errors.New("insufficient arguments for --width")
 			} else {
 				i++
-				config.width, err = strconv.Atoi(args[i])
-				if err == nil && config.width < 1 {
-					err = fmt.Errorf("invalid width %d", config.width)
+				opts.Width, err = strconv.Atoi(args[i])
+				if err == nil && opts.Width < 1 {
+					err = fmt.Errorf("invalid width %d", opts.Width)
 				}
 			}
 
@@ -96,7 +336,7 @@ func Configure(args []string) (*config, error) {
 			if arg[0] == '-' {
 				err = fmt.Errorf("unexpected flag argument %v", arg)
 			} else {
-				config.Fname = args[i]
+				fnames = append(fnames, args[i])
 			}
 		}
 		if err != nil {
@@ -104,30 +344,307 @@ func Configure(args []string) (*config, error) {
 		}
 		i++
 	}
+
+	opts.Warnings = os.Stderr
+	config, err := newConfig(&opts)
+	if err != nil {
+		return nil, err
+	}
+	if follow && (len(fnames) > 1 || sample) {
+		return nil, errors.New("--follow works with one file or the standard input, and not with --sample")
+	} else if intervalSet && !follow {
+		return nil, errors.New("--interval only applies to --follow")
+	}
+	config.fnames = fnames
+	config.sample = sample
+	// --sample stops at the first record the key can't be extracted from, unless --on-error says otherwise
+	if sample && opts.OnError == "" {
+		config.onError = onErrorFail
+	}
+	config.follow = follow
+	config.stats = stats
+	config.interval = interval
+	config.output = output
+	config.fieldNames = outputFieldNames(opts.Fields)
+	if config.extract != nil {
+		config.fieldNames = extractFieldNames(config.extract)
+	}
+	return config, nil
+}
+
+// newConfig checks the Options and compiles them into a config. This is where Configure and library callers
+// meet, so all the checking that doesn't depend on command-line syntax happens here.
+func newConfig(opts *Options) (*config, error) {
+	config := config{size: 10, width: opts.Width, quotedFields: opts.QuotedFields}
+	var err error
+
+	if opts.Number < 0 {
+		return nil, fmt.Errorf("invalid size %d", opts.Number)
+	} else if opts.Number > 0 {
+		config.size = opts.Number
+	}
+	if opts.Width < 0 {
+		return nil, fmt.Errorf("invalid width %d", opts.Width)
+	}
+	if opts.MaxKeys < 0 || (opts.MaxKeys > 0 && opts.MaxKeys < config.size) {
+		return nil, fmt.Errorf("--max-keys %d must be at least the number of keys to report", opts.MaxKeys)
+	}
+	config.maxKeys = opts.MaxKeys
+	config.format, err = parseLogFormat(opts.Format)
+	if err != nil {
+		return nil, err
+	}
+	if config.format != nil && (opts.JSON || opts.CSV || opts.TSV || opts.FieldSeparator != "" || opts.QuotedFields) {
+		return nil, errors.New("--format may not be combined with -j, --csv, --tsv, -p, or -q")
+	}
+	if opts.CSV || opts.TSV {
+		if opts.JSON || opts.FieldSeparator != "" || opts.QuotedFields || (opts.CSV && opts.TSV) {
+			return nil, errors.New("--csv and --tsv may not be combined with each other or -j, -p, or -q")
+		}
+		separator := byte(',')
+		if opts.TSV {
+			separator = '\t'
+		}
+		config.csv, err = newCSVFormat(separator, opts.Fields, opts.Header)
+		if err != nil {
+			return nil, err
+		}
+	} else if opts.Header {
+		return nil, errors.New("--header only applies to --csv and --tsv")
+	}
+	if opts.JSON {
+		if opts.Fields != "" {
+			config.jsonPaths, err = parseJSONPaths(opts.Fields)
+			if err != nil {
+				return nil, err
+			}
+		}
+		config.missing, err = parseMissing(opts.Missing)
+		if err != nil {
+			return nil, err
+		}
+		if opts.FieldSeparator != "" || opts.QuotedFields {
+			return nil, errors.New("-j/--json may not be combined with -p/--fieldseparator or -q/--quotedfields")
+		}
+	} else if opts.Missing != "" {
+		return nil, errors.New("--missing only applies to -j/--json")
+	} else if config.format != nil {
+		config.keyFormat, err = newFormatFinder(config.format, opts.Fields)
+		if err != nil {
+			return nil, err
+		}
+	} else if opts.Fields != "" && config.csv == nil {
+		config.fields, err = parseFields(opts.Fields)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.Sum != "" {
+		if err = config.parseSum(opts); err != nil {
+			return nil, err
+		}
+	} else if opts.NonNumeric != "" {
+		return nil, errors.New("--nonnumeric only applies to --sum")
+	}
+	if opts.Time != "" || opts.Window != 0 || opts.Slide != 0 {
+		if err = config.parseWindow(opts); err != nil {
+			return nil, err
+		}
+	} else if opts.TimeFormat != "" {
+		return nil, errors.New("--time-format only applies to --time")
+	}
+	if opts.Groups < 0 {
+		return nil, fmt.Errorf("invalid --groups %d", opts.Groups)
+	} else if opts.GroupBy != "" {
+		if opts.MaxKeys > 0 {
+			return nil, errors.New("--group-by may not be combined with --max-keys")
+		}
+		config.groupBy, err = config.parseFieldSpec(opts.GroupBy, opts)
+		if err != nil {
+			return nil, err
+		}
+		config.groups = opts.Groups
+	} else if opts.Groups > 0 {
+		return nil, errors.New("--groups only applies to --group-by")
+	}
+	if opts.Value != "" {
+		if opts.MaxKeys > 0 {
+			return nil, errors.New("--value may not be combined with --max-keys")
+		}
+		config.value, err = config.parseFieldSpec(opts.Value, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.Bottom && opts.MaxKeys > 0 {
+		return nil, errors.New("--bottom may not be combined with --max-keys")
+	}
+	config.bottom = opts.Bottom
+	config.percent = opts.Percent
+	config.cumulative = opts.Cumulative
+	config.other = opts.Other
+	config.onError, err = parseOnError(opts.OnError)
+	if err != nil {
+		return nil, err
+	}
+	if opts.MaxWarnings < 0 || (opts.MaxWarnings > 0 && config.onError != onErrorWarn) {
+		return nil, errors.New("--max-warnings only applies to --on-error warn")
+	}
+	config.maxWarnings = opts.MaxWarnings
+	config.rejects = opts.Rejects
+	config.warnings = opts.Warnings
+	if config.warnings == nil {
+		config.warnings = io.Discard
+	}
+	if opts.Distinct != "" {
+		if opts.Sum != "" || opts.MaxKeys > 0 {
+			return nil, errors.New("--distinct may not be combined with --sum or --max-keys")
+		}
+		config.distinct, err = config.parseFieldSpec(opts.Distinct, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.FieldSeparator != "" {
+		config.fieldSeparator, err = regexp.Compile(opts.FieldSeparator)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.Extract != "" {
+		config.extract, err = regexp.Compile(opts.Extract)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --extract: %w", err)
+		}
+	}
+	for _, where := range opts.Where {
+		clause, err := config.parseWhere(where, opts)
+		if err != nil {
+			return nil, err
+		}
+		config.where = append(config.where, clause)
+	}
+	if len(opts.Transform) > 0 {
+		config.transforms, err = parseTransforms(opts.Transform, keyFieldNames(opts.Fields, config.extract))
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, grep := range opts.Grep {
+		if err = config.filter.addGrep(grep); err != nil {
+			return nil, err
+		}
+	}
+	for _, vgrep := range opts.Vgrep {
+		if err = config.filter.addVgrep(vgrep); err != nil {
+			return nil, err
+		}
+	}
+	for _, sed := range opts.Sed {
+		if err = config.filter.addSed(sed.ReplaceThis, sed.WithThat); err != nil {
+			return nil, err
+		}
+	}
+	for _, glob := range append(append([]string{}, opts.Include...), opts.Exclude...) {
+		if _, err = filepath.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("bad glob \"%s\": %w", glob, err)
+		}
+	}
+	config.include = opts.Include
+	config.exclude = opts.Exclude
 	if (config.fieldSeparator != nil) && config.quotedFields {
-		err = errors.New("only one of -p/--fieldseparator and -q/--quotedfields may be specified")
+		return nil, errors.New("only one of -p/--fieldseparator and -q/--quotedfields may be specified")
 	}
 
-	return &config, err
+	return &config, nil
 }
 
-func parseFields(spec string) ([]uint, error) {
-	parts := strings.Split(spec, ",")
-	var fields []uint
-	lastNum := -1
-	for _, part := range parts {
-		num, err := strconv.Atoi(part)
+// parseSum sets up the --sum field, which is specified in the same way as the key fields
+func (config *config) parseSum(opts *Options) error {
+	var err error
+	config.sum = true
+	config.nonNumeric, err = parseNonNumeric(opts.NonNumeric)
+	if err != nil {
+		return err
+	}
+	switch {
+	case config.csv != nil:
+		config.sumCSV, err = newCSVFormat(config.csv.separator, opts.Sum, opts.Header)
+		if err != nil {
+			return err
+		}
+		if len(config.sumCSV.columns) != 1 {
+			return errors.New("--sum takes a single field")
+		}
+		// naming the column to sum means there's a header
+		if config.sumCSV.awaitingHeader {
+			config.csv.awaitingHeader = true
+		}
+	case opts.JSON:
+		config.sumPath, err = parseJSONPath(opts.Sum)
+		if err != nil {
+			return err
+		}
+	case config.format != nil:
+		config.sumFormat, err = newFormatFinder(config.format, opts.Sum)
 		if err != nil {
-			return nil, fmt.Errorf("illegal field spec: %w", err)
+			return err
 		}
-		if num <= lastNum {
-			return nil, fmt.Errorf("field-number list must be in order; problem at \"%d\"", num)
-		} else {
-			lastNum = num
+		if len(config.sumFormat.names) != 1 {
+			return errors.New("--sum takes a single field")
+		}
+	default:
+		config.sumFields, err = parseFields(opts.Sum)
+		if err != nil {
+			return err
+		}
+		if len(config.sumFields) != 1 || !config.sumFields[0].single() {
+			return errors.New("--sum takes a single field")
 		}
-		fields = append(fields, uint(num))
 	}
-	return fields, nil
+	return nil
+}
+
+// fieldSpec says where to find a field other than the key, like --time or --distinct, which is specified
+// in the same way as the key fields: by number, JSON path, or CSV column
+type fieldSpec struct {
+	fields []fieldRange
+	paths  [][]jsonStep
+	csv    *csvFormat
+	format *formatFinder
+}
+
+// parseFieldSpec reads a field list in whatever form suits the input format
+func (config *config) parseFieldSpec(spec string, opts *Options) (*fieldSpec, error) {
+	var err error
+	fs := &fieldSpec{}
+	switch {
+	case config.csv != nil:
+		fs.csv, err = newCSVFormat(config.csv.separator, spec, opts.Header)
+		if err != nil {
+			return nil, err
+		}
+		// naming a column means there's a header
+		if fs.csv.awaitingHeader {
+			config.csv.awaitingHeader = true
+		}
+	case opts.JSON:
+		fs.paths, err = parseJSONPaths(spec)
+		if err != nil {
+			return nil, err
+		}
+	case config.format != nil:
+		fs.format, err = newFormatFinder(config.format, spec)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		fs.fields, err = parseFields(spec)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fs, nil
 }
 
 const instructions = `
@@ -137,22 +654,59 @@ order of occurrences.
 
 Usage:topfew
 	-n, --number (output line count) [default is 10]
+	--bottom, --rarest [default is to list the most common keys]
 	-f, --fields (field list) [default is the whole record]
 	-p, --fieldseparator (field separator regex) [default is white space]
 	-q, --quotedfields [default is false]
+	-j, --json [default is false]
+	--csv, --tsv [default is false]
+	--header [default is false]
+	--format (apache-common|apache-combined|nginx|w3c|syslog) [no default]
+	--extract (regexp) [default is the fields themselves]
+	--transform ([field=]transform,...) [may repeat, default is no changes]
+	--missing (skip|null|error) [default is error]
 	-g, --grep (regexp) [may repeat, default is accept all]
 	-v, --vgrep (regexp) [may repeat, default is reject none]
+	--where (expression) [may repeat, default is accept all]
 	-s, --sed (regexp) (replacement) [may repeat, default is no changes]
 	-w, --width (segment count) [default is result of runtime.numCPU()]
+	--sum (field) [default is to count records]
+	--nonnumeric (zero|skip|error) [default is zero]
+	--max-keys (key count) [default is to count every key exactly]
+	--time (field list) [no default]
+	--time-format (rfc3339|apache|unix|unixms|syslog|Go layout) [default is rfc3339]
+	--window (duration) [default is one list for all the records]
+	--slide (duration) [default is windows that don't overlap]
+	--group-by (field list) [default is one list for all the records]
+	--groups (group count) [default is all groups]
+	--distinct (field list) [default is to count records]
+	--value (field list) [default is no value summaries]
+	--percent [default is false]
+	--cumulative [default is false]
+	--other [default is false]
+	--include (glob) [may repeat, default is all files in directories]
+	--exclude (glob) [may repeat, default is none]
+	--output (text|json|csv|tsv) [default is text]
+	--stats [default is false]
+	--on-error (skip|warn|fail) [default is warn]
+	--max-warnings (count) [default is no limit]
+	--rejects (filename) [default is none]
+	--follow [keep reading as the file grows, printing results periodically]
+	--interval (duration) [how often --follow prints, default is 2s]
 	--sample
 	-h, -help, --help
-	filename [default is stdin]
+	filename... [default is stdin]
 
 All the arguments are optional; if none are provided, topfew will read records
 from the standard input and list the 10 which occur most often.
 
-Field list is comma-separated integers, e.g. -f 3 or --fields 1,3,7. The fields
-must be provided in order, so 3,1,7 is an error.
+--bottom lists the keys which occur least often instead, in increasing order of
+count, and of key for those with the same count. It can't be combined with
+--max-keys.
+
+Field list is comma-separated integers, e.g. -f 3 or --fields 1,3,7, in any
+order. Negative numbers count from the end, so -1 is the last field, and
+ranges like 3-6, 5- (the fifth to the last), and -3--1 may be used.
 
 Fields are separated by white space (spaces or tabs) by default.
 This can be overridden with the --fieldseparator option, at some cost in
@@ -163,6 +717,56 @@ allow spaces within fields which are quoted with ("). The -q/--quotedfields
 allows topfew to process these correctly. It is an error to specify both
 -p and -q.
 
+With -j/--json, each record is taken to be a JSON text, as in NDJSON files, and
+the field list is made of comma-separated paths into it, e.g.
+-f request.method,response.status or -f tags[0]. String values are decoded,
+others are used as they appear. If a record has nothing at one of the paths,
+--missing says what to do: "skip" ignores the record, "null" counts it with
+the value null, and "error" (the default) reports it. -j may not be combined
+with -p or -q.
+
+With --csv or --tsv, records and fields follow the RFC 4180 rules: fields are
+separated by commas (or tabs), and "-quoted fields may contain separators,
+doubled "" quotes, and even newlines. The field list may then include column
+names from a header record as well as numbers, in any order, e.g. -f country,3.
+--header says the first record is a header, which isn't counted; naming a
+column implies it. These options may not be combined with -j, -p, or -q.
+
+--format reads a well-known log format and lets fields be named, e.g.
+--format nginx -f status,path. apache-common has ip, ident, user, time,
+request, status and bytes; apache-combined and nginx add referer and ua; the
+request is also split into method, path and protocol. w3c takes its names from
+#Fields directives, and also knows ip, method, path, status etc. syslog has
+time, host, program, pid and message. With --window, --time and --time-format
+default to the format's. --format may not be combined with -j, --csv, --tsv,
+-p or -q.
+
+--extract makes the key from what a regexp's capture groups match in the
+record, or in the fields if there's a field list, e.g. --extract '/(\w+)/'.
+If it has named groups, only those are used; with no groups, the key is the
+whole match. Records it doesn't match are dealt with as --on-error says.
+
+--transform rewrites fields of the key with a pipeline of transforms, e.g.
+--transform ip=ipmask:24 or --transform path=urlpath,lower; the field is as
+in the field list, or an --extract group, and without one, all the fields are
+transformed. The transforms are lower, upper, trim, urlpath (no host, query or
+fragment), urlhost, ipmask:bits (ipmask:bits:bits6 for IPv6, default 64),
+truncate:length, and hash. They're applied after --extract and before --sed.
+
+--sum ranks keys by the total of a numeric field rather than by how many
+records have them, e.g. to find which clients fetched the most bytes. The field
+is given in the same way as those in the field list. Integers and decimals are
+accepted; --nonnumeric says what to do with values like "-" which aren't
+numbers: "zero" (the default) counts the record with a value of zero, "skip"
+ignores it, and "error" reports it.
+
+With --max-keys, topfew uses a fixed amount of memory however many different
+keys there are, by only keeping track of that many of them, e.g. 100000, in
+each thread. Counts are then approximate: each is followed by ± and the most by
+which it may be too high; it's never too low. Any key which makes up more than
+1/max-keys of the records is sure to be counted. With --sum, negative values
+can't be used with --max-keys.
+
 The regexp-valued fields work as follows:
 -g/--grep discards records that don't match the regexp (g for grep)
 -v/--vgrep discards records that do match the regexp (v for grep -v)
@@ -171,12 +775,88 @@ The regexp-valued fields work as follows:
 The regexp-valued fields can be supplied multiple times; the filtering
 and substitution will be performed in the order supplied.
 
-If the input is a named file, topfew will process it in multiple parallel
-threads, which can dramatically improve performance. The --width argument
-allows you to specify the number of threads. The default value is not always 
+--where only counts records that satisfy an expression made of predicates
+on fields, e.g. --where 'status>=500', --where 'method==POST' or --where
+'path~^/api/'. The field is specified like those in the field list, and the
+operators are ==, !=, <, <=, >, >=, ~ and !~ (regexp match); without a field,
+as in ~regexp, the predicate is about the whole record. With a numeric value,
+the field is compared as a number, otherwise as a string. A record without the
+field doesn't satisfy the predicate. Predicates combine with and, or, not (or
+&&, ||, !) and parentheses, e.g. '(status>=500 or bytes>1e6) and not ua~bot';
+quote values containing those. --where may repeat; all must be satisfied.
+
+Any number of file and directory names may be given, and the counts cover all
+of them. Directories are searched recursively; --include and --exclude give
+globs, e.g. --include '*.log', which the names of files found in directories
+must and must not match. Glob patterns in file names are expanded.
+
+--output json, csv, or tsv prints the results in a form that's easy for
+programs to read. Each result has its count, the sum and error if there are
+any, the key, and, if there's more than one field in the field list, each of
+the fields separately. JSON output is an array of objects, and CSV and TSV
+start with a row of column names; fields are named field1, field2 etc. unless
+they are given by name. In these formats, the regexps in --sed don't see a
+space between the fields but a \x1f (ASCII unit separator) character.
+
+With --window, e.g. --window 1h, there's a top list for each window of time
+rather than one for all the records. Each record's time is read from the
+--time field or fields, which are specified like the field list and joined
+with spaces, and written as --time-format says: rfc3339, apache as in
+[12/Mar/2007:08:04:39 -0800], which is -f 4,5 in Apache logs, unix or unixms
+seconds or milliseconds since 1970, syslog as in Mar  1 12:34:56, or a Go time
+layout like 2006-01-02. Windows
+are aligned to the Unix epoch, and with --slide, e.g. --slide 5m, they overlap,
+a new one starting that often. --window can't be combined with --max-keys.
+
+With --group-by, there's a top list for each value of the --group-by field or
+fields, which are specified like the field list, e.g. for each virtual host.
+Groups are ranked by their number of records, or with --sum, their totals, and
+--groups says how many to report. --group-by can't be combined with
+--max-keys.
+
+--distinct ranks keys by how many different values of another field, specified
+like the field list, they occur with, e.g. which URLs were fetched by the most
+different clients. Up to 1024, the numbers are exact, and beyond that, they
+are HyperLogLog estimates, within a few percent. --distinct can't be combined
+with --sum or --max-keys.
+
+--value summarizes another numeric field for each key, e.g. response times:
+the min, max, mean, and total, and the p50, p90, and p99 percentiles, which
+are within 1%. Values that aren't numbers are left out. --value can't be
+combined with --max-keys.
+
+--on-error says what to do with records that the key can't be extracted from:
+"warn" (the default) prints each on stderr, or only --max-warnings of them,
+"skip" leaves them out quietly, and "fail" stops with an error. --rejects
+writes them to a file, whatever the policy.
+
+--stats prints, on stderr, how many records and bytes were read, how many
+records each --grep and --vgrep rejected, how many had key errors or were
+skipped, how many were counted, and how many different keys there were, and the
+time and throughput overall and for each segment.
+
+--percent adds each key's share of the records, or with --sum, of the total,
+after the count, and --cumulative adds the running total of the shares.
+--other ends each list with a row for all the keys that aren't in it.
+
+With --follow, topfew keeps reading as data is added to the file, like
+tail -F, coping with the file being truncated or replaced by log rotation, and
+prints the top list every --interval, e.g. 500ms or 1m, if it has changed. If
+the output is a terminal, the screen is redrawn each time. With no file name,
+it reads the standard input the same way, until it ends. Compressed input isn't
+recognized in this mode.
+
+topfew processes its input in multiple parallel threads, which can
+dramatically improve performance. Named files are divided into segments; the
+standard input is read in chunks which are handed out to the threads. The
+--width argument allows you to specify the number of threads. The default value is not always 
 optimal; experience with particular data on a particular computer may lead 
 to finding a better value.
 
+Files and streams compressed with gzip or bzip2 are decompressed on the fly.
+Compressed files are only processed in parallel if they are made of multiple
+independent members, as written by bgzip and pbzip2.
+
 It can be difficult to get the regular expressions right. "--sample"
 causes topfew to read records and print out the results of the 
 filtering activities. It only works on standard input.`
@@ -7,7 +7,7 @@ func TestArgSyntax(t *testing.T) {
 		{"-donkey"},
 		{"-n", "0"}, {"--number", "-3"}, {"-n", ""}, {"--number", "two"}, {"-n"},
 		{"--fields"}, {"--sample", "-f"},
-		{"-f", "a"}, {"-f", "1,2,z,4"}, {"-f", "1,3,2"},
+		{"-f", "a"}, {"-f", "1,2,z,4"}, {"-f", "1,3-2"}, {"-f", "0"}, {"-f", "-3--4"}, {"-f", "2-x"}, {"-f", "-"}, {"--sum", "2-3"},
 		{"--sample", "--cpuprofile"}, {"--cpuprofile"},
 		{"--grep"}, {"--sample", "-g"},
 		{"--vgrep"}, {"--sample", "-vg"},
@@ -16,13 +16,40 @@ func TestArgSyntax(t *testing.T) {
 		{"--width", "a"}, {"-w", "0"}, {"--sample", "-w"},
 		{"--sample", "-p"}, {"--fieldseparator", "a["},
 		{"--fieldseparator", "x", "-q"}, {"--quotedfields", "-f", "z"},
+		{"--missing"}, {"--missing", "skip"}, {"-j", "--missing", "ignore"}, {"-j", "-f", "a..b"},
+		{"-j", "-q"}, {"--json", "-p", ","},
+		{"--csv", "--tsv"}, {"--csv", "-j"}, {"--tsv", "-q"}, {"--csv", "-p", ","}, {"--header"},
+		{"--csv", "-f", "0"}, {"--csv", "-f", "a,,b"},
+		{"--sum"}, {"--sum", "x"}, {"--sum", "1,2"}, {"--sum", "0"}, {"-j", "--sum", "a..b"},
+		{"--csv", "--sum", "a,b"}, {"--nonnumeric", "skip"}, {"--sum", "3", "--nonnumeric", "nan"},
+		{"--max-keys"}, {"--max-keys", "0"}, {"--max-keys", "x"}, {"-n", "20", "--max-keys", "19"},
+		{"--output"}, {"--output", "xml"}, {"--output", "JSON"},
+		{"--include"}, {"--exclude"}, {"--include", "[a-"}, {"--exclude", "x", "--exclude", "\\"},
+		{"--follow", "a", "b"}, {"--follow", "--sample"}, {"--interval", "1s"}, {"--follow", "--interval"},
+		{"--follow", "--interval", "0s"}, {"--follow", "--interval", "-1s"}, {"--follow", "--interval", "5"},
+		{"--time"}, {"--time", "4"}, {"--window", "1h"}, {"--time", "4", "--window", "1x"},
+		{"--time", "4", "--window", "-1h"}, {"--time", "0", "--window", "1h"}, {"--time-format", "unix"},
+		{"--time", "4", "--window", "1h", "--time-format", "tomorrow"}, {"--slide", "1m"},
+		{"--time", "4", "--window", "1h", "--slide", "2h"}, {"--time", "4", "--window", "1h", "--slide", "7m"},
+		{"--time", "4", "--window", "1h", "--max-keys", "100"},
+		{"--group-by"}, {"--group-by", "0"}, {"--groups", "3"}, {"--group-by", "1", "--groups", "0"},
+		{"--group-by", "1", "--groups", "x"}, {"--group-by", "1", "--max-keys", "100"}, {"-j", "--group-by", "a["},
+		{"--bottom", "--max-keys", "100"}, {"--distinct"}, {"--distinct", "0"}, {"--distinct", "1", "--sum", "2"}, {"--distinct", "1", "--max-keys", "9"},
+		{"--on-error"}, {"--on-error", "ignore"}, {"--max-warnings"}, {"--max-warnings", "0"},
+		{"--max-warnings", "x"}, {"--on-error", "skip", "--max-warnings", "5"}, {"--rejects"}, {"--extract"}, {"--extract", "(x"},
+		{"--where"}, {"--where", "status"}, {"--where", "x==1"}, {"--where", "1~("}, {"--where", "(1==2"},
+		{"--where", "1==2 or"}, {"--where", "not"},
+		{"--format", "nginx", "--where", "nope>1"}, {"--transform"}, {"--transform", "nope"}, {"-f", "1,2", "--transform", "3=lower"}, {"--transform", "ipmask:40"},
+		{"--format"}, {"--format", "iis"}, {"--format", "nginx", "-q"}, {"--format", "w3c", "--csv"},
+		{"--format", "nginx", "-f", "stat"}, {"--format", "syslog", "--sum", "pid,host"}, {"--format", "nginx", "--group-by", "x"},
+		{"--value"}, {"--value", "0"}, {"--value", "2", "--max-keys", "100"},
 	}
 
 	// not testing -h/--help because it'd be extra work to avoid printing out the usage
 	goods := [][]string{
 		{"-q", "fname"}, {"--quotedfields"},
 		{"--number", "1"}, {"-n", "5"},
-		{"--fields", "1"}, {"-f", "3,5"},
+		{"--fields", "1"}, {"-f", "3,5"}, {"-f", "7,1"}, {"-f", "3-6,-1,5-,-3--2"}, {"--sum", "-1"},
 		{"--grep", "re1"}, {"-g", "re2"},
 		{"--vgrep", "re1"}, {"-v", "re2"},
 		{"--sed", "foo", "bar"}, {"-s", "z", ""},
@@ -30,6 +57,30 @@ func TestArgSyntax(t *testing.T) {
 		{"--width", "2"}, {"-w", "3"},
 		{"--sample", "fname"},
 		{"-p", "a[bc]*d$"},
+		{"-j"}, {"--json", "-f", "a.b,c[2],3"}, {"-j", "--missing", "null"}, {"-j", "--missing", "skip"},
+		{"--json", "--missing", "error"},
+		{"--csv"}, {"--tsv", "--header"}, {"--csv", "-f", "3,1,name"}, {"--tsv", "-f", "a b,c"},
+		{"--sum", "3"}, {"-f", "1", "--sum", "10", "--nonnumeric", "skip"}, {"-j", "--sum", "a.b[1]"},
+		{"--csv", "--sum", "bytes", "--nonnumeric", "error"}, {"--tsv", "-f", "2", "--sum", "1"},
+		{"--max-keys", "10"}, {"-n", "5", "--max-keys", "1000", "--sum", "2"},
+		{"--output", "json"}, {"--output", "csv", "-f", "1,2"}, {"--output", "tsv"}, {"--output", "text"},
+		{"fname1", "fname2"}, {"--include", "*.log", "--include", "*.txt", "dir"}, {"--exclude", "*.gz"},
+		{"--follow"}, {"--follow", "fname"}, {"--follow", "--interval", "500ms", "-f", "1"},
+		{"--time", "4,5", "--time-format", "apache", "--window", "1h"}, {"-j", "--time", "a.t", "--window", "5m"},
+		{"--csv", "--time", "when", "--window", "1m", "--slide", "10s"}, {"--time", "3", "--window", "1h",
+			"--time-format", "2006-01-02"},
+		{"--group-by", "1"}, {"--group-by", "2,3", "--groups", "5"}, {"--csv", "--group-by", "host", "-f", "path"},
+		{"-j", "--group-by", "a.b", "--time", "t", "--window", "1m"},
+		{"--bottom"}, {"--rarest", "-n", "3"}, {"-f", "7", "--distinct", "1"}, {"--csv", "--distinct", "client", "--group-by", "host"},
+		{"-f", "7", "--value", "10"}, {"--percent"}, {"--stats"}, {"--on-error", "skip"}, {"--on-error", "fail", "--rejects", "bad.log"},
+		{"--max-warnings", "10"}, {"--on-error", "warn", "--max-warnings", "1"}, {"--stats", "-g", "x", "fname"}, {"--cumulative", "--other", "--max-keys", "100"},
+		{"-f", "3", "--extract", "^(?P<dir>/[^/]*)"}, {"-f", "1,3", "--transform", "3=urlpath,lower", "--transform", "field1=ipmask:24"},
+		{"-f", "3", "--extract", "^(?P<dir>/[^/]*)", "--transform", "dir=lower"}, {"--transform", "hash"},
+		{"--where", "9>=500", "--where", "6~^\"GET"}, {"--format", "nginx", "--where", "method != GET"},
+		{"--where", "==1"}, {"--format", "nginx", "--where", "(status>=500 or bytes>1e6) and not ua~HealthCheck"},
+		{"--csv", "--where", "status>=500", "-f", "path"}, {"-j", "--where", "a.b==c"}, {"--format", "apache-combined", "-f", "status,path", "--sum", "bytes"},
+		{"--format", "w3c", "-f", "anything", "--window", "1h"}, {"--format", "syslog", "--group-by", "host", "-f", "program"},
+		{"--percent", "--cumulative", "--other", "--group-by", "1", "--window", "1h", "--time", "4"}, {"--csv", "-f", "path", "--value", "ms", "--sum", "ms"},
 	}
 
 	for _, bad := range bads {
@@ -1,13 +1,75 @@
 package topfew
 
 import (
+	"hash/maphash"
+	"math"
 	"sort"
+	"time"
 )
 
-// keyCount represents a Key's occurrence count.
+// keyCount represents a Key's occurrence count. When the records are weighted, as with --sum, Sum is the
+// total of their weights, and is nil otherwise. When counts are approximate, as with --max-keys, Error is
+// the most by which Sum, or Count if the records aren't weighted, may exceed the true value. With --window,
+// Window is the start of the time window the count is for, and with --group-by, Group is the group's value.
+// With --distinct, Distinct is the number of different values of that field the Key occurred with, and with
+// --value, Values summarizes that field's values, unless none of them were numbers. With --percent and
+// --cumulative, Percent and Cumulative are the Key's share of the total and the running total of the shares.
+// With --other, the last result in a list can be the (other) row, standing for all the keys that aren't in
+// it, and then Keys is how many of them there are; it has no Error, because with --max-keys, its counts can
+// only be too low.
 type keyCount struct {
-	Key   string
-	Count *uint64
+	Key        string
+	Count      *uint64
+	Sum        *float64
+	Error      *float64
+	Window     *time.Time
+	Group      *string
+	Distinct   *uint64
+	Values     *ValueStats
+	Percent    *float64
+	Cumulative *float64
+	Keys       *uint64
+}
+
+// tally is what's known about a Key. Keys are ranked by sum, which is the total of the weights of the
+// records that had the Key; when they aren't weighted, each weighs one, so the sum is the same as the count.
+// With --distinct, distinct holds the values the Key occurred with, and sum is only filled in from it at
+// the end. With --value, values accumulates the statistics for that field.
+type tally struct {
+	count    uint64
+	sum      float64
+	distinct *distinctSet
+	values   *valueStats
+}
+
+// add puts other's counts into t
+func (t *tally) add(other *tally) {
+	t.count += other.count
+	t.sum += other.sum
+	if other.distinct != nil {
+		if t.distinct == nil {
+			t.distinct = newDistinctSet()
+		}
+		t.distinct.merge(other.distinct)
+	}
+	if other.values != nil {
+		if t.values == nil {
+			t.values = newValueStats()
+		}
+		t.values.merge(other.values)
+	}
+}
+
+// clone returns a copy of t which can be changed without affecting it
+func (t *tally) clone() *tally {
+	clone := *t
+	if t.distinct != nil {
+		clone.distinct = t.distinct.clone()
+	}
+	if t.values != nil {
+		clone.values = t.values.clone()
+	}
+	return &clone
 }
 
 // The core idea is that when you read a large number of field values and want to find the N values which
@@ -28,41 +90,107 @@ type keyCount struct {
 // the "top" map represents the keys & counts encountered so far which are higher than threshold
 // The hash values are pointers not integers for efficiency reasons, so you don't have to update the
 // map[string] mapping, you just update the number the Key maps to.
+// All this depends on sums only ever going up, which isn't true if there are negative weights; once one has
+// been seen, unordered is set and getTop looks at all the keys.
+// If sketch is set, the counts are approximate and kept there instead, see spaceSaving. If distinct is set,
+// keys are ranked by their numbers of distinct values, which aren't known until the end, so top isn't used.
+// Nor is it if bottom is set, because then it's the keys with the lowest counts that are wanted, and any
+// key's count might still go up; so getTop looks at all the keys.
+// total is the count and sum of all the records, whether their keys are in the top list or not. With a sketch,
+// which doesn't know how many keys there are, keys keeps track of their hashes. stats says what happened to
+// the records.
 type counter struct {
-	counts    map[string]*uint64
-	top       map[string]*uint64
-	threshold uint64
+	counts    map[string]*tally
+	top       map[string]*tally
+	threshold float64
 	size      int
+	weighted  bool
+	unordered bool
+	distinct  bool
+	bottom    bool
+	sketch    *spaceSaving
+	total     tally
+	keys      *distinctSet
+	stats     Stats
 }
 
 // newCounter creates a new empty counter, ready for use. size controls how many top items to track.
 func newCounter(size int) *counter {
 	t := new(counter)
 	t.size = size
-	t.counts = make(map[string]*uint64, 1024)
-	t.top = make(map[string]*uint64, size*2)
+	t.counts = make(map[string]*tally, 1024)
+	t.top = make(map[string]*tally, size*2)
+	return t
+}
+
+// newWeightedCounter creates a counter whose results include the sums of the weights added, as with --sum
+func newWeightedCounter(size int) *counter {
+	t := newCounter(size)
+	t.weighted = true
+	t.threshold = math.Inf(-1)
+	return t
+}
+
+// newDistinctCounter creates a counter which ranks keys by how many distinct values they occur with, as
+// with --distinct
+func newDistinctCounter(size int) *counter {
+	t := newCounter(size)
+	t.distinct = true
 	return t
 }
 
+// newApproxCounter creates a counter which tracks no more than maxKeys keys, as with --max-keys, so its
+// counts are approximate
+func newApproxCounter(size int, maxKeys int, weighted bool) *counter {
+	return &counter{size: size, weighted: weighted, sketch: newSpaceSaving(maxKeys), keys: newDistinctSet()}
+}
+
+// newSegmentCounter creates a SegmentCounter suitable for merging into this counter
+func (t *counter) newSegmentCounter() segmentCounter {
+	if t.sketch != nil {
+		return segmentCounter{sketch: newSpaceSaving(t.sketch.capacity), total: &tally{}, keys: newDistinctSet(),
+			stats: &Stats{}}
+	}
+	return newSegmentCounter()
+}
+
 // add one occurrence to the counts for the indicated Key.
 func (t *counter) add(bytes []byte) {
+	t.addWeighted(bytes, 1)
+}
+
+// addWeighted adds one occurrence, with the supplied weight, to the counts for the indicated Key.
+func (t *counter) addWeighted(bytes []byte, weight float64) {
 	// note the call with a byte slice rather than the string because of
 	//  https://github.com/golang/go/commit/f5f5a8b6209f84961687d993b93ea0d397f5d5bf
 	//  which recognizes the idiom foo[string(someByteSlice)] and bypasses constructing the string;
 	//  of course we'd rather just say foo[someByteSlice] but that's not legal because Reasons.
+	t.total.count++
+	t.total.sum += weight
+	if t.sketch != nil {
+		t.keys.add(maphash.Bytes(distinctSeed, bytes))
+		t.sketch.add(bytes, weight)
+		return
+	}
 
 	// have we seen this Key?
 	count, ok := t.counts[string(bytes)]
 	if !ok {
-		var one uint64 = 1
-		count = &one // a little surprised this works, i.e. you can give a local variable permanent life…
+		count = &tally{count: 1, sum: weight}
 		t.counts[string(bytes)] = count
 	} else {
-		*count++
+		count.count++
+		count.sum += weight
+	}
+	if weight < 0 {
+		t.unordered = true
+	}
+	if t.bottom {
+		return
 	}
 
 	// big enough to be a top candidate?
-	if *count < t.threshold {
+	if count.sum < t.threshold {
 		return
 	}
 	_, ok = t.top[string(bytes)]
@@ -74,33 +202,127 @@ func (t *counter) add(bytes []byte) {
 	}
 }
 
+// addDistinct adds one occurrence of the Key, with a value whose hash is supplied, as with --distinct
+func (t *counter) addDistinct(bytes []byte, hash uint64) {
+	segmentCounter{counts: t.counts, total: &t.total}.addDistinct(bytes, hash)
+}
+
+// addValue adds a value of the --value field to the statistics for a Key which has just been added
+func (t *counter) addValue(bytes []byte, value float64) {
+	segmentCounter{counts: t.counts}.addValue(bytes, value)
+}
+
+// recordStats is where what happens to the records counted is recorded
+func (t *counter) recordStats() *Stats {
+	return &t.stats
+}
+
+// distinctKeys returns how many different keys there are, which with a sketch is an estimate
+func (t *counter) distinctKeys() uint64 {
+	if t.sketch != nil {
+		return t.keys.cardinality()
+	}
+	return uint64(len(t.counts))
+}
+
 func (t *counter) compact() {
 	// sort the top candidates, shrink the list to the top t.size, put them back in a map
 	var topList = t.topAsSortedList()
 	topList = topList[0:t.size]
-	t.threshold = *(topList[len(topList)-1].Count)
-	t.top = make(map[string]*uint64, t.size*2)
+	t.threshold = topList[len(topList)-1].sum
+	t.top = make(map[string]*tally, t.size*2)
 	for _, kc := range topList {
-		t.top[kc.Key] = kc.Count
+		t.top[kc.key] = kc.tally
+	}
+}
+
+// rankedKey is used in sorting the tallies
+type rankedKey struct {
+	key string
+	*tally
+}
+
+func (t *counter) topAsSortedList() []rankedKey {
+	return sortTallies(t.top)
+}
+
+// sortTalliesBottom sorts the tallies into increasing order; as there are often lots with the same count,
+// ties are broken by the key, so that the results don't depend on the order the keys were seen in
+func sortTalliesBottom(tallies map[string]*tally) []rankedKey {
+	bottomList := make([]rankedKey, 0, len(tallies))
+	for key, count := range tallies {
+		bottomList = append(bottomList, rankedKey{key, count})
 	}
+	sort.Slice(bottomList, func(k1, k2 int) bool {
+		if bottomList[k1].sum != bottomList[k2].sum {
+			return bottomList[k1].sum < bottomList[k2].sum
+		}
+		return bottomList[k1].key < bottomList[k2].key
+	})
+	return bottomList
 }
 
-func (t *counter) topAsSortedList() []*keyCount {
-	topList := make([]*keyCount, 0, len(t.top))
-	for key, count := range t.top {
-		topList = append(topList, &keyCount{key, count})
+func sortTallies(tallies map[string]*tally) []rankedKey {
+	topList := make([]rankedKey, 0, len(tallies))
+	for key, count := range tallies {
+		topList = append(topList, rankedKey{key, count})
 	}
 	sort.Slice(topList, func(k1, k2 int) bool {
-		return *topList[k1].Count > *topList[k2].Count
+		return topList[k1].sum > topList[k2].sum
 	})
 	return topList
 }
 
-// getTop returns the top occurring keys & counts in order of descending count
+// getTop returns the top occurring keys & counts in order of descending count, or with bottom, the least
+// occurring in order of ascending count
 func (t *counter) getTop() []*keyCount {
-	topList := t.topAsSortedList()
-	if len(topList) > t.size {
-		return topList[0:t.size]
+	if t.sketch != nil {
+		return t.getApproxTop()
+	}
+	var sorted []rankedKey
+	if t.distinct {
+		for _, count := range t.counts {
+			count.sum = float64(count.distinct.cardinality())
+		}
+	}
+	if t.bottom {
+		sorted = sortTalliesBottom(t.counts)
+	} else if t.distinct || t.unordered {
+		sorted = sortTallies(t.counts)
+	} else {
+		sorted = t.topAsSortedList()
+	}
+	if len(sorted) > t.size {
+		sorted = sorted[0:t.size]
+	}
+	topList := make([]*keyCount, 0, len(sorted))
+	for _, ranked := range sorted {
+		kc := &keyCount{Key: ranked.key, Count: &ranked.count}
+		if t.weighted {
+			kc.Sum = &ranked.sum
+		}
+		if t.distinct {
+			distinct := uint64(ranked.sum)
+			kc.Distinct = &distinct
+		}
+		kc.Values = ranked.values.summary()
+		topList = append(topList, kc)
+	}
+	return topList
+}
+
+func (t *counter) getApproxTop() []*keyCount {
+	sorted := t.sketch.sorted()
+	if len(sorted) > t.size {
+		sorted = sorted[0:t.size]
+	}
+	topList := make([]*keyCount, 0, len(sorted))
+	for _, e := range sorted {
+		kc := &keyCount{Key: e.key, Count: &e.count, Error: &e.err}
+		if t.weighted {
+			kc.Sum = &e.sum
+		}
+		topList = append(topList, kc)
 	}
 	return topList
 }
@@ -108,7 +330,14 @@ func (t *counter) getTop() []*keyCount {
 // merge applies the counts from the SegmentCounter into the counter.
 // Once merged, the SegmentCounter should be discarded.
 func (t *counter) merge(segCounter segmentCounter) {
-	for segKey, segCount := range segCounter {
+	t.total.add(segCounter.total)
+	t.stats.add(segCounter.stats)
+	if t.sketch != nil {
+		t.keys.merge(segCounter.keys)
+		t.sketch.merge(segCounter.sketch)
+		return
+	}
+	for segKey, segCount := range segCounter.counts {
 		// Annoyingly we can't efficiently call add here because we have
 		// a string not a []byte
 		count, existingKey := t.counts[segKey]
@@ -116,11 +345,17 @@ func (t *counter) merge(segCounter segmentCounter) {
 			count = segCount
 			t.counts[segKey] = segCount
 		} else {
-			*count += *segCount
+			count.add(segCount)
+		}
+		if segCount.sum < 0 {
+			t.unordered = true
+		}
+		if t.distinct || t.bottom {
+			continue
 		}
 
 		// big enough to be a top candidate?
-		if *count >= t.threshold {
+		if count.sum >= t.threshold {
 			// if it wasn't in t.counts then we already know it's not in
 			// t.top
 			var topKey bool
@@ -138,20 +373,71 @@ func (t *counter) merge(segCounter segmentCounter) {
 	}
 }
 
-// SegmentCounter tracks Key occurrence counts for a single segment.
-type segmentCounter map[string]*uint64
+// SegmentCounter tracks Key occurrence counts for a single segment, approximately if sketch is set. Like the
+// counter's, total is for all the records, keys has the hashes of the keys if there's a sketch, and stats
+// says what happened to the records.
+type segmentCounter struct {
+	counts map[string]*tally
+	sketch *spaceSaving
+	total  *tally
+	keys   *distinctSet
+	stats  *Stats
+}
+
+// recordCounter is what countRecord adds keys to: a counter, when a stream's records are counted one by one,
+// or a segmentCounter, which is merged into the counter later
+type recordCounter interface {
+	addWeighted(key []byte, weight float64)
+	addDistinct(key []byte, hash uint64)
+	addValue(key []byte, value float64)
+	recordStats() *Stats
+}
 
 func newSegmentCounter() segmentCounter {
-	return make(segmentCounter, 1024)
+	return segmentCounter{counts: make(map[string]*tally, 1024), total: &tally{}, stats: &Stats{}}
 }
 
 func (s segmentCounter) add(key []byte) {
-	count, ok := s[string(key)]
+	s.addWeighted(key, 1)
+}
+
+func (s segmentCounter) addDistinct(key []byte, hash uint64) {
+	count, ok := s.counts[string(key)]
+	if !ok {
+		count = &tally{distinct: newDistinctSet()}
+		s.counts[string(key)] = count
+	}
+	count.count++
+	count.distinct.add(hash)
+	s.total.count++
+}
+
+func (s segmentCounter) addValue(key []byte, value float64) {
+	count := s.counts[string(key)]
+	if count.values == nil {
+		count.values = newValueStats()
+	}
+	count.values.add(value)
+}
+
+func (s segmentCounter) recordStats() *Stats {
+	return s.stats
+}
+
+func (s segmentCounter) addWeighted(key []byte, weight float64) {
+	s.total.count++
+	s.total.sum += weight
+	if s.sketch != nil {
+		s.keys.add(maphash.Bytes(distinctSeed, key))
+		s.sketch.add(key, weight)
+		return
+	}
+	count, ok := s.counts[string(key)]
 	if !ok {
-		var one uint64 = 1
-		count = &one // a little surprised this works, i.e. you can give a local variable permanent life…
-		s[string(key)] = count
+		count = &tally{count: 1, sum: weight}
+		s.counts[string(key)] = count
 	} else {
-		*count++
+		count.count++
+		count.sum += weight
 	}
 }
@@ -2,8 +2,10 @@ package topfew
 
 import (
 	"bufio"
+	"fmt"
 	"os"
 	"regexp"
+	"strings"
 	"testing"
 )
 
@@ -68,11 +70,11 @@ func TestTable_Add(t *testing.T) {
 	n8 := uint64(8)
 
 	wanted := []*keyCount{
-		{"c", &n8},
-		{"g", &n7},
-		{"e", &n6},
-		{"f", &n5},
-		{"a", &n4},
+		{Key: "c", Count: &n8},
+		{Key: "g", Count: &n7},
+		{Key: "e", Count: &n6},
+		{Key: "f", Count: &n5},
+		{Key: "a", Count: &n4},
 	}
 	assertKeyCountsEqual(t, wanted, table.getTop())
 
@@ -81,9 +83,9 @@ func TestTable_Add(t *testing.T) {
 		table.add([]byte(key))
 	}
 	wanted = []*keyCount{
-		{"c", &n8},
-		{"g", &n7},
-		{"e", &n6},
+		{Key: "c", Count: &n8},
+		{Key: "g", Count: &n7},
+		{Key: "e", Count: &n6},
 	}
 	assertKeyCountsEqual(t, wanted, table.getTop())
 }
@@ -110,11 +112,58 @@ func Test_Merge(t *testing.T) {
 	a.merge(b)
 	a.merge(c)
 	exp := []*keyCount{
-		{"A", pv(100)}, {"C", pv(51)}, {"B", pv(50)},
+		{Key: "A", Count: pv(100)}, {Key: "C", Count: pv(51)}, {Key: "B", Count: pv(50)},
 	}
 	assertKeyCountsEqual(t, exp, a.getTop())
 }
 
+func Test_WeightedMerge(t *testing.T) {
+	a := newWeightedCounter(2)
+	b := newSegmentCounter()
+	c := newSegmentCounter()
+	for i := 0; i < 50; i++ {
+		b.addWeighted([]byte("A"), 0.5)
+		b.addWeighted([]byte("B"), 2)
+		c.addWeighted([]byte("C"), 1)
+		c.addWeighted([]byte("A"), 3)
+	}
+	a.merge(b)
+	a.merge(c)
+	a.addWeighted([]byte("C"), 60)
+	top := a.getTop()
+	if len(top) != 2 || top[0].Key != "A" || *top[0].Sum != 175 || *top[0].Count != 100 ||
+		top[1].Key != "C" || *top[1].Sum != 110 || *top[1].Count != 51 {
+		t.Errorf("weighted merge got %v", top)
+	}
+}
+
+func Test_Bottom(t *testing.T) {
+	a := newCounter(3)
+	a.bottom = true
+	b := newSegmentCounter()
+	for i := 0; i < 100; i++ {
+		a.add([]byte(fmt.Sprintf("common%d", i%10)))
+		b.add([]byte(fmt.Sprintf("common%d", i%10)))
+	}
+	for _, key := range []string{"rare2", "rare1", "unusual", "rare3", "unusual"} {
+		b.add([]byte(key))
+	}
+	a.add([]byte("rare3"))
+	a.merge(b)
+	exp := []*keyCount{{Key: "rare1", Count: pv(1)}, {Key: "rare2", Count: pv(1)}, {Key: "rare3", Count: pv(2)}}
+	assertKeyCountsEqual(t, exp, a.getTop())
+
+	// lots of ties, which have to come out the same in both
+	data, err := os.ReadFile("../test/data/small")
+	if err != nil {
+		t.Fatal("read: " + err.Error())
+	}
+	got := runBoth(t, string(data), "--bottom", "-n", "50", "-f", "1")
+	if !strings.HasPrefix(got, "1 104.54.201.35\n1 107.178.194.209\n") {
+		t.Errorf("bottom of small got\n%s", got)
+	}
+}
+
 func pv(v uint64) *uint64 {
 	return &v
 }
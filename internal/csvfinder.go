@@ -0,0 +1,326 @@
+package topfew
+
+// In CSV mode, records and fields follow RFC 4180: fields are separated by commas (or tabs, for TSV), may be
+//  enclosed in "quotes", in which case they can contain separators, newlines, and quotes, which are doubled.
+//  The only tricky thing is the newlines; a record isn't over until it has an even number of quote
+//  characters. That's cheap to check, so the record readers just keep reading lines until it's true.
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var errCSVSyntax = errors.New("malformed CSV in record")
+
+// csvFormat is the part of a keyFinder that knows about CSV. names and columns line up with the fields
+// from --fields; columns holds 0-based column numbers, and for a field that was given as a name rather than
+// a number, the column can't be filled in until the header has been read.
+type csvFormat struct {
+	separator      byte
+	awaitingHeader bool
+	names          []string
+	columns        []int
+	maxColumn      int
+	spans          []csvSpan
+}
+
+// csvSpan locates a field in a record; if it was quoted, start and end are inside the quotes, and doubled
+// quotes within it still need to be undoubled
+type csvSpan struct {
+	start  int
+	end    int
+	quoted bool
+}
+
+// newCSVFormat sets up CSV processing; header says the first record is a header and shouldn't be counted.
+// spec is the --fields argument, whose comma-separated entries may be column numbers or names from the
+// header, in any order. Naming a column means there must be a header.
+func newCSVFormat(separator byte, spec string, header bool) (*csvFormat, error) {
+	c := &csvFormat{separator: separator, awaitingHeader: header}
+	if spec == "" {
+		return c, nil
+	}
+	for _, part := range strings.Split(spec, ",") {
+		num, err := strconv.Atoi(part)
+		switch {
+		case err == nil && num < 1:
+			return nil, fmt.Errorf("illegal field number %d", num)
+		case err == nil:
+			c.names = append(c.names, "")
+			c.columns = append(c.columns, num-1)
+		case part == "":
+			return nil, errors.New("empty field name in field list")
+		default:
+			c.names = append(c.names, part)
+			c.columns = append(c.columns, -1)
+			c.awaitingHeader = true
+		}
+	}
+	c.setMaxColumn()
+	return c, nil
+}
+
+func (c *csvFormat) setMaxColumn() {
+	c.maxColumn = 0
+	for _, col := range c.columns {
+		if col > c.maxColumn {
+			c.maxColumn = col
+		}
+	}
+}
+
+// clone returns a csvFormat with the same configuration and its own working storage; the columns are
+// copied because setHeader fills them in
+func (c *csvFormat) clone() *csvFormat {
+	clone := *c
+	clone.columns = append([]int(nil), c.columns...)
+	clone.spans = nil
+	return &clone
+}
+
+// setHeader reads the column names from the header record and uses them to find the named fields
+func (c *csvFormat) setHeader(record []byte) error {
+	c.awaitingHeader = false
+	record = chompCSV(record)
+	columnNames := make(map[string]int)
+	for col, index := 0, 0; index <= len(record); col++ {
+		span, next, err := csvField(record, index, c.separator)
+		if err != nil {
+			return err
+		}
+		name := string(appendCSVField(nil, record, span))
+		if _, seen := columnNames[name]; !seen {
+			columnNames[name] = col
+		}
+		index = next
+	}
+	for i, name := range c.names {
+		if name == "" {
+			continue
+		}
+		col, ok := columnNames[name]
+		if !ok {
+			return fmt.Errorf("no column named \"%s\" in header", name)
+		}
+		c.columns[i] = col
+	}
+	c.setMaxColumn()
+	return nil
+}
+
+// setCSVHeader passes the header record to the keyFinder's csvFormat, and to those of the other fields, like
+// --sum and --time, if there are any
+func (kf *keyFinder) setCSVHeader(record []byte) error {
+	for _, finder := range kf.fieldFinders() {
+		if err := finder.csv.setHeader(record); err != nil {
+			return err
+		}
+	}
+	return kf.csv.setHeader(record)
+}
+
+// getCSVKey is getKey for CSV records. It finds all the columns up to the highest-numbered one it needs,
+// then assembles the key from them in the order they were asked for.
+func (kf *keyFinder) getCSVKey(record []byte) ([]byte, error) {
+	c := kf.csv
+	record = chompCSV(record)
+	if len(c.columns) == 0 {
+		return record, nil
+	}
+	c.spans = c.spans[:0]
+	index := 0
+	for col := 0; col <= c.maxColumn; col++ {
+		if index > len(record) {
+			return nil, errors.New(NER)
+		}
+		span, next, err := csvField(record, index, c.separator)
+		if err != nil {
+			return nil, err
+		}
+		c.spans = append(c.spans, span)
+		index = next
+	}
+
+	kf.key = kf.key[:0]
+	for i, col := range c.columns {
+		if i > 0 {
+			kf.key = append(kf.key, kf.joiner)
+		}
+		kf.key = appendCSVField(kf.key, record, c.spans[col])
+	}
+	return kf.key, nil
+}
+
+// chompCSV removes the record's line ending, which RFC 4180 says is CRLF
+func chompCSV(record []byte) []byte {
+	if len(record) > 0 && record[len(record)-1] == '\n' {
+		record = record[:len(record)-1]
+	}
+	if len(record) > 0 && record[len(record)-1] == '\r' {
+		record = record[:len(record)-1]
+	}
+	return record
+}
+
+// csvField finds the field starting at index, and returns the index just past the separator following it,
+// which is len(record)+1 if the field was the last in the record
+func csvField(record []byte, index int, separator byte) (csvSpan, int, error) {
+	if index < len(record) && record[index] == '"' {
+		span := csvSpan{start: index + 1, quoted: true}
+		index++
+		for {
+			if index >= len(record) {
+				return csvSpan{}, 0, errCSVSyntax
+			}
+			if record[index] == '"' {
+				if index+1 < len(record) && record[index+1] == '"' {
+					index += 2
+					continue
+				}
+				break
+			}
+			index++
+		}
+		span.end = index
+		index++
+		if index == len(record) {
+			return span, index + 1, nil
+		}
+		if record[index] != separator {
+			return csvSpan{}, 0, errCSVSyntax
+		}
+		return span, index + 1, nil
+	}
+
+	span := csvSpan{start: index}
+	for index < len(record) && record[index] != separator {
+		index++
+	}
+	span.end = index
+	return span, index + 1, nil
+}
+
+// appendCSVField adds a field's contents to key, undoubling quotes if it was quoted
+func appendCSVField(key []byte, record []byte, span csvSpan) []byte {
+	field := record[span.start:span.end]
+	if !span.quoted {
+		return append(key, field...)
+	}
+	for len(field) > 0 {
+		q := bytes.IndexByte(field, '"')
+		if q == -1 {
+			return append(key, field...)
+		}
+		// the quote is doubled, keep one of them
+		key = append(key, field[:q+1]...)
+		field = field[q+2:]
+	}
+	return key
+}
+
+// csvQuoteOpen checks whether a record read so far ends inside a quoted field
+func csvQuoteOpen(record []byte) bool {
+	return bytes.Count(record, []byte{'"'})%2 == 1
+}
+
+// readCSVContinuation is called when record ends inside a quoted field, and appends lines to it until it
+// doesn't, or the input runs out
+func readCSVContinuation(reader *bufio.Reader, record []byte) ([]byte, error) {
+	for {
+		line, err := reader.ReadBytes('\n')
+		record = append(record, line...)
+		if err != nil || csvQuoteOpen(line) {
+			return record, err
+		}
+	}
+}
+
+// readCSVRecord reads a whole CSV record, which may span lines
+func readCSVRecord(reader *bufio.Reader) ([]byte, error) {
+	record, err := reader.ReadBytes('\n')
+	if err == nil && csvQuoteOpen(record) {
+		record, err = readCSVContinuation(reader, record)
+	}
+	return record, err
+}
+
+// readCSVHeader reads the header record at the start of a file and returns its length, so that segmenting
+// can start after it
+func readCSVHeader(fname string, kf *keyFinder) (int64, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return 0, err
+	}
+	//noinspection ALL
+	defer file.Close()
+	header, err := readCSVRecord(bufio.NewReader(file))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+	if len(header) == 0 {
+		return 0, errors.New("no CSV header")
+	}
+	return int64(len(header)), kf.setCSVHeader(header)
+}
+
+// csvBoundaryQuoting is used in dividing a file into segments. Whether a newline ends a record depends on
+// whether there have been an even number of quotes since the start of the file, so this counts the quotes
+// in each chunkSize-byte chunk, in parallel, and returns for each chunk whether it starts inside quotes.
+func csvBoundaryQuoting(fname string, fileSize int64, chunkSize int64) ([]bool, error) {
+	type chunkResult struct {
+		chunk  int
+		quotes int
+		err    error
+	}
+	chunks := int((fileSize + chunkSize - 1) / chunkSize)
+	ch := make(chan chunkResult, chunks)
+	for chunk := 0; chunk < chunks; chunk++ {
+		go func(chunk int) {
+			quotes, err := countQuotes(fname, int64(chunk)*chunkSize, chunkSize)
+			ch <- chunkResult{chunk, quotes, err}
+		}(chunk)
+	}
+	counts := make([]int, chunks)
+	for done := 0; done < chunks; done++ {
+		res := <-ch
+		if res.err != nil {
+			return nil, res.err
+		}
+		counts[res.chunk] = res.quotes
+	}
+
+	inQuotes := make([]bool, chunks)
+	quotes := 0
+	for chunk := range counts {
+		inQuotes[chunk] = quotes%2 == 1
+		quotes += counts[chunk]
+	}
+	return inQuotes, nil
+}
+
+func countQuotes(fname string, start int64, length int64) (int, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return 0, err
+	}
+	//noinspection ALL
+	defer file.Close()
+	section := io.NewSectionReader(file, start, length)
+	buf := make([]byte, 64*1024)
+	quotes := 0
+	for {
+		n, err := section.Read(buf)
+		quotes += bytes.Count(buf[:n], []byte{'"'})
+		if errors.Is(err, io.EOF) {
+			return quotes, nil
+		} else if err != nil {
+			return 0, err
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package topfew
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCSVKeys(t *testing.T) {
+	records := []string{
+		"a,b,c,d\n",
+		`a,"b",c,"d"` + "\r\n",
+		`"a","b","c","d"`,
+		"a,b,c,d,e,f",
+	}
+	tests := map[string]string{
+		"":      "",
+		"1":     "a",
+		"2,4":   "b d",
+		"4,1,2": "d a b",
+		"3,3":   "c c",
+	}
+	for spec, wanted := range tests {
+		c, err := newCSVFormat(',', spec, false)
+		if err != nil {
+			t.Fatalf("spec %s: %s", spec, err.Error())
+		}
+		kf := newCSVKeyFinder(c)
+		for _, record := range records {
+			got, err := kf.getKey([]byte(record))
+			if err != nil {
+				t.Errorf("%s on <%s>: %s", spec, record, err.Error())
+				continue
+			}
+			if spec == "" {
+				wanted = strings.TrimRight(record, "\r\n")
+			}
+			if string(got) != wanted {
+				t.Errorf("%s on <%s>: got <%s> wanted <%s>", spec, record, string(got), wanted)
+			}
+		}
+	}
+
+	c, _ := newCSVFormat(',', "2,3", false)
+	kf := newCSVKeyFinder(c)
+	quoted := map[string]string{
+		`1,"a,b",c`:                   "a,b c",
+		`1,"say ""hi""",""""`:         `say "hi" "`,
+		"1,\"two\nlines\",x\n":        "two\nlines x",
+		`1,,`:                         " ",
+		"1,\"\",\"\"\"\"\"\"\"\"\"\"": ` """"`,
+	}
+	for record, wanted := range quoted {
+		got, err := kf.getKey([]byte(record))
+		if err != nil {
+			t.Errorf("<%s>: %s", record, err.Error())
+		} else if string(got) != wanted {
+			t.Errorf("<%s>: got <%s> wanted <%s>", record, string(got), wanted)
+		}
+	}
+
+	for _, short := range []string{"a", "a,b", "\n"} {
+		if _, err := kf.getKey([]byte(short)); err == nil || err.Error() != NER {
+			t.Errorf("short record <%s> gave %v", short, err)
+		}
+	}
+	for _, bad := range []string{`1,"a"b,c`, `1,"a,c`, `1,b,"c`} {
+		if _, err := kf.getKey([]byte(bad)); !errors.Is(err, errCSVSyntax) {
+			t.Errorf("malformed record <%s> gave %v", bad, err)
+		}
+	}
+
+	c, _ = newCSVFormat('\t', "2", false)
+	kf = newCSVKeyFinder(c)
+	got, err := kf.getKey([]byte("a b\t\"c\td\"\te\n"))
+	if err != nil || string(got) != "c\td" {
+		t.Errorf("TSV got <%s> %v", string(got), err)
+	}
+}
+
+func TestCSVHeader(t *testing.T) {
+	bads := []string{"0", "1,,2"}
+	for _, bad := range bads {
+		if _, err := newCSVFormat(',', bad, false); err == nil {
+			t.Errorf("accepted field list %s", bad)
+		}
+	}
+
+	c, err := newCSVFormat(',', "status,1,\"odd\" name", false)
+	if err != nil {
+		t.Fatal("newCSVFormat: " + err.Error())
+	}
+	if !c.awaitingHeader {
+		t.Error("named fields should need a header")
+	}
+	err = c.setHeader([]byte(`ip,"""odd"" name",status,status` + "\r\n"))
+	if err != nil {
+		t.Fatal("setHeader: " + err.Error())
+	}
+	kf := newCSVKeyFinder(c)
+	got, err := kf.getKey([]byte("1.2.3.4,x,200,404\n"))
+	if err != nil || string(got) != "200 1.2.3.4 x" {
+		t.Errorf("named fields got <%s> %v", string(got), err)
+	}
+
+	c, _ = newCSVFormat(',', "country", false)
+	if err = c.setHeader([]byte("ip,status\n")); err == nil {
+		t.Error("found column that isn't in header")
+	}
+	c, _ = newCSVFormat(',', "country", false)
+	if err = c.setHeader([]byte("ip,\"status\n")); err == nil {
+		t.Error("accepted malformed header")
+	}
+}
+
+func TestCSVRun(t *testing.T) {
+	input := "name,\"comment\",country\n" +
+		"a,\"multi\nline, with comma\",CA\n" +
+		"b,plain,US\n" +
+		"c,\"\"\"quoted\"\"\",CA\n" +
+		"d,\"x\n\n\",CA\n"
+	c, err := Configure([]string{"--csv", "-f", "country"})
+	if err != nil {
+		t.Fatal("config: " + err.Error())
+	}
+	kc, err := Run(c, strings.NewReader(input))
+	if err != nil {
+		t.Fatal("Run: " + err.Error())
+	}
+	assertKeyCountsEqual(t, []*keyCount{{Key: "CA", Count: pv(3)}, {Key: "US", Count: pv(1)}}, kc)
+
+	c, err = Configure([]string{"--tsv", "--header", "-f", "2"})
+	if err != nil {
+		t.Fatal("config: " + err.Error())
+	}
+	kc, err = Run(c, strings.NewReader("h1\th2\nx\ty\nx\ty\nz\tw\n"))
+	if err != nil {
+		t.Fatal("Run: " + err.Error())
+	}
+	assertKeyCountsEqual(t, []*keyCount{{Key: "y", Count: pv(2)}, {Key: "w", Count: pv(1)}}, kc)
+
+	c, err = Configure([]string{"--csv", "-f", "nope"})
+	if err != nil {
+		t.Fatal("config: " + err.Error())
+	}
+	if _, err = Run(c, strings.NewReader(input)); err == nil {
+		t.Error("accepted field name not in header")
+	}
+}
+
+// TestCSVSegments makes a CSV file big enough to be split into several segments, full of records with
+// newlines in them, and checks that reading it in segments gives the same answer as reading it as a stream.
+func TestCSVSegments(t *testing.T) {
+	tmpName := fmt.Sprintf("/tmp/topfew-csv-%d", os.Getpid())
+	tmpfile, err := os.Create(tmpName)
+	if err != nil {
+		t.Fatal("can't make tmpfile: " + err.Error())
+	}
+	defer func() { _ = os.Remove(tmpName) }()
+	_, _ = fmt.Fprintln(tmpfile, "id,text,bucket")
+	wanted := map[string]uint64{}
+	for i := 0; i < 20000; i++ {
+		bucket := fmt.Sprintf("b%d", i%7)
+		if i%3 == 0 {
+			bucket = fmt.Sprintf("\"b%d\nnot, a \"\"new\"\" record\n\"", i%7)
+		}
+		_, _ = fmt.Fprintf(tmpfile, "%d,\"line one\nline, two\",%s\n", i, bucket)
+		wanted[strings.ReplaceAll(strings.Trim(bucket, "\""), "\"\"", "\"")]++
+	}
+	_ = tmpfile.Close()
+
+	for _, width := range []string{"1", "3", "16"} {
+		c, err := Configure([]string{"--csv", "-f", "bucket", "-n", "20", "-w", width, tmpName})
+		if err != nil {
+			t.Fatal("config: " + err.Error())
+		}
+		kc, err := Run(c, nil)
+		if err != nil {
+			t.Fatal("Run: " + err.Error())
+		}
+		if len(kc) != len(wanted) {
+			t.Errorf("width %s: got %d keys wanted %d", width, len(kc), len(wanted))
+		}
+		for _, k := range kc {
+			if *k.Count != wanted[k.Key] {
+				t.Errorf("width %s: count for <%s> is %d wanted %d", width, k.Key, *k.Count, wanted[k.Key])
+			}
+		}
+	}
+
+	f, err := os.Open(tmpName)
+	if err != nil {
+		t.Fatal("Open: " + err.Error())
+	}
+	//noinspection ALL
+	defer f.Close()
+	c, _ := Configure([]string{"--csv", "-f", "bucket", "-n", "20"})
+	kf := newCSVKeyFinder(c.csv)
+	kc, err := fromStream(context.Background(), f, &c.filter, kf, c.size)
+	if err != nil {
+		t.Fatal("fromStream: " + err.Error())
+	}
+	if len(kc) != len(wanted) {
+		t.Errorf("stream: got %d keys wanted %d", len(kc), len(wanted))
+	}
+	for _, k := range kc {
+		if *k.Count != wanted[k.Key] {
+			t.Errorf("stream: count for <%s> is %d wanted %d", k.Key, *k.Count, wanted[k.Key])
+		}
+	}
+
+	empty := tmpName + "-empty"
+	_ = os.WriteFile(empty, nil, 0o600)
+	defer func() { _ = os.Remove(empty) }()
+	c, _ = Configure([]string{"--csv", "-f", "bucket", empty})
+	if _, err = Run(c, nil); err == nil {
+		t.Error("no error on headerless file")
+	}
+}
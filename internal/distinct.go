@@ -0,0 +1,140 @@
+package topfew
+
+// With --distinct, keys are ranked by how many different values of another field they occur with, for
+//  example which URLs were fetched by the most different clients. Each key's tally has a distinctSet of the
+//  values' hashes, which is exact until it gets big, and then turns into a HyperLogLog sketch, which
+//  estimates the number of distinct values to within a couple of percent in a fixed 4K of memory. Both
+//  forms can be merged, so segments are counted in parallel just as usual. Since 64-bit hashes practically
+//  never collide, the exact form really is exact.
+
+import (
+	"hash/maphash"
+	"math"
+	"math/bits"
+)
+
+// distinctExactLimit is how many hashes a distinctSet holds before it becomes a HyperLogLog sketch
+const distinctExactLimit = 1024
+
+// hllPrecision is the number of hash bits that choose a register, so there are 4096 of them, and the
+// standard error is 1.04/sqrt(4096), about 1.6%
+const hllPrecision = 12
+
+const hllRegisters = 1 << hllPrecision
+
+// distinctSeed is shared so that the hashes from every segment agree
+var distinctSeed = maphash.MakeSeed()
+
+// distinctSet holds either the exact set of hashes, or the sketch's registers
+type distinctSet struct {
+	exact     map[uint64]struct{}
+	registers []uint8
+}
+
+func newDistinctSet() *distinctSet {
+	return &distinctSet{exact: make(map[uint64]struct{})}
+}
+
+// distinctGetter gets the hash of the --distinct field's value
+type distinctGetter struct {
+	field *keyFinder
+}
+
+func (d *distinctGetter) get(record []byte, fields *recordFields) error {
+	value, err := d.field.getKey(record)
+	if err != nil {
+		return err
+	}
+	fields.hash, fields.hasHash = maphash.Bytes(distinctSeed, value), true
+	return nil
+}
+
+func (d *distinctGetter) finders() []*keyFinder {
+	return []*keyFinder{d.field}
+}
+
+func (d *distinctGetter) clone() fieldGetter {
+	return &distinctGetter{field: d.field.clone()}
+}
+
+func (d *distinctSet) add(hash uint64) {
+	if d.registers != nil {
+		d.addToSketch(hash)
+		return
+	}
+	d.exact[hash] = struct{}{}
+	if len(d.exact) > distinctExactLimit {
+		d.toSketch()
+	}
+}
+
+// addToSketch uses the top bits of the hash to pick a register, and records in it the position of the first
+// 1 bit in the rest of the hash, if that's higher than what's there
+func (d *distinctSet) addToSketch(hash uint64) {
+	index := hash >> (64 - hllPrecision)
+	// the sentinel bit stops the count at 64 - hllPrecision + 1
+	rank := uint8(bits.LeadingZeros64(hash<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank > d.registers[index] {
+		d.registers[index] = rank
+	}
+}
+
+func (d *distinctSet) toSketch() {
+	d.registers = make([]uint8, hllRegisters)
+	for hash := range d.exact {
+		d.addToSketch(hash)
+	}
+	d.exact = nil
+}
+
+// merge adds other's values to d
+func (d *distinctSet) merge(other *distinctSet) {
+	if other.registers == nil {
+		for hash := range other.exact {
+			d.add(hash)
+		}
+		return
+	}
+	if d.registers == nil {
+		d.toSketch()
+	}
+	for i, rank := range other.registers {
+		if rank > d.registers[i] {
+			d.registers[i] = rank
+		}
+	}
+}
+
+// clone returns a copy of d which can be changed without affecting it
+func (d *distinctSet) clone() *distinctSet {
+	if d.registers != nil {
+		return &distinctSet{registers: append([]uint8(nil), d.registers...)}
+	}
+	clone := &distinctSet{exact: make(map[uint64]struct{}, len(d.exact))}
+	for hash := range d.exact {
+		clone.exact[hash] = struct{}{}
+	}
+	return clone
+}
+
+// cardinality returns the number of distinct values; when there's a sketch, it's the HyperLogLog estimate,
+// with the usual correction for small numbers of values, which by then only matters after merges
+func (d *distinctSet) cardinality() uint64 {
+	if d.registers == nil {
+		return uint64(len(d.exact))
+	}
+	m := float64(hllRegisters)
+	sum := 0.0
+	zeros := 0
+	for _, rank := range d.registers {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(math.Round(estimate))
+}
@@ -0,0 +1,109 @@
+package topfew
+
+import (
+	"fmt"
+	"hash/maphash"
+	"math"
+	"strings"
+	"testing"
+)
+
+func distinctSetOf(from int, to int) *distinctSet {
+	d := newDistinctSet()
+	for i := from; i < to; i++ {
+		d.add(maphash.String(distinctSeed, fmt.Sprintf("value %d", i)))
+	}
+	return d
+}
+
+func assertCardinality(t *testing.T, d *distinctSet, wanted int, what string) {
+	t.Helper()
+	got := float64(d.cardinality())
+	// four standard errors
+	if math.Abs(got-float64(wanted)) > 0.065*float64(wanted) {
+		t.Errorf("%s: got %.0f wanted about %d", what, got, wanted)
+	}
+}
+
+func TestDistinctSet(t *testing.T) {
+	small := distinctSetOf(0, distinctExactLimit)
+	small.add(maphash.String(distinctSeed, "value 0"))
+	if small.registers != nil || small.cardinality() != distinctExactLimit {
+		t.Errorf("small set: got %d, sketch %v", small.cardinality(), small.registers != nil)
+	}
+
+	for _, size := range []int{distinctExactLimit + 1, 5000, 20000, 200000} {
+		d := distinctSetOf(0, size)
+		if d.registers == nil {
+			t.Errorf("%d values: no sketch", size)
+		}
+		assertCardinality(t, d, size, fmt.Sprintf("%d values", size))
+	}
+
+	// merging overlapping sets, exact and sketched, in both directions
+	cases := []struct {
+		from1, to1, from2, to2 int
+	}{
+		{0, 500, 250, 750},
+		{0, 500, 0, 50000},
+		{0, 50000, 49900, 50400},
+		{0, 50000, 25000, 75000},
+	}
+	for _, c := range cases {
+		wanted := c.to2 - c.from1
+		what := fmt.Sprintf("%d-%d merged with %d-%d", c.from1, c.to1, c.from2, c.to2)
+		d := distinctSetOf(c.from1, c.to1)
+		d.merge(distinctSetOf(c.from2, c.to2))
+		if wanted <= distinctExactLimit && d.cardinality() != uint64(wanted) {
+			t.Errorf("%s: got %d wanted %d", what, d.cardinality(), wanted)
+		}
+		assertCardinality(t, d, wanted, what)
+		d = distinctSetOf(c.from2, c.to2)
+		d.merge(distinctSetOf(c.from1, c.to1))
+		assertCardinality(t, d, wanted, what+", reversed")
+	}
+
+	// a clone doesn't share storage
+	for _, d := range []*distinctSet{distinctSetOf(0, 10), distinctSetOf(0, 10000)} {
+		before := d.cardinality()
+		clone := d.clone()
+		clone.merge(distinctSetOf(10000, 20000))
+		if d.cardinality() != before {
+			t.Errorf("changing a clone changed the original from %d to %d", before, d.cardinality())
+		}
+	}
+}
+
+func TestDistinct(t *testing.T) {
+	var records strings.Builder
+	// /a is fetched most often, but /b by the most clients
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(&records, "10.0.0.1 /a\n10.0.0.2 /a\n10.0.0.%d /b\n", i)
+	}
+	records.WriteString("10.0.0.3 /c\n")
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&records, "10.1.%d.%d /d\n", i/256, i%256)
+	}
+	got := runBoth(t, records.String(), "-f", "2", "--distinct", "1", "-n", "3")
+	if !strings.HasSuffix(got, " /d\n10 /b\n2 /a\n") {
+		t.Errorf("got\n%s", got)
+	}
+	var estimate int
+	if _, err := fmt.Sscanf(got, "%d", &estimate); err != nil || math.Abs(float64(estimate-5000)) > 325 {
+		t.Errorf("estimated %d for 5000", estimate)
+	}
+
+	got = runBoth(t, records.String(), "-f", "2", "--distinct", "1", "-n", "2", "-g", "/[abc]", "--output", "csv")
+	if got != "count,distinct,key\n10,10,/b\n20,2,/a\n" {
+		t.Errorf("CSV got\n%s", got)
+	}
+
+	got = runBoth(t, "a,x,1\na,y,1\nb,x,1\nb,x,2\nb,x,3\na,x,4\n", "--csv", "-f", "1", "--distinct", "3",
+		"--group-by", "2", "--output", "json")
+	wanted := "[\n{\"group\":\"x\",\"count\":3,\"distinct\":3,\"key\":\"b\"},\n" +
+		"{\"group\":\"x\",\"count\":2,\"distinct\":2,\"key\":\"a\"},\n" +
+		"{\"group\":\"y\",\"count\":1,\"distinct\":1,\"key\":\"a\"}\n]\n"
+	if got != wanted {
+		t.Errorf("JSON got\n%s", got)
+	}
+}
@@ -0,0 +1,91 @@
+package topfew
+
+// With --extract, the key is built from what a regular expression's capture groups match in the record, or in
+//  the fields picked out with -f, rather than being the fields themselves. If the regexp has named groups,
+//  only those are used; if it has no groups, the key is the whole match. A record the regexp doesn't match
+//  is one the key can't be extracted from, and --on-error says what happens to it.
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+)
+
+var errNoMatch = errors.New("no match for --extract")
+
+// extractor builds keys from the groups of re; like keyFinder, it reuses key, so isn't thread-safe
+type extractor struct {
+	re     *regexp.Regexp
+	groups []int
+	joiner byte
+	key    []byte
+}
+
+// newExtractor makes an extractor which joins the groups' matches with joiner
+func newExtractor(re *regexp.Regexp, joiner byte) *extractor {
+	return &extractor{re: re, groups: extractGroups(re), joiner: joiner, key: make([]byte, 0, 128)}
+}
+
+func (x *extractor) clone() *extractor {
+	return newExtractor(x.re, x.joiner)
+}
+
+// extractGroups returns the numbers of the groups the key is made of: the named ones if there are any,
+// otherwise all of them, or just group 0, the whole match, if there aren't any
+func extractGroups(re *regexp.Regexp) []int {
+	var named, all []int
+	for i, name := range re.SubexpNames() {
+		if i == 0 {
+			continue
+		}
+		if name != "" {
+			named = append(named, i)
+		}
+		all = append(all, i)
+	}
+	switch {
+	case len(named) > 0:
+		return named
+	case len(all) > 0:
+		return all
+	}
+	return []int{0}
+}
+
+// extractFieldNames names the parts of an extracted key for the JSON and CSV output: the group names, or
+// "group1", "group2", and so on for unnamed groups
+func extractFieldNames(re *regexp.Regexp) []string {
+	groups := extractGroups(re)
+	if len(groups) == 1 && groups[0] == 0 {
+		return nil
+	}
+	names := re.SubexpNames()
+	var fieldNames []string
+	for _, group := range groups {
+		name := names[group]
+		if name == "" {
+			name = "group" + strconv.Itoa(group)
+		}
+		fieldNames = append(fieldNames, name)
+	}
+	return fieldNames
+}
+
+// extract makes a key from the groups' matches in from; a group that didn't take part in the match
+// contributes an empty string
+func (x *extractor) extract(from []byte) ([]byte, error) {
+	match := x.re.FindSubmatchIndex(from)
+	if match == nil {
+		return nil, errNoMatch
+	}
+	x.key = x.key[:0]
+	for i, group := range x.groups {
+		if i > 0 {
+			x.key = append(x.key, x.joiner)
+		}
+		if start := match[2*group]; start >= 0 {
+			x.key = append(x.key, from[start:match[2*group+1]]...)
+		}
+	}
+	return x.key, nil
+}
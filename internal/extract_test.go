@@ -0,0 +1,79 @@
+package topfew
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestExtractor(t *testing.T) {
+	tests := []struct {
+		re     string
+		from   string
+		key    string
+		names  []string
+		errors bool
+	}{
+		{`/\w+/`, "GET /a/b", "/a/", nil, false},
+		{`/(\w+)/(\w+)`, "GET /a/b", "a b", []string{"group1", "group2"}, false},
+		{`^(?P<method>\w+) /(\w+)/(?P<leaf>\w+)`, "GET /a/b", "GET b", []string{"method", "leaf"}, false},
+		{`(x)?/(\w+)`, "GET /a/b", " a", []string{"group1", "group2"}, false},
+		{`^POST`, "GET /a/b", "", nil, true},
+	}
+	for _, test := range tests {
+		re := regexp.MustCompile(test.re)
+		x := newExtractor(re, ' ').clone()
+		key, err := x.extract([]byte(test.from))
+		if (err != nil) != test.errors || string(key) != test.key {
+			t.Errorf("%s: got %q, %v", test.re, string(key), err)
+		}
+		names := extractFieldNames(re)
+		if strings.Join(names, ",") != strings.Join(test.names, ",") {
+			t.Errorf("%s: names %v", test.re, names)
+		}
+	}
+}
+
+func TestExtract(t *testing.T) {
+	records := `1.1.1.1 "GET /a/x HTTP/1.1" 200
+2.2.2.2 "GET /a/y HTTP/1.1" 200
+3.3.3.3 "POST /b/x HTTP/1.1" 200
+1.1.1.1 "-" 408
+4.4.4.4 "GET /a/z HTTP/1.1" 404
+`
+	got := runBoth(t, records, "-q", "-f", "2", "--extract", `^\S+ /(\w+)/`, "--on-error", "skip")
+	if got != "3 a\n1 b\n" {
+		t.Errorf("got\n%s", got)
+	}
+	got = runBoth(t, records, "--extract", `^1\.\d\.\d\.(?P<last>\d)|(4)`, "--on-error", "skip")
+	// 4.4.4.4 only matches the unnamed group, so its key is empty
+	if got != "2 1\n1 \n" {
+		t.Errorf("named got\n%s", got)
+	}
+
+	// the groups are separate fields in the JSON output, and records that don't match are key errors
+	config, err := Configure([]string{"-q", "-f", "2,3", "--extract", `^(?P<method>\S+) /(\w+)/.* (?P<status>\d+)$`,
+		"--on-error", "skip", "--output", "json"})
+	if err != nil {
+		t.Fatal("configure: " + err.Error())
+	}
+	counts, stats, err := config.run(context.Background(), strings.NewReader(records))
+	if err != nil {
+		t.Fatal("run: " + err.Error())
+	}
+	out := &bytes.Buffer{}
+	if err = Output(config, counts, out); err != nil {
+		t.Fatal("output: " + err.Error())
+	}
+	for _, wanted := range []string{`"method":"GET","status":"200"`, `"method":"POST","status":"200"`,
+		`"method":"GET","status":"404"`} {
+		if !strings.Contains(out.String(), wanted) {
+			t.Errorf("no %s in %s", wanted, out.String())
+		}
+	}
+	if stats.KeyErrors != 1 || stats.Counted != 4 {
+		t.Errorf("stats %+v", *stats)
+	}
+}
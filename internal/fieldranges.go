@@ -0,0 +1,200 @@
+package topfew
+
+// A field list is comma-separated, and each item in it is a field number, counting from 1, or back from -1 for
+//  the last field; or a range of them, such as 3-6, 5- for the fifth field to the end, or -3--1 for the last
+//  three. The items can come in any order. The fields in a range are joined with spaces, and the items with
+//  the keyFinder's joiner, so each item is one field in the JSON and CSV output.
+// The usual case of increasing field numbers is dealt with by the keyFinder's original code, which stops as soon
+//  as it has the last field it needs; anything else is done by finding where the fields are first, then picking
+//  them out.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// fieldRange is an item in a field list: the fields from from to to, which are the same for a single field
+type fieldRange struct {
+	from int
+	to   int
+}
+
+// fieldSpan is where a field is in a record
+type fieldSpan struct {
+	start int
+	end   int
+}
+
+func parseFields(spec string) ([]fieldRange, error) {
+	var fields []fieldRange
+	for _, part := range strings.Split(spec, ",") {
+		field, err := parseFieldRange(part)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// parseFieldRange parses one item of a field list
+func parseFieldRange(part string) (fieldRange, error) {
+	var field fieldRange
+	var err error
+	// a leading - is a minus sign, so a range's - is after that
+	dash := -1
+	if len(part) > 1 {
+		if d := strings.IndexByte(part[1:], '-'); d != -1 {
+			dash = d + 1
+		}
+	}
+	switch {
+	case dash == -1:
+		field.from, err = strconv.Atoi(part)
+		field.to = field.from
+	case dash == len(part)-1:
+		field.from, err = strconv.Atoi(part[:dash])
+		field.to = -1
+	default:
+		field.from, err = strconv.Atoi(part[:dash])
+		if err == nil {
+			field.to, err = strconv.Atoi(part[dash+1:])
+		}
+	}
+	if err != nil {
+		return field, fmt.Errorf("illegal field spec: %w", err)
+	}
+	if field.from == 0 || field.to == 0 {
+		return field, errors.New("illegal field number 0")
+	}
+	if (field.from > 0) == (field.to > 0) && field.from > field.to {
+		return field, fmt.Errorf("field range \"%s\" is backwards", part)
+	}
+	return field, nil
+}
+
+// single says whether the range is one field, which can be told without seeing the record
+func (field fieldRange) single() bool {
+	return field.from == field.to
+}
+
+// simpleFields returns the field numbers in a field list if they're all single, positive, and increasing, which
+// is what newKeyFinder can deal with
+func simpleFields(ranges []fieldRange) ([]uint, bool) {
+	var fields []uint
+	last := 0
+	for _, field := range ranges {
+		if !field.single() || field.from <= last {
+			return nil, false
+		}
+		last = field.from
+		fields = append(fields, uint(field.from))
+	}
+	return fields, true
+}
+
+// newRangeKeyFinder is newKeyFinder for any field list
+func newRangeKeyFinder(ranges []fieldRange, separator *regexp.Regexp, quotedFields bool) *keyFinder {
+	if fields, ok := simpleFields(ranges); ok {
+		return newKeyFinder(fields, separator, quotedFields)
+	}
+	kf := newKeyFinder(nil, separator, quotedFields)
+	kf.ranges = ranges
+	// if all the field numbers count from the start, there's no need to look further than the last of them
+	for _, field := range ranges {
+		if field.from < 0 || field.to < 0 {
+			kf.lastField = 0
+			break
+		}
+		if field.to > kf.lastField {
+			kf.lastField = field.to
+		}
+	}
+	return kf
+}
+
+// getRangeKey is getKey for field lists that simpleFields doesn't accept
+func (kf *keyFinder) getRangeKey(record []byte) ([]byte, error) {
+	spans, err := kf.fieldSpans(record)
+	if err != nil {
+		return nil, err
+	}
+	kf.key = kf.key[:0]
+	for i, field := range kf.ranges {
+		from, to := fieldIndex(field.from, len(spans)), fieldIndex(field.to, len(spans))
+		if from < 0 || to >= len(spans) || from > to {
+			return nil, errors.New(NER)
+		}
+		if i > 0 {
+			kf.key = append(kf.key, kf.joiner)
+		}
+		for f := from; f <= to; f++ {
+			if f > from {
+				kf.key = append(kf.key, ' ')
+			}
+			kf.key = append(kf.key, record[spans[f].start:spans[f].end]...)
+		}
+	}
+	return kf.key, nil
+}
+
+// fieldIndex turns a field number into an index into a record's fields
+func fieldIndex(field int, fields int) int {
+	if field > 0 {
+		return field - 1
+	}
+	return fields + field
+}
+
+// fieldSpans finds where the record's fields are, in the same way as the simple field-list code; it stops after
+// lastField, if that isn't zero
+func (kf *keyFinder) fieldSpans(record []byte) ([]fieldSpan, error) {
+	kf.spans = kf.spans[:0]
+	if kf.separator != nil {
+		// this is what regexp.Split does
+		start, end := 0, 0
+		for _, match := range kf.separator.FindAllIndex(record, -1) {
+			end = match[0]
+			if match[1] != 0 {
+				kf.spans = append(kf.spans, fieldSpan{start, end})
+			}
+			start = match[1]
+		}
+		if end != len(record) {
+			kf.spans = append(kf.spans, fieldSpan{start, len(record)})
+		}
+		return kf.spans, nil
+	}
+
+	index := 0
+	for kf.lastField == 0 || len(kf.spans) < kf.lastField {
+		for index < len(record) && (record[index] == ' ' || record[index] == '\t') {
+			index++
+		}
+		if index == len(record) {
+			break
+		}
+		start := index
+		if kf.quotedFields && record[index] == '"' {
+			// the field is what's inside the quotes, and the next one starts after the closing quote
+			start++
+			closing := bytes.IndexByte(record[start:], '"')
+			if closing == -1 {
+				return nil, errors.New(NER)
+			}
+			index = start + closing
+			kf.spans = append(kf.spans, fieldSpan{start, index})
+			index++
+			continue
+		}
+		for index < len(record) && record[index] != ' ' && record[index] != '\t' {
+			index++
+		}
+		kf.spans = append(kf.spans, fieldSpan{start, index})
+	}
+	return kf.spans, nil
+}
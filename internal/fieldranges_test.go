@@ -0,0 +1,139 @@
+package topfew
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestParseFields(t *testing.T) {
+	goods := map[string][]fieldRange{
+		"3":         {{3, 3}},
+		"7,1":       {{7, 7}, {1, 1}},
+		"3-6":       {{3, 6}},
+		"5-":        {{5, -1}},
+		"-1":        {{-1, -1}},
+		"-3--1,2-2": {{-3, -1}, {2, 2}},
+		"-3-":       {{-3, -1}},
+		"2--2":      {{2, -2}},
+	}
+	for spec, wanted := range goods {
+		got, err := parseFields(spec)
+		if err != nil || len(got) != len(wanted) {
+			t.Errorf("%s: got %v, %v", spec, got, err)
+			continue
+		}
+		for i := range got {
+			if got[i] != wanted[i] {
+				t.Errorf("%s: got %v", spec, got)
+			}
+		}
+	}
+	for _, bad := range []string{"", "0", "1,0", "-", "--1", "3-1", "-1--3", "1-0", "x", "1-x", "1,,2", "1-2-3"} {
+		if got, err := parseFields(bad); err == nil {
+			t.Errorf("%s: accepted, got %v", bad, got)
+		}
+	}
+
+	if fields, ok := simpleFields([]fieldRange{{1, 1}, {3, 3}}); !ok || len(fields) != 2 || fields[1] != 3 {
+		t.Errorf("simple got %v", fields)
+	}
+	for _, spec := range []string{"3,1", "1,1", "2-3", "-1"} {
+		ranges, _ := parseFields(spec)
+		if _, ok := simpleFields(ranges); ok {
+			t.Errorf("%s is simple", spec)
+		}
+	}
+}
+
+func TestRangeKeys(t *testing.T) {
+	record := []byte("a b  \"c d\" e\tf g\n")
+	tests := []struct {
+		spec   string
+		quoted bool
+		key    string
+	}{
+		{"7,1", false, "g a"},
+		{"2-4", false, "b \"c d\""},
+		{"-1", false, "g"},
+		{"6-", false, "f g"},
+		{"-2-,1", false, "f g a"},
+		{"1,1", false, "a a"},
+		{"3,1", true, "c d a"},
+		{"-3--1", true, "e f g"},
+		{"2-3", true, "b c d"},
+	}
+	for _, test := range tests {
+		ranges, err := parseFields(test.spec)
+		if err != nil {
+			t.Fatal("parse: " + err.Error())
+		}
+		kf := newRangeKeyFinder(ranges, nil, test.quoted).clone()
+		key, err := kf.getKey(record)
+		if err != nil || string(key) != test.key {
+			t.Errorf("%s quoted %v: got %q, %v", test.spec, test.quoted, string(key), err)
+		}
+	}
+
+	// with a regexp separator, fields are found the same way as by regexp.Split
+	separator := regexp.MustCompile(",+")
+	for _, record := range []string{"a,b,,c", ",a,b", "a,b,", "a"} {
+		ranges, _ := parseFields("-1,1")
+		kf := newRangeKeyFinder(ranges, separator, false)
+		fields := separator.Split(record, -1)
+		key, err := kf.getKey([]byte(record + "\n"))
+		if err != nil || string(key) != fields[len(fields)-1]+" "+fields[0] {
+			t.Errorf("%q: got %q, %v", record, string(key), err)
+		}
+	}
+
+	// records without enough fields, and an unterminated quote, but only if the fields after it are needed
+	for _, spec := range []string{"8", "1-8", "-8", "7-", "6--3"} {
+		ranges, _ := parseFields(spec)
+		if key, err := newRangeKeyFinder(ranges, nil, false).getKey([]byte("a b c d e f g\n")); err == nil {
+			if spec != "7-" {
+				t.Errorf("%s: got %q", spec, string(key))
+			}
+		}
+	}
+	ranges, _ := parseFields("2,1")
+	kf := newRangeKeyFinder(ranges, nil, true)
+	if key, err := kf.getKey([]byte("a b \"c\n")); err != nil || string(key) != "b a" {
+		t.Errorf("stopping early got %q, %v", string(key), err)
+	}
+	ranges, _ = parseFields("-1")
+	kf = newRangeKeyFinder(ranges, nil, true)
+	if key, err := kf.getKey([]byte("a b \"c\n")); err == nil {
+		t.Errorf("unterminated quote got %q", string(key))
+	}
+}
+
+func TestFieldRanges(t *testing.T) {
+	records := `1.1.1.1 GET /a 200 10
+2.2.2.2 GET /b 404 20
+1.1.1.1 POST /a 200 30
+`
+	if got := runBoth(t, records, "-f", "3,2", "--sum", "-1"); got != "30 /a POST\n20 /b GET\n10 /a GET\n" {
+		t.Errorf("got\n%s", got)
+	}
+	if got := runBoth(t, records, "-f", "-3", "--group-by", "-2"); got != "200:\n2 /a\n\n404:\n1 /b\n" {
+		t.Errorf("got\n%s", got)
+	}
+
+	// each item in the list is a field in the output
+	config, err := Configure([]string{"-f", "-2,2-3", "--output", "json"})
+	if err != nil {
+		t.Fatal("configure: " + err.Error())
+	}
+	counts, _, err := config.run(context.Background(), strings.NewReader(records))
+	if err != nil {
+		t.Fatal("run: " + err.Error())
+	}
+	out := &bytes.Buffer{}
+	_ = Output(config, counts, out)
+	if !strings.Contains(out.String(), `"fields":{"field-2":"404","field2-3":"GET /b"}`) {
+		t.Errorf("got %s", out.String())
+	}
+}
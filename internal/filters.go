@@ -49,20 +49,24 @@ func (f *filters) addVgrep(s string) error {
 // filterRecord returns true if the supplied record passes all the filter
 // criteria.
 func (f *filters) filterRecord(bytes []byte) bool {
-	if f.greps == nil && f.vgreps == nil {
-		return true
-	}
-	for _, re := range f.greps {
+	index, _ := f.rejectedBy(bytes)
+	return index < 0
+}
+
+// rejectedBy returns the index of the first grep or vgrep, whichever vgrep says, that rejects the record,
+// or -1 if it passes them all.
+func (f *filters) rejectedBy(bytes []byte) (index int, vgrep bool) {
+	for i, re := range f.greps {
 		if !re.Match(bytes) {
-			return false
+			return i, false
 		}
 	}
-	for _, re := range f.vgreps {
+	for i, re := range f.vgreps {
 		if re.Match(bytes) {
-			return false
+			return i, true
 		}
 	}
-	return true
+	return -1, false
 }
 
 // filterField returns a Key that has had all the sed operations applied to it.
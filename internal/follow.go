@@ -0,0 +1,204 @@
+package topfew
+
+// With --follow, topfew keeps reading as data is appended to a file, like tail -F, and every --interval
+//  prints the current top list, redrawing the screen if the output is a terminal. The file is checked
+//  for rotation, i.e. replacement by a new file of the same name, and truncation whenever there's nothing
+//  new to read. A reader goroutine hands records to the loop that counts them and prints the results, so
+//  printing happens even when no data is arriving.
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// followPoll is how often to look for more data at the end of a followed file
+var followPoll = 250 * time.Millisecond
+
+// clearScreen moves the cursor to the top left of a terminal and clears it
+const clearScreen = "\x1b[H\x1b[2J"
+
+// followReader reads a file, and instead of returning io.EOF at the end, waits for more to be written
+type followReader struct {
+	ctx    context.Context
+	fname  string
+	file   *os.File
+	next   *os.File
+	offset int64
+	poll   time.Duration
+}
+
+func newFollowReader(ctx context.Context, fname string) (*followReader, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	return &followReader{ctx: ctx, fname: fname, file: file, poll: followPoll}, nil
+}
+
+func (f *followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := f.file.Read(p)
+		f.offset += int64(n)
+		if n > 0 {
+			return n, nil
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return 0, err
+		}
+		if f.next != nil {
+			// the old file's been read to the end, so it's time to start on its replacement
+			_ = f.file.Close()
+			f.file, f.next, f.offset = f.next, nil, 0
+			continue
+		}
+		if err = f.wait(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// wait sleeps for a while, then checks whether the file has been rotated or truncated. After a rotation, the
+// old file is read to the end in case anything was written to it since the last read.
+func (f *followReader) wait() error {
+	select {
+	case <-f.ctx.Done():
+		return f.ctx.Err()
+	case <-time.After(f.poll):
+	}
+	named, err := os.Stat(f.fname)
+	if err != nil {
+		// probably in the middle of being rotated
+		return nil
+	}
+	current, err := f.file.Stat()
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(named, current) {
+		if f.next, err = os.Open(f.fname); err != nil {
+			f.next = nil
+		}
+		return nil
+	}
+	if named.Size() < f.offset {
+		_, err = f.file.Seek(0, io.SeekStart)
+		f.offset = 0
+	}
+	return err
+}
+
+// Close closes the files; it mustn't be called while a Read is under way
+func (f *followReader) Close() error {
+	if f.next != nil {
+		_ = f.next.Close()
+	}
+	return f.file.Close()
+}
+
+// runFollow counts the records from instream, or the named file if there is one, printing the top list to out
+// every interval. It only returns if the stream ends, or there's an error, or ctx is cancelled, and then
+// returns the top list for the caller to print, and the statistics.
+func (config *config) runFollow(ctx context.Context, instream io.Reader, out io.Writer) ([]*keyCount, *Stats,
+	error) {
+	began := time.Now()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// reading is the reader goroutine, which has to have stopped before the file it reads is closed
+	var reading sync.WaitGroup
+	if len(config.fnames) == 1 {
+		reader, err := newFollowReader(ctx, config.fnames[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		defer func() {
+			cancel()
+			reading.Wait()
+			_ = reader.Close()
+		}()
+		instream = reader
+	}
+	kf, err := config.newRunKeyFinder()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() { _ = kf.onError.close() }()
+	counter := config.newCounter()
+	terminal := false
+	if file, ok := out.(*os.File); ok {
+		if info, err := file.Stat(); err == nil {
+			terminal = info.Mode()&os.ModeCharDevice != 0
+		}
+	}
+
+	// the reader sets readErr before closing records, so it's safe to look at once records is closed
+	records := make(chan []byte, 1024)
+	var readErr error
+	reading.Add(1)
+	go func() {
+		defer reading.Done()
+		defer close(records)
+		reader := bufio.NewReader(instream)
+		for {
+			record, err := readStreamRecord(reader, kf)
+			if err != nil && !errors.Is(err, io.EOF) {
+				readErr = err
+				return
+			}
+			// the last line needn't end with a newline
+			if len(record) > 0 {
+				select {
+				case records <- record:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(config.interval)
+	defer ticker.Stop()
+	changed := true
+	done := ctx.Done()
+	for {
+		select {
+		case <-done:
+			return nil, nil, ctx.Err()
+		case record, ok := <-records:
+			if !ok {
+				if readErr != nil {
+					return nil, nil, readErr
+				}
+				if err := kf.onError.close(); err != nil {
+					return nil, nil, err
+				}
+				return config.results(counter), config.finishStats(counter, began), nil
+			}
+			if err := countRecord(record, &config.filter, kf, counter); err != nil {
+				return nil, nil, err
+			}
+			changed = true
+		case <-ticker.C:
+			if !changed {
+				continue
+			}
+			changed = false
+			if terminal {
+				_, _ = io.WriteString(out, clearScreen)
+			}
+			if err := Output(config, config.results(counter), out); err != nil {
+				return nil, nil, err
+			}
+			if !terminal && config.output == outputText {
+				_, _ = io.WriteString(out, "\n")
+			}
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package topfew
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readFollowed reads from a followReader until it has seen want bytes
+func readFollowed(t *testing.T, f *followReader, want int) string {
+	t.Helper()
+	buf := make([]byte, 1024)
+	var got []byte
+	for len(got) < want {
+		n, err := f.Read(buf)
+		if err != nil {
+			t.Fatal("read: " + err.Error())
+		}
+		got = append(got, buf[:n]...)
+	}
+	return string(got)
+}
+
+// appendTo adds data to the end of a file; it's called from goroutines, so can't use t.Fatal
+func appendTo(t *testing.T, fname string, data string) {
+	t.Helper()
+	file, err := os.OpenFile(fname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Error("open: " + err.Error())
+		return
+	}
+	//noinspection ALL
+	defer file.Close()
+	if _, err = file.WriteString(data); err != nil {
+		t.Error("write: " + err.Error())
+	}
+}
+
+func TestFollowReader(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	fname := filepath.Join(t.TempDir(), "log")
+	appendTo(t, fname, "one\n")
+	f, err := newFollowReader(ctx, fname)
+	if err != nil {
+		t.Fatal("newFollowReader: " + err.Error())
+	}
+	//noinspection ALL
+	defer f.Close()
+	f.poll = 10 * time.Millisecond
+
+	if got := readFollowed(t, f, 4); got != "one\n" {
+		t.Errorf("got %q at start", got)
+	}
+
+	// appended data shows up even though the reader had hit the end
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		appendTo(t, fname, "two\n")
+	}()
+	if got := readFollowed(t, f, 4); got != "two\n" {
+		t.Errorf("got %q after append", got)
+	}
+
+	// truncation
+	if err = os.WriteFile(fname, []byte("3\n"), 0o600); err != nil {
+		t.Fatal("truncate: " + err.Error())
+	}
+	if got := readFollowed(t, f, 2); got != "3\n" {
+		t.Errorf("got %q after truncation", got)
+	}
+
+	// rotation, with a last line written to the old file after it's been renamed
+	if err = os.Rename(fname, fname+".1"); err != nil {
+		t.Fatal("rename: " + err.Error())
+	}
+	appendTo(t, fname+".1", "old\n")
+	appendTo(t, fname, "new\n")
+	if got := readFollowed(t, f, 8); got != "old\nnew\n" {
+		t.Errorf("got %q after rotation", got)
+	}
+
+	cancel()
+	if _, err = f.Read(make([]byte, 10)); err == nil {
+		t.Error("read after cancel succeeded")
+	}
+}
+
+func TestFollowStream(t *testing.T) {
+	config, err := Configure([]string{"--follow", "--interval", "10ms", "-f", "1"})
+	if err != nil {
+		t.Fatal("configure: " + err.Error())
+	}
+
+	// the top list is printed while the stream is paused, and returned when it ends
+	reader, writer := io.Pipe()
+	go func() {
+		_, _ = writer.Write([]byte("a x\nb y\na z\n"))
+		time.Sleep(200 * time.Millisecond)
+		_, _ = writer.Write([]byte("b\nb\n"))
+		_ = writer.Close()
+	}()
+	out := &bytes.Buffer{}
+	counts, _, err := config.runFollow(context.Background(), reader, out)
+	if err != nil {
+		t.Fatal("runFollow: " + err.Error())
+	}
+	if !strings.HasPrefix(out.String(), "2 a\n1 b\n\n") {
+		t.Errorf("printed %q", out.String())
+	}
+	if len(counts) != 2 || counts[0].Key != "b" || *counts[0].Count != 3 || *counts[1].Count != 2 {
+		t.Errorf("bad counts %v", counts)
+	}
+}
+
+func TestFollowStreamUnterminatedLastLine(t *testing.T) {
+	config, err := Configure([]string{"--follow", "--interval", "10ms", "-f", "1"})
+	if err != nil {
+		t.Fatal("configure: " + err.Error())
+	}
+	counts, _, err := config.runFollow(context.Background(), strings.NewReader("a\nb\nb"), &bytes.Buffer{})
+	if err != nil {
+		t.Fatal("runFollow: " + err.Error())
+	}
+	if len(counts) != 2 || counts[0].Key != "b" || *counts[0].Count != 2 {
+		t.Errorf("bad counts %v", counts)
+	}
+}
+
+func TestFollowFile(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "log")
+	appendTo(t, fname, "a\nb\na\n")
+	config, err := Configure([]string{"--follow", "--interval", "10ms", fname})
+	if err != nil {
+		t.Fatal("configure: " + err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		appendTo(t, fname, "c\nc\nc\n")
+		time.Sleep(500 * time.Millisecond)
+		cancel()
+	}()
+	out := &bytes.Buffer{}
+	_, _, err = config.runFollow(ctx, nil, out)
+	if err == nil {
+		t.Error("no error after cancel")
+	}
+	printed := out.String()
+	if !strings.HasPrefix(printed, "2 a\n1 b\n\n") || !strings.HasSuffix(printed, "3 c\n2 a\n1 b\n\n") {
+		t.Errorf("printed %q", printed)
+	}
+}
+
+func TestFollowCancelDuringRotation(t *testing.T) {
+	defer func(poll time.Duration) { followPoll = poll }(followPoll)
+	followPoll = time.Millisecond
+	fname := filepath.Join(t.TempDir(), "log")
+	appendTo(t, fname, "a\n")
+	config, err := Configure([]string{"--follow", "--interval", "10ms", fname})
+	if err != nil {
+		t.Fatal("configure: " + err.Error())
+	}
+
+	// the file keeps being rotated until after the cancel, so the reader is likely to be in the middle of
+	// a read or a rotation when runFollow closes the files; go test -race catches it if they overlap
+	ctx, cancel := context.WithCancel(context.Background())
+	rotated := make(chan struct{})
+	go func() {
+		defer close(rotated)
+		for i := 0; i < 100; i++ {
+			if i == 50 {
+				cancel()
+			}
+			if err := os.Rename(fname, fname+".1"); err != nil {
+				t.Error("rename: " + err.Error())
+				return
+			}
+			appendTo(t, fname+".1", "b\n")
+			appendTo(t, fname, "c\n")
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	_, _, err = config.runFollow(ctx, nil, &bytes.Buffer{})
+	if err == nil {
+		t.Error("no error after cancel")
+	}
+	<-rotated
+}
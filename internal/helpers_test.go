@@ -0,0 +1,63 @@
+package topfew
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// runBoth runs topfew on the records from a stream and a file, checks they got the same results, and
+// returns the text output
+func runBoth(t *testing.T, records string, args ...string) string {
+	t.Helper()
+	fname := filepath.Join(t.TempDir(), "records")
+	if err := os.WriteFile(fname, []byte(records), 0o600); err != nil {
+		t.Fatal("write: " + err.Error())
+	}
+	config, err := Configure(args)
+	if err != nil {
+		t.Fatal("configure: " + err.Error())
+	}
+	fromStream, _, err := config.run(context.Background(), strings.NewReader(records))
+	if err != nil {
+		t.Fatal("stream: " + err.Error())
+	}
+	config.fnames = []string{fname}
+	config.width = 3
+	fromFile, _, err := config.run(context.Background(), nil)
+	if err != nil {
+		t.Fatal("file: " + err.Error())
+	}
+	var streamOut, fileOut bytes.Buffer
+	_ = Output(config, fromStream, &streamOut)
+	_ = Output(config, fromFile, &fileOut)
+	if streamOut.String() != fileOut.String() {
+		t.Errorf("stream got\n%s\nfile got\n%s", streamOut.String(), fileOut.String())
+	}
+	return streamOut.String()
+}
+
+// runSorted configures topfew with args, runs it on the records from stream, or from the files in args if
+// stream is nil, and returns the text output with its lines sorted, because keys with the same count can come
+// in any order, along with the statistics
+func runSorted(t *testing.T, stream io.Reader, args ...string) (string, *Stats) {
+	t.Helper()
+	config, err := Configure(args)
+	if err != nil {
+		t.Fatal("configure: " + err.Error())
+	}
+	counts, stats, err := config.run(context.Background(), stream)
+	if err != nil {
+		t.Fatal("run: " + err.Error())
+	}
+	out := &bytes.Buffer{}
+	_ = Output(config, counts, out)
+	lines := strings.Split(out.String(), "\n")
+	sort.Strings(lines)
+	return strings.Join(lines, "\n"), stats
+}
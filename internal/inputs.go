@@ -0,0 +1,76 @@
+package topfew
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// inputFiles turns the file names from the command line into the list of files to read. A directory is
+// walked recursively, and the files in it are read if their names match one of the include globs (or there
+// are none) and none of the exclude globs. A name which doesn't exist but contains glob characters is
+// expanded, for the benefit of shells that don't do that.
+func inputFiles(names []string, include []string, exclude []string) ([]string, error) {
+	var files []string
+	for _, name := range names {
+		matches := []string{name}
+		if _, err := os.Stat(name); err != nil {
+			if !strings.ContainsAny(name, "*?[") {
+				return nil, err
+			}
+			matches, err = filepath.Glob(name)
+			if err != nil {
+				return nil, err
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match %s", name)
+			}
+		}
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				files = append(files, match)
+				continue
+			}
+			err = filepath.WalkDir(match, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if d.Type().IsRegular() && globsAllow(d.Name(), include, exclude) {
+					files = append(files, path)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files to read in %s", strings.Join(names, ", "))
+	}
+	return files, nil
+}
+
+// globsAllow checks a file name found in a directory against the --include and --exclude globs
+func globsAllow(name string, include []string, exclude []string) bool {
+	for _, glob := range exclude {
+		if matched, _ := filepath.Match(glob, name); matched {
+			return false
+		}
+	}
+	if len(include) == 0 {
+		return true
+	}
+	for _, glob := range include {
+		if matched, _ := filepath.Match(glob, name); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package topfew
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInputFiles(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{"a.log", "b.log", "c.txt", "d.log.gz", "sub/e.log", "sub/deeper/f.txt"}
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal("mkdir: " + err.Error())
+		}
+		if err := os.WriteFile(path, []byte(name+"\n"), 0o600); err != nil {
+			t.Fatal("write: " + err.Error())
+		}
+	}
+
+	cases := []struct {
+		args    []string
+		include []string
+		exclude []string
+		wanted  []string
+	}{
+		{[]string{dir}, nil, nil, []string{"a.log", "b.log", "c.txt", "d.log.gz", "sub/deeper/f.txt", "sub/e.log"}},
+		{[]string{dir}, []string{"*.log"}, nil, []string{"a.log", "b.log", "sub/e.log"}},
+		{[]string{dir}, []string{"*.log", "*.gz"}, []string{"b*"}, []string{"a.log", "d.log.gz", "sub/e.log"}},
+		{[]string{dir}, nil, []string{"*.log"}, []string{"c.txt", "d.log.gz", "sub/deeper/f.txt"}},
+		{[]string{filepath.Join(dir, "*.log")}, nil, nil, []string{"a.log", "b.log"}},
+		{[]string{filepath.Join(dir, "c.txt"), filepath.Join(dir, "sub")}, nil, nil,
+			[]string{"c.txt", "sub/deeper/f.txt", "sub/e.log"}},
+
+		// files named explicitly are read whatever the globs say
+		{[]string{filepath.Join(dir, "c.txt")}, []string{"*.log"}, nil, []string{"c.txt"}},
+	}
+	for i, c := range cases {
+		files, err := inputFiles(c.args, c.include, c.exclude)
+		if err != nil {
+			t.Errorf("case %d: %s", i, err.Error())
+			continue
+		}
+		if len(files) != len(c.wanted) {
+			t.Errorf("case %d: got %d files wanted %d", i, len(files), len(c.wanted))
+			continue
+		}
+		for j, file := range files {
+			if file != filepath.Join(dir, c.wanted[j]) {
+				t.Errorf("case %d: got %s wanted %s", i, file, c.wanted[j])
+			}
+		}
+	}
+
+	bads := [][]string{
+		{filepath.Join(dir, "nosuch")},
+		{filepath.Join(dir, "*.nosuch")},
+		{filepath.Join(dir, "a.log"), filepath.Join(dir, "nosuch")},
+	}
+	for _, bad := range bads {
+		if _, err := inputFiles(bad, nil, nil); err == nil {
+			t.Errorf("accepted %v", bad)
+		}
+	}
+	if _, err := inputFiles([]string{dir}, []string{"*.nosuch"}, nil); err == nil {
+		t.Error("accepted directory with no matching files")
+	}
+}
+
+func TestMultipleFiles(t *testing.T) {
+	single := allCounts(t, "-f", "1", "../test/data/small")
+	doubled := make(map[string]uint64)
+	for key, count := range single {
+		doubled[key] = 2 * count
+	}
+	for _, width := range []string{"1", "3", "100"} {
+		got := allCounts(t, "-f", "1", "-w", width, "../test/data/small", "../test/data/small-multi.bz2")
+		assertCountsMatch(t, "two files, width "+width, doubled, got)
+	}
+}
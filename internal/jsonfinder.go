@@ -0,0 +1,397 @@
+package topfew
+
+// In JSON mode, each record is a JSON text (typically an object, one per line as in NDJSON) and the fields
+//  are paths like request.method or items[2].name. Rather than unmarshaling every record, which would be
+//  painfully slow, we walk the bytes looking only for the members and array elements on each path,
+//  skipping everything else without decoding it.
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// what to do when a record doesn't contain a value at one of the requested paths
+const (
+	missingError = iota // report the record as one we can't extract a key from
+	missingSkip         // quietly ignore the record
+	missingNull         // use "null" as the value
+)
+
+// errSkipRecord is returned by getKey when a record should be quietly ignored rather than counted
+var errSkipRecord = errors.New("skip record")
+
+var errJSONMissing = errors.New("JSON path not found in record")
+var errJSONSyntax = errors.New("malformed JSON in record")
+
+// jsonStep is one step along a path into a JSON text; either an object member name or an array index
+type jsonStep struct {
+	name    string
+	index   int
+	isIndex bool
+}
+
+// parseMissing turns the --missing argument into one of the missingXxx constants
+func parseMissing(s string) (int, error) {
+	switch s {
+	case "", "error":
+		return missingError, nil
+	case "skip":
+		return missingSkip, nil
+	case "null":
+		return missingNull, nil
+	}
+	return 0, fmt.Errorf("--missing must be one of skip, null, or error, not \"%s\"", s)
+}
+
+// parseJSONPaths turns a --fields argument like "request.method,tags[0]" into a list of paths
+func parseJSONPaths(spec string) ([][]jsonStep, error) {
+	var paths [][]jsonStep
+	for _, pathSpec := range strings.Split(spec, ",") {
+		path, err := parseJSONPath(pathSpec)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+func parseJSONPath(spec string) ([]jsonStep, error) {
+	var path []jsonStep
+	rest := spec
+	for {
+		// a member name, which may only be omitted if the path starts with an index
+		nameEnd := strings.IndexAny(rest, ".[")
+		if nameEnd == -1 {
+			nameEnd = len(rest)
+		}
+		if nameEnd > 0 {
+			path = append(path, jsonStep{name: rest[:nameEnd]})
+		} else if len(path) > 0 || len(rest) == 0 || rest[0] != '[' {
+			return nil, fmt.Errorf("illegal JSON path \"%s\"", spec)
+		}
+		rest = rest[nameEnd:]
+
+		// any number of [n] indexes
+		for len(rest) > 0 && rest[0] == '[' {
+			closer := strings.IndexByte(rest, ']')
+			if closer == -1 {
+				return nil, fmt.Errorf("unclosed [ in JSON path \"%s\"", spec)
+			}
+			index, err := strconv.Atoi(rest[1:closer])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("illegal array index in JSON path \"%s\"", spec)
+			}
+			path = append(path, jsonStep{index: index, isIndex: true})
+			rest = rest[closer+1:]
+		}
+
+		if len(rest) == 0 {
+			return path, nil
+		}
+		if rest[0] != '.' || len(rest) == 1 {
+			return nil, fmt.Errorf("illegal JSON path \"%s\"", spec)
+		}
+		rest = rest[1:]
+	}
+}
+
+// getJSONKey is getKey for JSON records; the record has already been chomped
+func (kf *keyFinder) getJSONKey(record []byte) ([]byte, error) {
+	kf.key = kf.key[:0]
+	for i, path := range kf.jsonPaths {
+		if i > 0 {
+			kf.key = append(kf.key, kf.joiner)
+		}
+		start, end, err := findJSONValue(record, path)
+		if errors.Is(err, errJSONMissing) {
+			switch kf.missing {
+			case missingSkip:
+				return nil, errSkipRecord
+			case missingNull:
+				kf.key = append(kf.key, "null"...)
+				continue
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		kf.key, err = appendJSONValue(kf.key, record[start:end])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return kf.key, nil
+}
+
+// findJSONValue returns the start and end offsets of the value at the end of the path
+func findJSONValue(record []byte, path []jsonStep) (int, int, error) {
+	var err error
+	index := skipJSONSpace(record, 0)
+	for _, step := range path {
+		if step.isIndex {
+			index, err = findJSONElement(record, index, step.index)
+		} else {
+			index, err = findJSONMember(record, index, step.name)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	end, err := skipJSONValue(record, index)
+	if err != nil {
+		return 0, 0, err
+	}
+	return index, end, nil
+}
+
+// findJSONMember expects index to point at an object, and returns the index of the value of the member
+// with the supplied name
+func findJSONMember(record []byte, index int, name string) (int, error) {
+	if index >= len(record) || record[index] != '{' {
+		return 0, errJSONMissing
+	}
+	index = skipJSONSpace(record, index+1)
+	if index < len(record) && record[index] == '}' {
+		return 0, errJSONMissing
+	}
+	for {
+		if index >= len(record) || record[index] != '"' {
+			return 0, errJSONSyntax
+		}
+		nameStart := index + 1
+		var err error
+		index, err = skipJSONString(record, index)
+		if err != nil {
+			return 0, err
+		}
+		memberName := record[nameStart : index-1]
+		index = skipJSONSpace(record, index)
+		if index >= len(record) || record[index] != ':' {
+			return 0, errJSONSyntax
+		}
+		index = skipJSONSpace(record, index+1)
+		if jsonNameMatches(memberName, name) {
+			return index, nil
+		}
+		index, err = skipJSONValue(record, index)
+		if err != nil {
+			return 0, err
+		}
+		index = skipJSONSpace(record, index)
+		if index >= len(record) {
+			return 0, errJSONSyntax
+		}
+		switch record[index] {
+		case ',':
+			index = skipJSONSpace(record, index+1)
+		case '}':
+			return 0, errJSONMissing
+		default:
+			return 0, errJSONSyntax
+		}
+	}
+}
+
+// findJSONElement expects index to point at an array, and returns the index of its want'th element
+func findJSONElement(record []byte, index int, want int) (int, error) {
+	if index >= len(record) || record[index] != '[' {
+		return 0, errJSONMissing
+	}
+	index = skipJSONSpace(record, index+1)
+	if index < len(record) && record[index] == ']' {
+		return 0, errJSONMissing
+	}
+	for element := 0; ; element++ {
+		if element == want {
+			return index, nil
+		}
+		var err error
+		index, err = skipJSONValue(record, index)
+		if err != nil {
+			return 0, err
+		}
+		index = skipJSONSpace(record, index)
+		if index >= len(record) {
+			return 0, errJSONSyntax
+		}
+		switch record[index] {
+		case ',':
+			index = skipJSONSpace(record, index+1)
+		case ']':
+			return 0, errJSONMissing
+		default:
+			return 0, errJSONSyntax
+		}
+	}
+}
+
+func skipJSONSpace(record []byte, index int) int {
+	for index < len(record) {
+		switch record[index] {
+		case ' ', '\t', '\r', '\n':
+			index++
+		default:
+			return index
+		}
+	}
+	return index
+}
+
+// skipJSONString expects index to point at an opening quote, and returns the index just past the closing one
+func skipJSONString(record []byte, index int) (int, error) {
+	index++
+	for index < len(record) {
+		switch record[index] {
+		case '\\':
+			index += 2
+		case '"':
+			return index + 1, nil
+		default:
+			index++
+		}
+	}
+	return 0, errJSONSyntax
+}
+
+// skipJSONValue returns the index just past the value that starts at index. Objects and arrays are skipped
+// by counting brackets, without checking what's inside them beyond making sure strings are closed.
+func skipJSONValue(record []byte, index int) (int, error) {
+	if index >= len(record) {
+		return 0, errJSONSyntax
+	}
+	switch record[index] {
+	case '"':
+		return skipJSONString(record, index)
+	case '{', '[':
+		depth := 0
+		for index < len(record) {
+			switch record[index] {
+			case '"':
+				var err error
+				index, err = skipJSONString(record, index)
+				if err != nil {
+					return 0, err
+				}
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return index + 1, nil
+				}
+			}
+			index++
+		}
+		return 0, errJSONSyntax
+	case ',', ':', '}', ']':
+		return 0, errJSONSyntax
+	default:
+		// number, true, false, null
+		start := index
+		for index < len(record) {
+			switch record[index] {
+			case ',', '}', ']', ' ', '\t', '\r', '\n':
+				return index, nil
+			}
+			index++
+		}
+		if index == start {
+			return 0, errJSONSyntax
+		}
+		return index, nil
+	}
+}
+
+// jsonNameMatches checks a raw member name from the record against one from a path; only names with
+// escapes in them need to be decoded
+func jsonNameMatches(raw []byte, name string) bool {
+	for _, b := range raw {
+		if b == '\\' {
+			decoded, err := appendJSONUnescaped(nil, raw)
+			return err == nil && string(decoded) == name
+		}
+	}
+	return string(raw) == name
+}
+
+// appendJSONValue adds a value to the key. Strings are decoded, everything else is copied as it appears.
+func appendJSONValue(key []byte, value []byte) ([]byte, error) {
+	if value[0] == '"' {
+		return appendJSONUnescaped(key, value[1:len(value)-1])
+	}
+	return append(key, value...), nil
+}
+
+// appendJSONUnescaped decodes the contents of a JSON string, without its quotes, onto the end of key
+func appendJSONUnescaped(key []byte, raw []byte) ([]byte, error) {
+	for i := 0; i < len(raw); i++ {
+		if raw[i] != '\\' {
+			key = append(key, raw[i])
+			continue
+		}
+		i++
+		if i == len(raw) {
+			return nil, errJSONSyntax
+		}
+		switch raw[i] {
+		case '"', '\\', '/':
+			key = append(key, raw[i])
+		case 'b':
+			key = append(key, '\b')
+		case 'f':
+			key = append(key, '\f')
+		case 'n':
+			key = append(key, '\n')
+		case 'r':
+			key = append(key, '\r')
+		case 't':
+			key = append(key, '\t')
+		case 'u':
+			r, ok := jsonHex4(raw, i+1)
+			if !ok {
+				return nil, errJSONSyntax
+			}
+			i += 4
+			if utf16.IsSurrogate(r) {
+				// the other half of the pair should follow as another \u escape
+				if low, ok := jsonHex4(raw, i+3); ok && i+2 < len(raw) && raw[i+1] == '\\' && raw[i+2] == 'u' {
+					r = utf16.DecodeRune(r, low)
+					i += 6
+				} else {
+					r = utf8.RuneError
+				}
+			}
+			key = utf8.AppendRune(key, r)
+		default:
+			return nil, errJSONSyntax
+		}
+	}
+	return key, nil
+}
+
+// jsonHex4 decodes the four hex digits starting at raw[index]
+func jsonHex4(raw []byte, index int) (rune, bool) {
+	if index+4 > len(raw) {
+		return 0, false
+	}
+	var r rune
+	for _, b := range raw[index : index+4] {
+		switch {
+		case b >= '0' && b <= '9':
+			r = r<<4 | rune(b-'0')
+		case b >= 'a' && b <= 'f':
+			r = r<<4 | rune(b-'a'+10)
+		case b >= 'A' && b <= 'F':
+			r = r<<4 | rune(b-'A'+10)
+		default:
+			return 0, false
+		}
+	}
+	return r, true
+}
@@ -0,0 +1,161 @@
+package topfew
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestJSONPathParsing(t *testing.T) {
+	goods := map[string][]jsonStep{
+		"a":          {{name: "a"}},
+		"a.b":        {{name: "a"}, {name: "b"}},
+		"a[3]":       {{name: "a"}, {index: 3, isIndex: true}},
+		"[0].x":      {{index: 0, isIndex: true}, {name: "x"}},
+		"a[1][2].bc": {{name: "a"}, {index: 1, isIndex: true}, {index: 2, isIndex: true}, {name: "bc"}},
+	}
+	for spec, wanted := range goods {
+		got, err := parseJSONPath(spec)
+		if err != nil {
+			t.Errorf("rejected %s: %s", spec, err.Error())
+			continue
+		}
+		if len(got) != len(wanted) {
+			t.Errorf("%s: got %d steps wanted %d", spec, len(got), len(wanted))
+			continue
+		}
+		for i := range got {
+			if got[i] != wanted[i] {
+				t.Errorf("%s: step %d got %v wanted %v", spec, i, got[i], wanted[i])
+			}
+		}
+	}
+
+	bads := []string{"", ".a", "a.", "a..b", "a[", "a[x]", "a[-1]", "a[1]b", "a,,b"}
+	for _, bad := range bads {
+		if _, err := parseJSONPaths(bad); err == nil {
+			t.Errorf("accepted bogus path %s", bad)
+		}
+	}
+}
+
+func TestJSONKeys(t *testing.T) {
+	record := `{"ip": "10.0.0.1", "request": {"method": "GET", "path": "/a b", "tags": ["x", {"y": 2}, [3]]},` +
+		` "status": 200, "ok": true, "none": null, "esc\"aped": "tést\n😀", "obj": {"a": [1, "]"]}}`
+
+	tests := map[string]string{
+		"ip":                      "10.0.0.1",
+		"request.method,status":   "GET 200",
+		"status,request.method":   "200 GET",
+		"request.path":            "/a b",
+		"request.tags[0]":         "x",
+		"request.tags[1].y":       "2",
+		"request.tags[2][0]":      "3",
+		"ok,none":                 "true null",
+		`esc"aped`:                "tést\n😀",
+		"obj":                     `{"a": [1, "]"]}`,
+		"request.tags[1],ip":      `{"y": 2} 10.0.0.1`,
+		"obj.a[1],request.method": "] GET",
+	}
+	for spec, wanted := range tests {
+		paths, err := parseJSONPaths(spec)
+		if err != nil {
+			t.Fatalf("parse %s: %s", spec, err.Error())
+		}
+		kf := newJSONKeyFinder(paths, missingError)
+		got, err := kf.getKey([]byte(record + "\n"))
+		if err != nil {
+			t.Errorf("%s: %s", spec, err.Error())
+		} else if string(got) != wanted {
+			t.Errorf("%s: got <%s> wanted <%s>", spec, string(got), wanted)
+		}
+	}
+
+	// whole record when there are no paths
+	kf := newJSONKeyFinder(nil, missingError)
+	got, err := kf.getKey([]byte(`{"a": 1}` + "\n"))
+	if err != nil || string(got) != `{"a": 1}` {
+		t.Errorf("no paths gave <%s>", string(got))
+	}
+}
+
+func TestJSONMissingAndMalformed(t *testing.T) {
+	paths, _ := parseJSONPaths("a.b,c[1]")
+	missings := []string{
+		`{"c": [1, 2]}`,
+		`{"a": {}, "c": [1, 2]}`,
+		`{"a": {"x": 1}, "c": [1, 2]}`,
+		`{"a": 3, "c": [1, 2]}`,
+		`{"a": {"b": 1}, "c": [1]}`,
+		`{"a": {"b": 1}, "c": []}`,
+		`{"a": {"b": 1}, "c": "s"}`,
+		`[1, 2]`,
+		``,
+	}
+	for _, record := range missings {
+		kf := newJSONKeyFinder(paths, missingError)
+		if _, err := kf.getKey([]byte(record + "\n")); !errors.Is(err, errJSONMissing) {
+			t.Errorf("error mode on <%s>: %v", record, err)
+		}
+		kf = newJSONKeyFinder(paths, missingSkip)
+		if _, err := kf.getKey([]byte(record + "\n")); !errors.Is(err, errSkipRecord) {
+			t.Errorf("skip mode on <%s>: %v", record, err)
+		}
+		kf = newJSONKeyFinder(paths, missingNull)
+		got, err := kf.getKey([]byte(record + "\n"))
+		if err != nil || !strings.Contains(string(got), "null") {
+			t.Errorf("null mode on <%s>: <%s> %v", record, string(got), err)
+		}
+	}
+
+	malformeds := []string{
+		`{"a": {"b": 1`,
+		`{"a" {"b": 1}}`,
+		`{a: 1}`,
+		`{"x": "unclosed}`,
+		`{"x": [1, 2, "a": {"b": 1}}`,
+		`{"x": 1 "a": 2}`,
+		`{"a": {"b": "\q"}, "c": [1, 2]}`,
+		`{"a": {"b": "\u12"}, "c": [1, 2]}`,
+		`{"a": {"b": }, "c": [1, 2]}`,
+		`{"c": [1 2]}`,
+		`{"c": [1, `,
+	}
+	for _, record := range malformeds {
+		kf := newJSONKeyFinder(paths, missingNull)
+		if got, err := kf.getKey([]byte(record + "\n")); !errors.Is(err, errJSONSyntax) {
+			t.Errorf("accepted malformed <%s>, got <%s> %v", record, string(got), err)
+		}
+	}
+}
+
+func TestJSONRun(t *testing.T) {
+	input := `{"method": "GET", "status": 200}
+{"method": "GET", "status": 404}
+{"method": "POST", "status": 200}
+{"method": "GET", "status": 200}
+{"status": 500}
+`
+	c, err := Configure([]string{"--json", "-f", "method", "--missing", "skip"})
+	if err != nil {
+		t.Fatal("config: " + err.Error())
+	}
+	kc, err := Run(c, strings.NewReader(input))
+	if err != nil {
+		t.Fatal("Run: " + err.Error())
+	}
+	assertKeyCountsEqual(t, []*keyCount{{Key: "GET", Count: pv(3)}, {Key: "POST", Count: pv(1)}}, kc)
+
+	c, err = Configure([]string{"-j", "-f", "method,status", "--missing", "null"})
+	if err != nil {
+		t.Fatal("config: " + err.Error())
+	}
+	kc, err = Run(c, strings.NewReader(input))
+	if err != nil {
+		t.Fatal("Run: " + err.Error())
+	}
+	assertKeyCountsEqual(t, []*keyCount{{Key: "GET 200", Count: pv(2)}}, kc[:1])
+	if len(kc) != 4 {
+		t.Errorf("got %d keys wanted 4", len(kc))
+	}
+}
@@ -16,22 +16,62 @@ const NER = "not enough bytes in record"
 
 // keyFinder extracts a Key based on the specified fields from a record. fields is a slice of small integers
 // representing field numbers; 1-based on the command line, 0-based here. The key field is used to store the
-// key as it is built up fromm the record's fields; it is truncated at the beginning of each call.
+// key as it is built up fromm the record's fields, separated by joiner, which is normally a space; it is
+// truncated at the beginning of each call.
 // The idea is to reuse the same storage for each record and minimize allocation and garbage collection. It
 // does mean that the contents of the field are only valid until you call getKey again, and also that
 // the keyFinder type is not thread-safe
 type keyFinder struct {
 	fields       []uint
+	ranges       []fieldRange
+	lastField    int
+	spans        []fieldSpan
 	key          []byte
+	joiner       byte
 	separator    *regexp.Regexp
 	quotedFields bool
+	jsonPaths    [][]jsonStep
+	missing      int
+	csv          *csvFormat
+	getters      []fieldGetter
+	found        recordFields
+	partitioned  []byte
+	format       *formatFinder
+	extract      *extractor
+	transform    *transformer
+	onError      *recordErrors
+}
+
+// recordFields are what the fieldGetters find in a record besides its key. The weight is 1 unless there's a
+// --sum; hasWeight, hasPane, hasGroup, and hasHash say whether those fields are there, and hasValue says whether
+// the --value field was a number.
+type recordFields struct {
+	weight    float64
+	hasWeight bool
+	pane      int64
+	hasPane   bool
+	group     []byte
+	hasGroup  bool
+	hash      uint64
+	hasHash   bool
+	value     float64
+	hasValue  bool
+}
+
+// fieldGetter gets a field other than the key, like --sum's or --time's, from each record, or checks it against
+// a --where. finders returns the keyFinders it uses, which need to see CSV headers and directives.
+type fieldGetter interface {
+	get(record []byte, fields *recordFields) error
+	finders() []*keyFinder
+	clone() fieldGetter
 }
 
 // newKeyFinder creates a new Key finder with the supplied field numbers, the input should be 1 based.
 // keyFinder is not thread-safe, you should clone it for each goroutine that uses it.
 func newKeyFinder(keys []uint, separator *regexp.Regexp, quotedFields bool) *keyFinder {
 	kf := keyFinder{
-		key: make([]byte, 0, 128),
+		key:    make([]byte, 0, 128),
+		joiner: ' ',
 	}
 	for _, knum := range keys {
 		kf.fields = append(kf.fields, knum-1)
@@ -41,24 +81,111 @@ func newKeyFinder(keys []uint, separator *regexp.Regexp, quotedFields bool) *key
 	return &kf
 }
 
+// newJSONKeyFinder creates a Key finder for records which are JSON texts; the key is made of the values
+// found at the supplied paths. missing says what to do about records in which a path leads nowhere.
+func newJSONKeyFinder(paths [][]jsonStep, missing int) *keyFinder {
+	return &keyFinder{
+		key:       make([]byte, 0, 128),
+		joiner:    ' ',
+		jsonPaths: paths,
+		missing:   missing,
+	}
+}
+
+// newCSVKeyFinder creates a Key finder for CSV or TSV records.
+func newCSVKeyFinder(csv *csvFormat) *keyFinder {
+	return &keyFinder{
+		key:    make([]byte, 0, 128),
+		joiner: ' ',
+		csv:    csv,
+	}
+}
+
 // clone returns a new keyFinder with the same configuration. Each goroutine should use its own
 // keyFinder instance.
 func (kf *keyFinder) clone() *keyFinder {
-	return &keyFinder{
+	clone := &keyFinder{
 		fields:       kf.fields,
+		ranges:       kf.ranges,
+		lastField:    kf.lastField,
 		key:          make([]byte, 0, 128),
+		joiner:       kf.joiner,
 		separator:    kf.separator,
 		quotedFields: kf.quotedFields,
+		jsonPaths:    kf.jsonPaths,
+		missing:      kf.missing,
+		onError:      kf.onError,
+	}
+	if kf.csv != nil {
+		clone.csv = kf.csv.clone()
+	}
+	for _, getter := range kf.getters {
+		clone.getters = append(clone.getters, getter.clone())
+	}
+	if kf.format != nil {
+		clone.format = kf.format.clone()
+	}
+	if kf.extract != nil {
+		clone.extract = kf.extract.clone()
 	}
+	if kf.transform != nil {
+		clone.transform = kf.transform.clone()
+	}
+	return clone
+}
+
+// fieldFinders returns the keyFinders for the fields other than the key, like --sum and --time, that there are
+func (kf *keyFinder) fieldFinders() []*keyFinder {
+	var finders []*keyFinder
+	for _, getter := range kf.getters {
+		finders = append(finders, getter.finders()...)
+	}
+	return finders
+}
+
+// getFields runs the fieldGetters on a record, stopping at the first error, which with a --where the record
+// doesn't satisfy is a whereRejection. Like the key, the fields are only valid until it's called again.
+func (kf *keyFinder) getFields(record []byte) (*recordFields, error) {
+	kf.found = recordFields{weight: 1}
+	for _, getter := range kf.getters {
+		if err := getter.get(record, &kf.found); err != nil {
+			return &kf.found, err
+		}
+	}
+	return &kf.found, nil
 }
 
 // getKey extracts a key from the supplied record. This is applied to every record,
 // so efficiency matters.
 func (kf *keyFinder) getKey(record []byte) ([]byte, error) {
+	key, err := kf.findKey(record)
+	if err == nil && kf.extract != nil {
+		key, err = kf.extract.extract(key)
+	}
+	if err != nil || kf.transform == nil {
+		return key, err
+	}
+	return kf.transform.transform(key), nil
+}
+
+// findKey is getKey without --extract: the fields, or the whole record
+func (kf *keyFinder) findKey(record []byte) ([]byte, error) {
+	if kf.csv != nil {
+		return kf.getCSVKey(record)
+	}
 	// chomp
 	if record[len(record)-1] == '\n' {
 		record = record[:len(record)-1]
 	}
+	if kf.jsonPaths != nil {
+		return kf.getJSONKey(record)
+	}
+	if kf.format != nil {
+		return kf.getFormatKey(record)
+	}
+	if kf.ranges != nil {
+		return kf.getRangeKey(record)
+	}
 	// if there are no Key-finders the key is the record
 	if len(kf.fields) == 0 {
 		return record, nil
@@ -93,7 +220,7 @@ func (kf *keyFinder) getKey(record []byte) ([]byte, error) {
 				if first {
 					first = false
 				} else {
-					kf.key = append(kf.key, ' ')
+					kf.key = append(kf.key, kf.joiner)
 				}
 
 				kf.key, index, err = gatherQuoted(kf.key, record, index)
@@ -128,7 +255,7 @@ func (kf *keyFinder) getKey(record []byte) ([]byte, error) {
 				if first {
 					first = false
 				} else {
-					kf.key = append(kf.key, ' ')
+					kf.key = append(kf.key, kf.joiner)
 				}
 
 				// attach desired field to Key
@@ -148,7 +275,7 @@ func (kf *keyFinder) getKey(record []byte) ([]byte, error) {
 				return nil, errors.New(NER)
 			}
 			if i > 0 {
-				kf.key = append(kf.key, ' ')
+				kf.key = append(kf.key, kf.joiner)
 			}
 			kf.key = append(kf.key, []byte(allFields[field])...)
 		}
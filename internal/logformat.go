@@ -0,0 +1,447 @@
+package topfew
+
+// --format names a well-known log format, which says how records are divided into fields, and gives them names
+//  that can be used in the field lists, as in -f status,path. The Apache and nginx access-log formats have
+//  "-quoted fields that contain spaces and a [bracketed] timestamp, which are each a single field without their
+//  quotes and brackets, and the request is also split into its method, path, and protocol. W3C extended logs,
+//  as written by IIS, say which fields they have in a #Fields directive, so the names aren't known until that's
+//  been read; like a CSV header, it's read before a file is divided into segments, and directive lines aren't
+//  records. A #Fields can come again further on, changing the fields of the records after it, so a file with
+//  another one is read in one segment, and streams in a format with directives aren't read in parallel. Syslog
+//  records have a timestamp, host, program, optional process ID, and message.
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// missingField is the span of a field the record doesn't have
+var missingField = fieldSpan{-1, -1}
+
+var errNoFieldsDirective = errors.New("no #Fields directive before the record")
+
+// logFormat is a --format preset. split divides a record into fields, which are named by names unless the
+// names come from a #Fields directive. aliases gives the common names, like status, for fields that have other
+// names in the directive. timeField is the default --time field list, and timeFormat the default --time-format.
+type logFormat struct {
+	name       string
+	split      func(record []byte, spans []fieldSpan) []fieldSpan
+	names      []string
+	directives bool
+	aliases    map[string]string
+	timeField  string
+	timeFormat string
+}
+
+// the fields in the Apache common log format, and the combined format, which nginx also uses by default
+var (
+	commonNames   = []string{"ip", "ident", "user", "time", "request", "status", "bytes"}
+	combinedNames = []string{"ip", "ident", "user", "time", "request", "status", "bytes", "referer", "ua"}
+	requestNames  = []string{"method", "path", "protocol"}
+)
+
+var logFormats = map[string]*logFormat{
+	"apache-common": {
+		name:       "apache-common",
+		split:      accessLogSplitter(len(commonNames)),
+		names:      append(append([]string(nil), commonNames...), requestNames...),
+		timeField:  "time",
+		timeFormat: "apache",
+	},
+	"apache-combined": {
+		name:       "apache-combined",
+		split:      accessLogSplitter(len(combinedNames)),
+		names:      append(append([]string(nil), combinedNames...), requestNames...),
+		timeField:  "time",
+		timeFormat: "apache",
+	},
+	"nginx": {
+		name:       "nginx",
+		split:      accessLogSplitter(len(combinedNames)),
+		names:      append(append([]string(nil), combinedNames...), requestNames...),
+		timeField:  "time",
+		timeFormat: "apache",
+	},
+	"w3c": {
+		name: "w3c",
+		split: func(record []byte, spans []fieldSpan) []fieldSpan {
+			return splitLogFields(record, spans, false)
+		},
+		directives: true,
+		aliases: map[string]string{
+			"ip": "c-ip", "user": "cs-username", "method": "cs-method", "path": "cs-uri-stem",
+			"query": "cs-uri-query", "status": "sc-status", "bytes": "sc-bytes", "host": "cs-host",
+			"referer": "cs(Referer)", "ua": "cs(User-Agent)",
+		},
+		timeField:  "date,time",
+		timeFormat: "2006-01-02 15:04:05",
+	},
+	"syslog": {
+		name:       "syslog",
+		split:      splitSyslog,
+		names:      []string{"time", "host", "program", "pid", "message"},
+		timeField:  "time",
+		timeFormat: "syslog",
+	},
+}
+
+// parseLogFormat looks up the --format argument
+func parseLogFormat(s string) (*logFormat, error) {
+	if s == "" {
+		return nil, nil
+	}
+	format, ok := logFormats[s]
+	if !ok {
+		var names []string
+		for name := range logFormats {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("--format must be one of %s, not \"%s\"", strings.Join(names, ", "), s)
+	}
+	return format, nil
+}
+
+// formatFinder is the part of a keyFinder that picks fields out of records in a --format. names are the
+// fields from the field list, and fields says where each of them is among the fields as split up; for W3C
+// logs, that isn't known until the #Fields directive has been read.
+type formatFinder struct {
+	format *logFormat
+	names  []string
+	fields []int
+	spans  []fieldSpan
+}
+
+// newFormatFinder sets up a formatFinder for a field list, which is made of field names or numbers, the first
+// field as the format splits records up being 1
+func newFormatFinder(format *logFormat, spec string) (*formatFinder, error) {
+	f := &formatFinder{format: format}
+	if spec == "" {
+		return f, nil
+	}
+	f.names = strings.Split(spec, ",")
+	for _, name := range f.names {
+		if name == "" {
+			return nil, errors.New("empty field name in field list")
+		}
+		if num, err := strconv.Atoi(name); err == nil && num < 1 {
+			return nil, fmt.Errorf("illegal field number %d", num)
+		}
+	}
+	if !format.directives {
+		if err := f.setFieldNames(format.names); err != nil {
+			return nil, fmt.Errorf("%w; %s has %s", err, format.name, strings.Join(format.names, ", "))
+		}
+	}
+	return f, nil
+}
+
+// newFormatKeyFinder creates a Key finder for records in a --format
+func newFormatKeyFinder(f *formatFinder) *keyFinder {
+	return &keyFinder{
+		key:    make([]byte, 0, 128),
+		joiner: ' ',
+		format: f.clone(),
+	}
+}
+
+// clone returns a formatFinder with its own working storage; setFieldNames replaces fields rather than
+// changing it, so it can be shared
+func (f *formatFinder) clone() *formatFinder {
+	clone := *f
+	clone.spans = nil
+	return &clone
+}
+
+// setFieldNames finds the fields in the field list among those the records have, which are named by names
+func (f *formatFinder) setFieldNames(names []string) error {
+	positions := make(map[string]int)
+	for i, name := range names {
+		if _, seen := positions[name]; !seen {
+			positions[name] = i
+		}
+	}
+	fields := make([]int, 0, len(f.names))
+	for _, name := range f.names {
+		if num, err := strconv.Atoi(name); err == nil {
+			fields = append(fields, num-1)
+			continue
+		}
+		position, ok := positions[name]
+		if !ok {
+			position, ok = positions[f.format.aliases[name]]
+		}
+		if !ok {
+			return fmt.Errorf("no field named \"%s\"", name)
+		}
+		fields = append(fields, position)
+	}
+	f.fields = fields
+	return nil
+}
+
+// isDirective says whether a record is a directive, like W3C's #Fields, rather than data
+func (kf *keyFinder) isDirective(record []byte) bool {
+	return kf.format != nil && kf.format.format.directives && len(record) > 0 && record[0] == '#'
+}
+
+// setDirective deals with a directive record; the only one that matters is #Fields, which is passed to the
+// keyFinder's formatFinder, and to those of the other fields, like --sum and --time, if there are any
+func (kf *keyFinder) setDirective(record []byte) error {
+	directive := []byte("#Fields:")
+	if !bytes.HasPrefix(record, directive) {
+		return nil
+	}
+	names := strings.Fields(string(record[len(directive):]))
+	for _, finder := range append([]*keyFinder{kf}, kf.fieldFinders()...) {
+		if finder.format == nil || finder.format.names == nil {
+			continue
+		}
+		if err := finder.format.setFieldNames(names); err != nil {
+			return fmt.Errorf("%w in %s", err, strings.TrimSpace(string(record)))
+		}
+	}
+	return nil
+}
+
+// needsDirectives says whether the keyFinder's fields are found using directives, which have to be read from
+// the start of a file before it's divided into segments
+func (kf *keyFinder) needsDirectives() bool {
+	return kf.format != nil && kf.format.format.directives
+}
+
+// readDirectives passes the directives at the start of the input to setDirective
+func readDirectives(reader *bufio.Reader, kf *keyFinder) error {
+	for {
+		next, err := reader.Peek(1)
+		if err != nil || next[0] != '#' {
+			return nil
+		}
+		record, err := reader.ReadBytes('\n')
+		if err := kf.setDirective(record); err != nil {
+			return err
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+// readFileDirectives is readDirectives for a file, which may be compressed. It also says whether there's
+// another #Fields directive further on in the file, after which the records' fields are in different places.
+func readFileDirectives(fname string, kf *keyFinder) (bool, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return false, err
+	}
+	// noinspection ALL
+	defer file.Close()
+	instream, err := decompressStream(file)
+	if err != nil {
+		return false, err
+	}
+	reader := bufio.NewReader(instream)
+	if err = readDirectives(reader, kf); err != nil {
+		return false, err
+	}
+	return laterFieldsDirective(reader)
+}
+
+// laterFieldsDirective says whether there's a #Fields directive at the start of any line in the rest of the
+// input
+func laterFieldsDirective(reader io.Reader) (bool, error) {
+	directive := []byte("\n#Fields:")
+	buf := make([]byte, 64*1024)
+	kept := 0
+	for {
+		n, err := reader.Read(buf[kept:])
+		n += kept
+		if bytes.Contains(buf[:n], directive) {
+			return true, nil
+		}
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		// a directive might be split between reads, so the end of this one is kept
+		kept = len(directive) - 1
+		if kept > n {
+			kept = n
+		}
+		copy(buf, buf[n-kept:n])
+	}
+}
+
+// getFormatKey is getKey for records in a --format
+func (kf *keyFinder) getFormatKey(record []byte) ([]byte, error) {
+	f := kf.format
+	if f.names == nil {
+		return record, nil
+	}
+	if f.fields == nil {
+		return nil, errNoFieldsDirective
+	}
+	record = bytes.TrimSuffix(record, []byte{'\r'})
+	f.spans = f.format.split(record, f.spans[:0])
+	kf.key = kf.key[:0]
+	for i, field := range f.fields {
+		if field >= len(f.spans) || f.spans[field] == missingField {
+			return nil, errors.New(NER)
+		}
+		if i > 0 {
+			kf.key = append(kf.key, kf.joiner)
+		}
+		kf.key = append(kf.key, record[f.spans[field].start:f.spans[field].end]...)
+	}
+	return kf.key, nil
+}
+
+// splitLogFields divides a record into fields separated by white space, where a field in "quotes", or with
+// brackets, in [brackets], may contain spaces. The spans don't include the quotes or brackets, and a quoted
+// field may contain \" escapes.
+func splitLogFields(record []byte, spans []fieldSpan, brackets bool) []fieldSpan {
+	index := 0
+	for {
+		for index < len(record) && (record[index] == ' ' || record[index] == '\t') {
+			index++
+		}
+		if index >= len(record) {
+			return spans
+		}
+		start := index
+		switch {
+		case record[index] == '"':
+			start++
+			index = start
+			for index < len(record) && record[index] != '"' {
+				if record[index] == '\\' {
+					index++
+				}
+				index++
+			}
+			if index > len(record) {
+				index = len(record)
+			}
+			spans = append(spans, fieldSpan{start, index})
+			index++
+		case brackets && record[index] == '[':
+			start++
+			end := bytes.IndexByte(record[start:], ']')
+			if end == -1 {
+				end = len(record)
+			} else {
+				end += start
+			}
+			spans = append(spans, fieldSpan{start, end})
+			index = end + 1
+		default:
+			for index < len(record) && record[index] != ' ' && record[index] != '\t' {
+				index++
+			}
+			spans = append(spans, fieldSpan{start, index})
+		}
+	}
+}
+
+// accessLogSplitter returns a split function for an access log with fields fields, the fifth of which is
+// the request; any more fields are left out, and then the request's method, path, and protocol are added
+func accessLogSplitter(fields int) func(record []byte, spans []fieldSpan) []fieldSpan {
+	const request = 4
+	return func(record []byte, spans []fieldSpan) []fieldSpan {
+		spans = splitLogFields(record, spans, true)
+		if len(spans) > fields {
+			spans = spans[:fields]
+		}
+		for len(spans) < fields {
+			spans = append(spans, missingField)
+		}
+		index, end := spans[request].start, spans[request].end
+		for part := 0; part < len(requestNames); part++ {
+			for index >= 0 && index < end && record[index] == ' ' {
+				index++
+			}
+			if index < 0 || index >= end {
+				spans = append(spans, missingField)
+				continue
+			}
+			start := index
+			for index < end && record[index] != ' ' {
+				index++
+			}
+			spans = append(spans, fieldSpan{start, index})
+		}
+		return spans
+	}
+}
+
+// splitSyslog divides a syslog record, like "Mar  1 12:34:56 host program[123]: message", or with an RFC 3339
+// timestamp, or a <priority> at the start, into its time, host, program, pid, and message
+func splitSyslog(record []byte, spans []fieldSpan) []fieldSpan {
+	index := 0
+	if len(record) > 0 && record[0] == '<' {
+		if end := bytes.IndexByte(record, '>'); end != -1 {
+			index = end + 1
+		}
+	}
+	skipSpaces := func() {
+		for index < len(record) && record[index] == ' ' {
+			index++
+		}
+	}
+	token := func() fieldSpan {
+		skipSpaces()
+		start := index
+		for index < len(record) && record[index] != ' ' {
+			index++
+		}
+		if start == index {
+			return missingField
+		}
+		return fieldSpan{start, index}
+	}
+
+	// "Mar  1 12:34:56" is three tokens, an RFC 3339 timestamp just one
+	timeSpan := token()
+	if timeSpan != missingField && (record[timeSpan.start] < '0' || record[timeSpan.start] > '9') {
+		for i := 0; i < 2; i++ {
+			if next := token(); next != missingField {
+				timeSpan.end = next.end
+			}
+		}
+	}
+	spans = append(spans, timeSpan, token())
+
+	// the program name ends at a [pid], a colon, or a space
+	skipSpaces()
+	start := index
+	for index < len(record) && record[index] != '[' && record[index] != ':' && record[index] != ' ' {
+		index++
+	}
+	program, pid := missingField, missingField
+	if index > start {
+		program = fieldSpan{start, index}
+	}
+	if index < len(record) && record[index] == '[' {
+		if end := bytes.IndexByte(record[index:], ']'); end != -1 {
+			pid = fieldSpan{index + 1, index + end}
+			index += end + 1
+		}
+	}
+	if index < len(record) && record[index] == ':' {
+		index++
+	}
+	skipSpaces()
+	message := missingField
+	if index < len(record) {
+		message = fieldSpan{index, len(record)}
+	}
+	return append(spans, program, pid, message)
+}
@@ -0,0 +1,141 @@
+package topfew
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestLogFormatFields(t *testing.T) {
+	combined := `1.2.3.4 - bob [12/Mar/2007:08:04:39 -0800] "GET /a/b?c=d HTTP/1.1" 200 2326 "http://x.com/" "Agent \"quoted\" 1.0"`
+	tests := []struct {
+		format string
+		record string
+		spec   string
+		key    string
+	}{
+		{"apache-combined", combined, "ip,time", "1.2.3.4 12/Mar/2007:08:04:39 -0800"},
+		{"apache-combined", combined, "status,path,method,protocol", "200 /a/b?c=d GET HTTP/1.1"},
+		{"apache-combined", combined, "ua,referer", `Agent \"quoted\" 1.0 http://x.com/`},
+		{"nginx", combined, "request,7", "GET /a/b?c=d HTTP/1.1 2326"},
+		{"apache-common", `::1 - - [12/Mar/2007:08:04:39 -0800] "POST /x HTTP/1.0" 404 -`, "method,status,bytes",
+			"POST 404 -"},
+		{"syslog", "Mar  1 12:34:56 web1 sshd[123]: Accepted key for root", "time,host,program,pid,message",
+			"Mar  1 12:34:56 web1 sshd 123 Accepted key for root"},
+		{"syslog", "<34>Oct 11 22:14:15 mymachine su: 'su root' failed", "program,message",
+			"su 'su root' failed"},
+		{"syslog", "2024-01-02T03:04:05.123+00:00 host kernel: [ 1.0] usb", "time,program,message",
+			"2024-01-02T03:04:05.123+00:00 kernel [ 1.0] usb"},
+	}
+	for _, test := range tests {
+		f, err := newFormatFinder(logFormats[test.format], test.spec)
+		if err != nil {
+			t.Fatalf("%s %s: %s", test.format, test.spec, err.Error())
+		}
+		key, err := newFormatKeyFinder(f).getKey([]byte(test.record + "\r\n"))
+		if err != nil || string(key) != test.key {
+			t.Errorf("%s %s: got %q, %v", test.format, test.spec, string(key), err)
+		}
+	}
+
+	// fields the record doesn't have
+	for _, test := range []struct{ format, record, spec string }{
+		{"apache-combined", `1.2.3.4 - - [12/Mar/2007:08:04:39 -0800] "-" 408 -`, "path"},
+		{"apache-combined", `1.2.3.4 - - [12/Mar/2007:08:04:39 -0800] "GET / HTTP/1.1" 200 10`, "ua"},
+		{"syslog", "Mar  1 12:34:56 web1 cron: tick", "pid"},
+		{"syslog", "Mar  1 12:34:56 web1 cron[1]:", "message"},
+	} {
+		f, _ := newFormatFinder(logFormats[test.format], test.spec)
+		if key, err := newFormatKeyFinder(f).getKey([]byte(test.record + "\n")); err == nil {
+			t.Errorf("%s %s: got %q", test.format, test.spec, string(key))
+		}
+	}
+
+	for _, spec := range []string{"nope", "ip,,status", "0"} {
+		if _, err := newFormatFinder(logFormats["nginx"], spec); err == nil {
+			t.Errorf("accepted %s", spec)
+		}
+	}
+}
+
+func TestLogFormats(t *testing.T) {
+	combined := `1.1.1.1 - - [12/Mar/2007:08:04:39 -0800] "GET /a HTTP/1.1" 200 10 "-" "curl"
+2.2.2.2 - - [12/Mar/2007:08:14:39 -0800] "GET /b HTTP/1.1" 404 20 "-" "curl"
+1.1.1.1 - - [12/Mar/2007:08:24:39 -0800] "GET /a HTTP/1.1" 200 30 "-" "curl"
+1.1.1.1 - - [12/Mar/2007:09:04:39 -0800] "GET /a HTTP/1.1" 200 40 "-" "Mozilla/5.0 (X11)"
+`
+	if got := runBoth(t, combined, "--format", "apache-combined", "-f", "status,path", "--sum", "bytes"); got !=
+		"80 200 /a\n20 404 /b\n" {
+		t.Errorf("combined got\n%s", got)
+	}
+	// the bracketed timestamp is the default --time, and is read in the apache format
+	if got := runBoth(t, combined, "--format", "nginx", "-f", "ip", "--window", "1h"); got !=
+		"2007-03-12T16:00:00Z to 2007-03-12T17:00:00Z\n2 1.1.1.1\n1 2.2.2.2\n\n"+
+			"2007-03-12T17:00:00Z to 2007-03-12T18:00:00Z\n1 1.1.1.1\n" {
+		t.Errorf("windows got\n%s", got)
+	}
+
+	// W3C logs name their fields in a directive, which may come again later
+	w3c := "#Software: Microsoft Internet Information Services 10.0\r\n" +
+		"#Fields: date time s-ip cs-method cs-uri-stem cs-uri-query c-ip cs(User-Agent) sc-status time-taken\r\n" +
+		"2024-01-02 03:04:05 10.0.0.1 GET /a - 1.1.1.1 curl 200 15\r\n" +
+		"2024-01-02 03:14:05 10.0.0.1 GET /b x=1 2.2.2.2 Mozilla/5.0+(X11) 404 5\r\n" +
+		"2024-01-02 03:24:05 10.0.0.1 GET /a - 1.1.1.1 curl 200 0\r\n" +
+		"#Date: 2024-01-02 04:00:00\r\n" +
+		"2024-01-02 04:04:05 10.0.0.1 POST /a - 1.1.1.1 curl 200 30\r\n"
+	if got := runBoth(t, w3c, "--format", "w3c", "-f", "path,status", "--sum", "time-taken"); got !=
+		"45 /a 200\n5 /b 404\n" {
+		t.Errorf("w3c got\n%s", got)
+	}
+	if got := runBoth(t, w3c, "--format", "w3c", "-f", "ua", "--window", "1h"); got !=
+		"2024-01-02T03:00:00Z to 2024-01-02T04:00:00Z\n2 curl\n1 Mozilla/5.0+(X11)\n\n"+
+			"2024-01-02T04:00:00Z to 2024-01-02T05:00:00Z\n1 curl\n" {
+		t.Errorf("w3c windows got\n%s", got)
+	}
+
+	config, err := Configure([]string{"--format", "w3c", "-f", "ip", "--on-error", "skip"})
+	if err != nil {
+		t.Fatal("configure: " + err.Error())
+	}
+	_, stats, err := config.run(context.Background(), strings.NewReader(w3c))
+	if err != nil || stats.Records != 4 || stats.Counted != 4 {
+		t.Errorf("directives got %+v, %v", stats, err)
+	}
+	_, stats, err = config.run(context.Background(), strings.NewReader("1 2 3\n"))
+	if err != nil || stats.KeyErrors != 1 {
+		t.Errorf("no directive got %+v, %v", stats, err)
+	}
+	config, _ = Configure([]string{"--format", "w3c", "-f", "cs-bytes"})
+	if _, _, err = config.run(context.Background(), strings.NewReader(w3c)); err == nil ||
+		!strings.Contains(err.Error(), "no field named \"cs-bytes\"") {
+		t.Errorf("missing w3c field got %v", err)
+	}
+}
+
+func TestW3CFieldsChange(t *testing.T) {
+	saveChunkSize := streamChunkSize
+	defer func() { streamChunkSize = saveChunkSize }()
+	streamChunkSize = 100
+
+	// the second #Fields moves the fields around, and is well past the first of the segments the file's
+	//  divided into
+	w3c := "#Fields: cs-method cs-uri-stem sc-status\n" + strings.Repeat("GET /a 200\n", 1000) +
+		"#Fields: sc-status cs-uri-stem cs-method\n" + strings.Repeat("404 /b GET\n", 900)
+	if got := runBoth(t, w3c, "--format", "w3c", "-f", "path,status"); got != "1000 /a 200\n900 /b 404\n" {
+		t.Errorf("got\n%s", got)
+	}
+	if got, _ := runSorted(t, strings.NewReader(w3c), "--format", "w3c", "-f", "path,status", "-w", "4"); got !=
+		"\n1000 /a 200\n900 /b 404" {
+		t.Errorf("in parallel got\n%s", got)
+	}
+
+	for input, wanted := range map[string]bool{
+		"GET /a 200\n#Fields: x\n": true, "GET /a 200\n#Software: x\n": false, "GET /a #Fields: x\n": false,
+	} {
+		got, err := laterFieldsDirective(iotest.OneByteReader(strings.NewReader(input)))
+		if err != nil || got != wanted {
+			t.Errorf("%q: got %v, %v", input, got, err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package topfew
+
+// Regular files are memory-mapped when possible, so that their segments are just slices of the mapped region and
+//  records can be handed to the key finder without being copied, and segmenting doesn't need to open and seek
+//  the file again for each segment. Pipes, special files, and anything the OS won't map are read as before.
+
+import (
+	"bytes"
+	"os"
+	"sync/atomic"
+)
+
+// useMmap can be turned off to read regular files the same way as everything else
+var useMmap = true
+
+// mappedFile is a memory-mapped file which is shared by the jobs reading its segments, and unmapped once the
+// last of them is done with it
+type mappedFile struct {
+	data  []byte
+	users atomic.Int32
+}
+
+// mapFile maps fname into memory, or returns nil if it isn't a regular file or can't be mapped, in which case
+// it should be read the usual way
+func mapFile(fname string) *mappedFile {
+	if !useMmap {
+		return nil
+	}
+	file, err := os.Open(fname)
+	if err != nil {
+		return nil
+	}
+	// noinspection ALL
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+		return nil
+	}
+	data, err := mmap(file, info.Size())
+	if err != nil {
+		return nil
+	}
+	return &mappedFile{data: data}
+}
+
+// share says how many jobs will use the mapping; if there are none, it's unmapped right away
+func (m *mappedFile) share(jobs int) {
+	if jobs == 0 {
+		_ = munmap(m.data)
+		return
+	}
+	m.users.Store(int32(jobs))
+}
+
+// release is called by each job when it's done with the mapping
+func (m *mappedFile) release() {
+	if m.users.Add(-1) == 0 {
+		_ = munmap(m.data)
+	}
+}
+
+// segmentEnd is newSegment for a mapped file: it finds the end of the line that end falls in, or for CSV, the
+// end of the record; inQuotes says whether end is inside a quoted field
+func (m *mappedFile) segmentEnd(end int64, csv bool, inQuotes bool) int64 {
+	size := int64(len(m.data))
+	for end < size {
+		lineEnd := size
+		if nl := bytes.IndexByte(m.data[end:], '\n'); nl != -1 {
+			lineEnd = end + int64(nl) + 1
+		}
+		if csv && csvQuoteOpen(m.data[end:lineEnd]) {
+			inQuotes = !inQuotes
+		}
+		end = lineEnd
+		if !inQuotes {
+			break
+		}
+	}
+	if end > size {
+		end = size
+	}
+	return end
+}
@@ -0,0 +1,17 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package topfew
+
+import (
+	"errors"
+	"os"
+)
+
+// mmap isn't available here, so files are always read with the bufio path
+func mmap(_ *os.File, _ int64) ([]byte, error) {
+	return nil, errors.New("memory-mapping not supported")
+}
+
+func munmap(_ []byte) error {
+	return nil
+}
@@ -0,0 +1,171 @@
+package topfew
+
+import (
+	"io"
+	"time"
+)
+
+// Options describes what a topfew run should do. Configure builds one from the command line, and library
+// callers fill one in directly. The zero value counts whole records and reports the 10 most common.
+type Options struct {
+	// Number is how many of the highest-count keys to report; zero means 10.
+	Number int
+
+	// Bottom reports the keys with the lowest counts, in increasing order, as with --bottom; keys with the
+	// same count are in order of the key. It may not be combined with MaxKeys.
+	Bottom bool
+
+	// Percent reports each key's share of all the records, or of the total of the Sum field, as a
+	// percentage, as with --percent.
+	Percent bool
+
+	// Cumulative reports the running total of the shares, down the list, as with --cumulative.
+	Cumulative bool
+
+	// Other adds an "(other)" result to the end of each list, for all the keys that aren't in it, as with
+	// --other.
+	Other bool
+
+	// Fields is a comma-separated list of the fields that make up the key, in that order, as with --fields.
+	// Fields are numbered from one, negative numbers count back from the last field, and 3-6, 5-, and -3--1
+	// are ranges. With JSON, the fields are paths, and with CSV or TSV, or a Format, they may be names.
+	// Empty means the key is the whole record.
+	Fields string
+
+	// FieldSeparator is a regexp that separates fields, as with --fieldseparator. Empty means white space.
+	FieldSeparator string
+
+	// QuotedFields respects "-delimited fields which may contain spaces, as with --quotedfields. It may
+	// not be combined with FieldSeparator.
+	QuotedFields bool
+
+	// Format is the name of a log format, as with --format: "apache-common", "apache-combined", "nginx", "w3c",
+	// or "syslog". The Fields, and other fields like Sum, may then be names such as status and path.
+	Format string
+
+	// Extract is a regexp, as with --extract, whose capture groups' matches in the record, or in the Fields
+	// if there are any, make up the key; if it has named groups, only they are used, and if it has no groups,
+	// the key is the whole match. Records it doesn't match are dealt with as OnError says.
+	Extract string
+
+	// Transform lists pipelines of transforms, as with --transform, like "path=urlpath,lower" or "ipmask:24",
+	// which rewrite a field of the key, or without a field, all of them, before it's counted.
+	Transform []string
+
+	// JSON treats each record as a JSON text, as with --json. Fields then holds paths like request.method or
+	// tags[0] rather than field numbers.
+	JSON bool
+
+	// Missing says what to do with a JSON record that has nothing at one of the Fields paths, as with
+	// --missing: "skip" ignores the record, "null" uses null as the value, and "error" (the default) reports
+	// it as a record the key can't be extracted from.
+	Missing string
+
+	// CSV treats the input as RFC 4180 comma-separated values, as with --csv. Fields may then name columns
+	// from the header record as well as giving their numbers, and may be in any order.
+	CSV bool
+
+	// TSV is like CSV, but the fields are separated by tabs, as with --tsv.
+	TSV bool
+
+	// Header says that the first CSV or TSV record is a header which isn't to be counted, as with --header.
+	// Naming a column in Fields implies Header.
+	Header bool
+
+	// Sum names a field whose numeric value is added up for each key, as with --sum; keys are then ranked by
+	// the total rather than by how many records had them. It's given in the same way as one of the Fields.
+	Sum string
+
+	// NonNumeric says what to do with a record whose Sum field isn't a number, as with --nonnumeric: "zero"
+	// (the default) counts it with a value of zero, "skip" ignores it, and "error" reports it as a record the
+	// key can't be extracted from.
+	NonNumeric string
+
+	// MaxKeys bounds memory use by tracking no more than this many keys, as with --max-keys; counts are then
+	// approximate, and each result says how much it may overstate. Zero means every key is counted exactly.
+	MaxKeys int
+
+	// Time is the field holding each record's timestamp, as with --time; there's then a separate top list for
+	// each Window. It's given in the same way as the Fields, and if it's more than one field, they're joined
+	// with spaces.
+	Time string
+
+	// TimeFormat says how the Time field is written, as with --time-format: "rfc3339" (the default),
+	// "apache" as in [12/Mar/2007:08:04:39 -0800], "unix" seconds, "unixms" milliseconds, "syslog" as in
+	// Mar  1 12:34:56, in the current year, or a Go time layout.
+	TimeFormat string
+
+	// Window is how long the time windows are, as with --window. They're aligned to the Unix epoch, so for
+	// example one-hour windows start on the hour.
+	Window time.Duration
+
+	// Slide makes the windows overlap, as with --slide; a new one starts every Slide, which must divide the
+	// Window evenly. Zero means the windows follow one another without overlapping.
+	Slide time.Duration
+
+	// GroupBy is a field whose values divide the records into groups, as with --group-by, each with its own
+	// top list. It's given in the same way as the Fields.
+	GroupBy string
+
+	// Groups is how many groups to report, as with --groups; they're ranked by how many records they have,
+	// or the total of the Sum field. Zero means all of them.
+	Groups int
+
+	// Distinct is a field whose different values are counted for each key, as with --distinct; keys are then
+	// ranked by how many there are. It's given in the same way as the Fields. Up to 1024 values, the number
+	// is exact, and beyond that, it's estimated to within a few percent.
+	Distinct string
+
+	// Value is a numeric field, as with --value, whose minimum, maximum, mean, total, and percentiles are
+	// reported for each key; values which aren't numbers are left out. It's given in the same way as the
+	// Fields, and may not be combined with MaxKeys.
+	Value string
+
+	// OnError says what to do with records that the key, or another field, can't be extracted from, as with
+	// --on-error: "warn" (the default) reports each on stderr, "skip" leaves them out quietly, and "fail"
+	// stops the run with an error.
+	OnError string
+
+	// MaxWarnings is how many such records "warn" reports, as with --max-warnings; after that, they're only
+	// counted. Zero means all of them.
+	MaxWarnings int
+
+	// Rejects names a file, as with --rejects, which such records are written to, whatever OnError says.
+	Rejects string
+
+	// Warnings is where "warn" reports such records. The command writes them to stderr; nil means they're
+	// discarded.
+	Warnings io.Writer
+
+	// Grep lists regexps which a record must match to be counted, as with --grep.
+	Grep []string
+
+	// Vgrep lists regexps which a record must not match to be counted, as with --vgrep.
+	Vgrep []string
+
+	// Where lists expressions made of predicates on fields, like "status>=500" or "path~^/api/", combined with
+	// and, or, not, and parentheses, which a record must satisfy to be counted, as with --where.
+	Where []string
+
+	// Sed lists the substitutions applied, in order, to the extracted key, as with --sed.
+	Sed []Substitution
+
+	// Include lists globs, as with --include; if there are any, only files found in directories whose names
+	// match one of them are read.
+	Include []string
+
+	// Exclude lists globs, as with --exclude; files found in directories whose names match any of them
+	// aren't read.
+	Exclude []string
+
+	// Width is how many segments files are divided into for parallel processing, and how many are processed
+	// at once, as with --width. Zero means one per CPU.
+	Width int
+}
+
+// Substitution is a sed(1)-style s/ReplaceThis/WithThat/g edit; WithThat may refer to capture groups in
+// ReplaceThis as $1, $2, and so on.
+type Substitution struct {
+	ReplaceThis string
+	WithThat    string
+}
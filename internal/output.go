@@ -0,0 +1,365 @@
+package topfew
+
+// By default the results are printed one per line as the count, a space, and the key, which is fine for
+//  people but ambiguous for programs when keys contain spaces. --output json, csv, and tsv produce properly
+//  escaped results with the count, key, and each of the fields that make up the key, as separately-named
+//  properties or columns. To be able to separate the fields, the keyFinder joins them with fieldJoiner
+//  rather than a space in those formats.
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	outputText = iota
+	outputJSON
+	outputCSV
+	outputTSV
+)
+
+// fieldJoiner is the ASCII Unit Separator, which is very unlikely to turn up in a key
+const fieldJoiner = 0x1f
+
+// parseOutput turns the --output argument into one of the outputXxx constants
+func parseOutput(s string) (int, error) {
+	switch s {
+	case "text":
+		return outputText, nil
+	case "json":
+		return outputJSON, nil
+	case "csv":
+		return outputCSV, nil
+	case "tsv":
+		return outputTSV, nil
+	}
+	return 0, fmt.Errorf("--output must be one of text, json, csv, or tsv, not \"%s\"", s)
+}
+
+// outputFieldNames names the fields in the --fields list for output; numbered fields are called field1,
+// field2, and so on, ranges field3-6 and the like, and JSON paths and CSV column names are used as they are
+func outputFieldNames(spec string) []string {
+	if spec == "" {
+		return nil
+	}
+	var names []string
+	for _, part := range strings.Split(spec, ",") {
+		if _, err := parseFieldRange(part); err == nil {
+			part = "field" + part
+		}
+		names = append(names, part)
+	}
+	return names
+}
+
+// splitsKeys says whether keys are made of separable fields, which only happens with more than one field in
+// one of the machine-readable formats
+func (config *config) splitsKeys() bool {
+	return config.output != outputText && len(config.fieldNames) > 1
+}
+
+// Output writes the results to w in the format chosen with --output. There aren't any results with --sample.
+func Output(config *config, counts []*keyCount, w io.Writer) error {
+	if config.sample {
+		return nil
+	}
+	out := bufio.NewWriter(w)
+	var err error
+	switch config.output {
+	case outputJSON:
+		err = config.writeJSON(counts, out)
+	case outputCSV, outputTSV:
+		err = config.writeCSV(counts, out)
+	default:
+		err = config.writeText(counts, out)
+	}
+	if err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+func formatNumber(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// formatEstimate rounds f to three significant figures, which is as many as the percentiles are good for
+func formatEstimate(f float64) string {
+	return formatRounded(f, 3)
+}
+
+// formatMean rounds f to six significant figures, so that a mean like 100.5952380952381 isn't printed to more
+// places than anyone wants
+func formatMean(f float64) string {
+	return formatRounded(f, 6)
+}
+
+// formatRounded rounds f to the given number of significant figures, without an exponent
+func formatRounded(f float64, figures int) string {
+	rounded, _ := strconv.ParseFloat(strconv.FormatFloat(f, 'g', figures, 64), 64)
+	return formatNumber(rounded)
+}
+
+// valueNames are the names of the --value statistics in the output
+var valueNames = []string{"min", "max", "mean", "total", "p50", "p90", "p99"}
+
+// valueFields formats the --value statistics, in the order of valueNames
+func valueFields(v *ValueStats) []string {
+	return []string{formatNumber(v.Min), formatNumber(v.Max), formatMean(v.Mean), formatNumber(v.Total),
+		formatEstimate(v.P50), formatEstimate(v.P90), formatEstimate(v.P99)}
+}
+
+// formatWindow is how the start and end of windows are printed
+func formatWindow(t time.Time) string {
+	return t.Format(time.RFC3339Nano)
+}
+
+// writeText writes each result on a line, with the percentages, if any, and then the --value statistics as
+// name=value, between the count and the key; the (other) row says how many keys it stands for. With
+// --window, each window's results are preceded by a line
+// giving its start and end, and with --group-by, each group's by a line giving its value and a colon; the
+// lists are separated by blank lines.
+func (config *config) writeText(counts []*keyCount, out *bufio.Writer) error {
+	for i, kc := range counts {
+		newWindow := kc.Window != nil && (i == 0 || !kc.Window.Equal(*counts[i-1].Window))
+		newGroup := kc.Group != nil && (i == 0 || newWindow || *kc.Group != *counts[i-1].Group)
+		if i > 0 && (newWindow || newGroup) {
+			_, _ = out.WriteString("\n")
+		}
+		if newWindow {
+			end := kc.Window.Add(config.window)
+			_, _ = fmt.Fprintf(out, "%s to %s\n", formatWindow(*kc.Window), formatWindow(end))
+		}
+		if newGroup {
+			_, _ = fmt.Fprintf(out, "%s:\n", *kc.Group)
+		}
+		count := strconv.FormatUint(*kc.Count, 10)
+		if kc.Sum != nil {
+			count = formatNumber(*kc.Sum)
+		} else if kc.Distinct != nil {
+			count = strconv.FormatUint(*kc.Distinct, 10)
+		}
+		if kc.Error != nil {
+			count += "±" + formatNumber(*kc.Error)
+		}
+		if kc.Percent != nil {
+			count += " " + formatPercent(*kc.Percent) + "%"
+		}
+		if kc.Cumulative != nil {
+			count += " " + formatPercent(*kc.Cumulative) + "%"
+		}
+		if kc.Values != nil {
+			for j, field := range valueFields(kc.Values) {
+				count += " " + valueNames[j] + "=" + field
+			}
+		}
+		key := kc.Key
+		if kc.Keys != nil {
+			key = fmt.Sprintf("(%d other keys)", *kc.Keys)
+		}
+		if _, err := fmt.Fprintf(out, "%s %s\n", count, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyFields returns the key as it would be printed in text, and its fields if they're to be output. A --sed
+// can add or remove joiners; if there are then too few fields, the last ones are empty, and if there are too
+// many, the last one gets the rest. The (other) row's fields are all empty.
+func (config *config) keyFields(kc *keyCount) (string, []string) {
+	if !config.splitsKeys() {
+		return kc.Key, nil
+	}
+	if kc.Keys != nil {
+		return kc.Key, make([]string, len(config.fieldNames))
+	}
+	fields := strings.SplitN(kc.Key, string(rune(fieldJoiner)), len(config.fieldNames))
+	key := strings.Join(fields, " ")
+	last := len(fields) - 1
+	fields[last] = strings.ReplaceAll(fields[last], string(rune(fieldJoiner)), " ")
+	for len(fields) < len(config.fieldNames) {
+		fields = append(fields, "")
+	}
+	return strings.ReplaceAll(key, string(rune(fieldJoiner)), " "), fields
+}
+
+// writeJSON writes an array of objects, one per line, like
+// {"count":5,"key":"GET 200","fields":{"field6":"GET","field7":"200"}}; with --window, each also has the
+// start of its window as "window", with --group-by, its group as "group", with --percent and --cumulative,
+// "percent" and "cumulative", and with --value, its statistics as a "values" object. The (other) row has
+// "keys", how many keys it stands for.
+func (config *config) writeJSON(counts []*keyCount, out *bufio.Writer) error {
+	_, _ = out.WriteString("[")
+	for i, kc := range counts {
+		if i > 0 {
+			_, _ = out.WriteString(",")
+		}
+		_, _ = out.WriteString("\n{")
+		if kc.Window != nil {
+			_, _ = fmt.Fprintf(out, "\"window\":\"%s\",", formatWindow(*kc.Window))
+		}
+		if kc.Group != nil {
+			_, _ = out.WriteString("\"group\":")
+			if err := writeJSONString(out, *kc.Group); err != nil {
+				return err
+			}
+			_, _ = out.WriteString(",")
+		}
+		_, _ = fmt.Fprintf(out, "\"count\":%d", *kc.Count)
+		if kc.Distinct != nil {
+			_, _ = fmt.Fprintf(out, ",\"distinct\":%d", *kc.Distinct)
+		}
+		if kc.Sum != nil {
+			_, _ = fmt.Fprintf(out, ",\"sum\":%s", formatNumber(*kc.Sum))
+		}
+		if kc.Error != nil {
+			_, _ = fmt.Fprintf(out, ",\"error\":%s", formatNumber(*kc.Error))
+		}
+		if kc.Percent != nil {
+			_, _ = fmt.Fprintf(out, ",\"percent\":%s", formatPercent(*kc.Percent))
+		}
+		if kc.Cumulative != nil {
+			_, _ = fmt.Fprintf(out, ",\"cumulative\":%s", formatPercent(*kc.Cumulative))
+		}
+		if kc.Values != nil {
+			_, _ = fmt.Fprintf(out, ",\"values\":{\"n\":%d", kc.Values.N)
+			for j, field := range valueFields(kc.Values) {
+				_, _ = fmt.Fprintf(out, ",\"%s\":%s", valueNames[j], field)
+			}
+			_, _ = out.WriteString("}")
+		}
+		if kc.Keys != nil {
+			_, _ = fmt.Fprintf(out, ",\"keys\":%d", *kc.Keys)
+		}
+		key, fields := config.keyFields(kc)
+		_, _ = out.WriteString(",\"key\":")
+		if err := writeJSONString(out, key); err != nil {
+			return err
+		}
+		if fields != nil {
+			_, _ = out.WriteString(",\"fields\":{")
+			for j, field := range fields {
+				if j > 0 {
+					_, _ = out.WriteString(",")
+				}
+				_ = writeJSONString(out, config.fieldNames[j])
+				_, _ = out.WriteString(":")
+				if err := writeJSONString(out, field); err != nil {
+					return err
+				}
+			}
+			_, _ = out.WriteString("}")
+		}
+		_, _ = out.WriteString("}")
+	}
+	_, err := out.WriteString("\n]\n")
+	return err
+}
+
+func writeJSONString(out *bufio.Writer, s string) error {
+	encoded, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(encoded)
+	return err
+}
+
+// writeCSV writes a header row and then a row per result, with columns for the window start and group if
+// there are any, the count, the distinct count, sum, error, percentages, --value statistics, and the (other)
+// row's number of keys if there are any, the key, and then the fields
+func (config *config) writeCSV(counts []*keyCount, out *bufio.Writer) error {
+	writer := csv.NewWriter(out)
+	if config.output == outputTSV {
+		writer.Comma = '\t'
+	}
+	var header []string
+	if config.window > 0 {
+		header = append(header, "window")
+	}
+	if config.groupBy != nil {
+		header = append(header, "group")
+	}
+	header = append(header, "count")
+	if config.distinct != nil {
+		header = append(header, "distinct")
+	}
+	if config.sum {
+		header = append(header, "sum")
+	}
+	if config.maxKeys > 0 {
+		header = append(header, "error")
+	}
+	if config.percent {
+		header = append(header, "percent")
+	}
+	if config.cumulative {
+		header = append(header, "cumulative")
+	}
+	if config.value != nil {
+		header = append(append(header, "n"), valueNames...)
+	}
+	if config.other {
+		header = append(header, "keys")
+	}
+	header = append(header, "key")
+	if config.splitsKeys() {
+		header = append(header, config.fieldNames...)
+	}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+
+	for _, kc := range counts {
+		var row []string
+		if kc.Window != nil {
+			row = append(row, formatWindow(*kc.Window))
+		}
+		if kc.Group != nil {
+			row = append(row, *kc.Group)
+		}
+		row = append(row, strconv.FormatUint(*kc.Count, 10))
+		if kc.Distinct != nil {
+			row = append(row, strconv.FormatUint(*kc.Distinct, 10))
+		}
+		if kc.Sum != nil {
+			row = append(row, formatNumber(*kc.Sum))
+		}
+		if kc.Error != nil {
+			row = append(row, formatNumber(*kc.Error))
+		} else if config.maxKeys > 0 {
+			row = append(row, "")
+		}
+		if kc.Percent != nil {
+			row = append(row, formatPercent(*kc.Percent))
+		}
+		if kc.Cumulative != nil {
+			row = append(row, formatPercent(*kc.Cumulative))
+		}
+		if kc.Values != nil {
+			row = append(append(row, strconv.FormatUint(kc.Values.N, 10)), valueFields(kc.Values)...)
+		} else if config.value != nil {
+			row = append(row, make([]string, len(valueNames)+1)...)
+		}
+		if kc.Keys != nil {
+			row = append(row, strconv.FormatUint(*kc.Keys, 10))
+		} else if config.other {
+			row = append(row, "")
+		}
+		key, fields := config.keyFields(kc)
+		row = append(row, key)
+		row = append(row, fields...)
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,125 @@
+package topfew
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func runOutput(t *testing.T, input string, args ...string) string {
+	t.Helper()
+	c, err := Configure(args)
+	if err != nil {
+		t.Fatal("config: " + err.Error())
+	}
+	counts, err := Run(c, strings.NewReader(input))
+	if err != nil {
+		t.Fatal("Run: " + err.Error())
+	}
+	var out bytes.Buffer
+	if err = Output(c, counts, &out); err != nil {
+		t.Fatal("Output: " + err.Error())
+	}
+	return out.String()
+}
+
+func TestOutputText(t *testing.T) {
+	input := "a b\na b\nc d\n"
+	if out := runOutput(t, input, "-f", "1,2"); out != "2 a b\n1 c d\n" {
+		t.Errorf("text output is %q", out)
+	}
+	if out := runOutput(t, input, "-f", "1,2", "--output", "text"); out != "2 a b\n1 c d\n" {
+		t.Errorf("--output text is %q", out)
+	}
+	if out := runOutput(t, "a 1.5\na 2\n", "-f", "1", "--sum", "2", "--max-keys", "10"); out != "3.5±0 a\n" {
+		t.Errorf("text output with sum and error is %q", out)
+	}
+}
+
+func TestOutputJSON(t *testing.T) {
+	// the key fields have spaces, quotes, and backslashes in them
+	input := `{"m": "GET", "p": "/a b\"c\\"}` + "\n" + `{"m": "GET", "p": "/a b\"c\\"}` + "\n" + `{"m": "PUT", "p": "/"}` + "\n"
+	out := runOutput(t, input, "-j", "-f", "m,p", "--output", "json")
+	type result struct {
+		Count  uint64
+		Sum    *float64
+		Key    string
+		Fields map[string]string
+	}
+	var results []result
+	if err := json.Unmarshal([]byte(out), &results); err != nil {
+		t.Fatalf("bad JSON output %s: %s", out, err.Error())
+	}
+	if len(results) != 2 || results[0].Count != 2 || results[0].Key != `GET /a b"c\` || results[0].Sum != nil ||
+		results[0].Fields["m"] != "GET" || results[0].Fields["p"] != `/a b"c\` || results[1].Fields["p"] != "/" {
+		t.Errorf("JSON results are %v", results)
+	}
+
+	// a single field isn't broken out
+	out = runOutput(t, "a 1\nb x\n", "-f", "1", "--sum", "2", "--output", "json")
+	if out != "[\n{\"count\":1,\"sum\":1,\"key\":\"a\"},\n{\"count\":1,\"sum\":0,\"key\":\"b\"}\n]\n" {
+		t.Errorf("JSON output is %q", out)
+	}
+	if out = runOutput(t, "", "--output", "json"); out != "[\n]\n" {
+		t.Errorf("empty JSON output is %q", out)
+	}
+}
+
+func TestOutputCSV(t *testing.T) {
+	input := "ip,agent,status\n1.2.3.4,\"Mozilla, \"\"like\"\" Gecko\",200\n1.2.3.4,\"Mozilla, \"\"like\"\" Gecko\",200\n" +
+		"5.6.7.8,\"curl\tx\",404\n"
+	for _, format := range []string{"csv", "tsv"} {
+		out := runOutput(t, input, "--csv", "-f", "agent,3", "--output", format)
+		reader := csv.NewReader(strings.NewReader(out))
+		if format == "tsv" {
+			reader.Comma = '\t'
+		}
+		rows, err := reader.ReadAll()
+		if err != nil {
+			t.Fatalf("%s: bad output %s: %s", format, out, err.Error())
+		}
+		wanted := [][]string{
+			{"count", "key", "agent", "field3"},
+			{"2", `Mozilla, "like" Gecko 200`, `Mozilla, "like" Gecko`, "200"},
+			{"1", "curl\tx 404", "curl\tx", "404"},
+		}
+		if len(rows) != len(wanted) {
+			t.Fatalf("%s: got %d rows wanted %d", format, len(rows), len(wanted))
+		}
+		for i, row := range rows {
+			if strings.Join(row, "|") != strings.Join(wanted[i], "|") {
+				t.Errorf("%s: row %d is %q wanted %q", format, i, row, wanted[i])
+			}
+		}
+	}
+
+	out := runOutput(t, "a 3\n", "-f", "1", "--sum", "2", "--max-keys", "10", "--output", "csv")
+	if out != "count,sum,error,key\n1,3,0,a\n" {
+		t.Errorf("CSV with sum and error is %q", out)
+	}
+}
+
+func TestOutputSed(t *testing.T) {
+	// the same --sed applies whatever the output format, but it sees a different separator between fields,
+	// which . matches just as it matches a space
+	input := "GET /a?x=1 200\nGET /a?y=2 200\n"
+	args := []string{"-f", "2,3", "-s", `\?.*$`, ""}
+	if out := runOutput(t, input, args...); out != "2 /a\n" {
+		t.Errorf("text output with sed is %q", out)
+	}
+	out := runOutput(t, input, append(args, "--output", "csv")...)
+	if out != "count,key,field2,field3\n2,/a,/a,\n" {
+		t.Errorf("CSV output with sed is %q", out)
+	}
+	out = runOutput(t, input, "-f", "2,3", "-s", `\?[^\x1f]*`, "", "--output", "csv")
+	if out != "count,key,field2,field3\n2,/a 200,/a,200\n" {
+		t.Errorf("CSV output with field-bounded sed is %q", out)
+	}
+	out = runOutput(t, input+"GET /a?x=1 200\n", "-f", "2,3", "-s", "=", "\x1f", "--output", "json")
+	if out != "[\n{\"count\":2,\"key\":\"/a?x 1 200\",\"fields\":{\"field2\":\"/a?x\",\"field3\":\"1 200\"}},\n"+
+		"{\"count\":1,\"key\":\"/a?y 2 200\",\"fields\":{\"field2\":\"/a?y\",\"field3\":\"2 200\"}}\n]\n" {
+		t.Errorf("JSON output with extra joiner is %q", out)
+	}
+}
@@ -0,0 +1,207 @@
+package topfew
+
+// With --window or --group-by, the records are partitioned, and there's a top list for each partition: each
+//  time window, each group, or each group in each window. Rather than keep a counter for each partition,
+//  which would complicate everything that counts keys, in parallel segments or not, each key is prefixed
+//  with its partition: the start of its time pane as 8 bytes, then the group's length as a varint and the
+//  group itself. The usual machinery counts the prefixed keys, and at the end they're sorted out into
+//  partitions. This means all the keys have to be counted exactly, so it doesn't work with --max-keys.
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+)
+
+// paneLength is the number of bytes of pane start time at the front of each key
+const paneLength = 8
+
+// paneCounts holds the counts by pane start, then group, then key
+type paneCounts map[int64]map[string]map[string]*tally
+
+// groupGetter gets the value of the --group-by field
+type groupGetter struct {
+	field *keyFinder
+}
+
+func (g *groupGetter) get(record []byte, fields *recordFields) error {
+	group, err := g.field.getKey(record)
+	fields.group, fields.hasGroup = group, true
+	return err
+}
+
+func (g *groupGetter) finders() []*keyFinder {
+	return []*keyFinder{g.field}
+}
+
+func (g *groupGetter) clone() fieldGetter {
+	return &groupGetter{field: g.field.clone()}
+}
+
+// partitionKey returns the key prefixed with its partition, if the records are partitioned by time or group
+func (kf *keyFinder) partitionKey(fields *recordFields, key []byte) []byte {
+	if !fields.hasPane && !fields.hasGroup {
+		return key
+	}
+	kf.partitioned = kf.partitioned[:0]
+	if fields.hasPane {
+		kf.partitioned = binary.BigEndian.AppendUint64(kf.partitioned, uint64(fields.pane))
+	}
+	if fields.hasGroup {
+		kf.partitioned = binary.AppendUvarint(kf.partitioned, uint64(len(fields.group)))
+		kf.partitioned = append(kf.partitioned, fields.group...)
+	}
+	kf.partitioned = append(kf.partitioned, key...)
+	return kf.partitioned
+}
+
+// splitPartition takes a key made by partitionKey apart
+func (config *config) splitPartition(key string) (int64, string, string) {
+	var pane int64
+	if config.window > 0 {
+		pane = int64(binary.BigEndian.Uint64([]byte(key[:paneLength])))
+		key = key[paneLength:]
+	}
+	var group string
+	if config.groupBy != nil {
+		prefix := key
+		if len(prefix) > binary.MaxVarintLen64 {
+			prefix = prefix[:binary.MaxVarintLen64]
+		}
+		length, n := binary.Uvarint([]byte(prefix))
+		group = key[n : n+int(length)]
+		key = key[n+int(length):]
+	}
+	return pane, group, key
+}
+
+// results returns the counter's top list, or if the records are partitioned, a top list for each partition
+func (config *config) results(counter *counter) []*keyCount {
+	if config.window > 0 || config.groupBy != nil {
+		return config.partitionTops(counter)
+	}
+	return config.shares(counter, counter.getTop())
+}
+
+// partitionTops sorts the counts out into panes and groups, then returns the top lists in order of window
+// and then group, each result labeled with its window start and group
+func (config *config) partitionTops(counter *counter) []*keyCount {
+	panes := make(paneCounts)
+	for key, count := range counter.counts {
+		start, group, key := config.splitPartition(key)
+		groups, ok := panes[start]
+		if !ok {
+			groups = make(map[string]map[string]*tally)
+			panes[start] = groups
+		}
+		keys, ok := groups[group]
+		if !ok {
+			keys = make(map[string]*tally)
+			groups[group] = keys
+		}
+		keys[key] = count
+	}
+
+	var topList []*keyCount
+	for _, start := range config.windowStarts(panes) {
+		windowStart := time.Unix(0, start).UTC()
+		groups := config.windowGroups(panes, start)
+		for _, group := range rankGroups(groups, config.groups, config.sum) {
+			groupCounter := config.newCounter()
+			groupCounter.merge(groups[group])
+			group := group
+			for _, kc := range config.shares(groupCounter, groupCounter.getTop()) {
+				if config.window > 0 {
+					kc.Window = &windowStart
+				}
+				if config.groupBy != nil {
+					kc.Group = &group
+				}
+				topList = append(topList, kc)
+			}
+		}
+	}
+	return topList
+}
+
+// paneStep is the length of a pane, and panesPerWindow how many make up a window; without --window, there's
+// a single pane
+func (config *config) paneStep() (int64, int64) {
+	switch {
+	case config.window == 0:
+		return 1, 1
+	case config.slide == 0:
+		return int64(config.window), 1
+	}
+	return int64(config.slide), int64(config.window / config.slide)
+}
+
+// windowStarts returns, in order, the starts of the windows that contain any of the panes. Windows start at
+// multiples of the slide.
+func (config *config) windowStarts(panes paneCounts) []int64 {
+	step, panesPerWindow := config.paneStep()
+	startSet := make(map[int64]bool)
+	for start := range panes {
+		for i := int64(0); i < panesPerWindow; i++ {
+			startSet[start-i*step] = true
+		}
+	}
+	starts := make([]int64, 0, len(startSet))
+	for start := range startSet {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	return starts
+}
+
+// windowGroups adds up the counts for each group in the panes that make up the window starting at start.
+// The tallies are copied because merge takes over the ones it's given, and panes can be in more than one
+// window.
+func (config *config) windowGroups(panes paneCounts, start int64) map[string]segmentCounter {
+	step, panesPerWindow := config.paneStep()
+	groups := make(map[string]segmentCounter)
+	for i := int64(0); i < panesPerWindow; i++ {
+		for group, keys := range panes[start+i*step] {
+			segCounter, ok := groups[group]
+			if !ok {
+				segCounter = newSegmentCounter()
+				groups[group] = segCounter
+			}
+			for key, count := range keys {
+				segCounter.total.count += count.count
+				segCounter.total.sum += count.sum
+				total, ok := segCounter.counts[key]
+				if !ok {
+					segCounter.counts[key] = count.clone()
+				} else {
+					total.add(count)
+				}
+			}
+		}
+	}
+	return groups
+}
+
+// rankGroups orders the groups by the total of their counts, or sums if the records are weighted, and
+// returns the first limit of them, or all of them if limit is zero
+func rankGroups(groups map[string]segmentCounter, limit int, weighted bool) []string {
+	totals := make(map[string]float64, len(groups))
+	names := make([]string, 0, len(groups))
+	for group, segCounter := range groups {
+		totals[group] = float64(segCounter.total.count)
+		if weighted {
+			totals[group] = segCounter.total.sum
+		}
+		names = append(names, group)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if totals[names[i]] != totals[names[j]] {
+			return totals[names[i]] > totals[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	if limit > 0 && len(names) > limit {
+		names = names[:limit]
+	}
+	return names
+}
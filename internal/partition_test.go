@@ -0,0 +1,82 @@
+package topfew
+
+import (
+	"testing"
+)
+
+func TestPartitionKeys(t *testing.T) {
+	config, err := Configure([]string{"-f", "3", "--group-by", "2", "--time", "1", "--time-format", "unix",
+		"--window", "1m"})
+	if err != nil {
+		t.Fatal("configure: " + err.Error())
+	}
+	kf := config.newKeyFinder()
+	long := make([]byte, 300)
+	for i := range long {
+		long[i] = 'g'
+	}
+	groups := [][]byte{nil, []byte("g"), long}
+	for _, pane := range []int64{0, -60e9, 1173686640e9} {
+		for _, group := range groups {
+			fields := recordFields{pane: pane, hasPane: true, group: group, hasGroup: true}
+			key := string(kf.partitionKey(&fields, []byte("a key")))
+			gotPane, gotGroup, gotKey := config.splitPartition(key)
+			if gotPane != pane || gotGroup != string(group) || gotKey != "a key" {
+				t.Errorf("pane %d group %d bytes: got %d, %d bytes, %s", pane, len(group), gotPane,
+					len(gotGroup), gotKey)
+			}
+		}
+	}
+}
+
+func TestGroupBy(t *testing.T) {
+	records := `a.com /x 10
+b.com /y 1
+a.com /x 10
+c.com /z 1
+b.com /y 1
+a.com /y 10
+b.com /x 1
+c.com /z 1
+b.com /y 1
+b.com
+`
+	got := runBoth(t, records, "-f", "2", "-n", "1", "--group-by", "1")
+	wanted := "b.com:\n3 /y\n\na.com:\n2 /x\n\nc.com:\n2 /z\n"
+	if got != wanted {
+		t.Errorf("group-by got\n%s", got)
+	}
+
+	// ranked by the sum rather than the count
+	got = runBoth(t, records, "-f", "2", "--group-by", "1", "--sum", "3", "--groups", "1")
+	wanted = "a.com:\n20 /x\n10 /y\n"
+	if got != wanted {
+		t.Errorf("group-by with sum got\n%s", got)
+	}
+
+	got = runBoth(t, records, "-f", "2", "-n", "1", "--group-by", "1", "--groups", "2", "--output", "json")
+	wanted = "[\n{\"group\":\"b.com\",\"count\":3,\"key\":\"/y\"},\n{\"group\":\"a.com\",\"count\":2,\"key\":\"/x\"}\n]\n"
+	if got != wanted {
+		t.Errorf("group-by JSON got\n%s", got)
+	}
+
+	csvRecords := "when,host,path\n" +
+		"2007-03-12T08:04:39Z,a,/x\n2007-03-12T08:04:40Z,b,/y\n2007-03-12T08:04:41Z,b,/y\n" +
+		"2007-03-12T08:05:00Z,a,/x\n2007-03-12T08:05:01Z,a,/z\n2007-03-12T08:05:02Z,a,/z\n"
+	got = runBoth(t, csvRecords, "--csv", "-f", "path", "--group-by", "host", "--time", "when", "--window", "1m",
+		"--output", "csv")
+	wanted = "window,group,count,key\n" +
+		"2007-03-12T08:04:00Z,b,2,/y\n2007-03-12T08:04:00Z,a,1,/x\n" +
+		"2007-03-12T08:05:00Z,a,2,/z\n2007-03-12T08:05:00Z,a,1,/x\n"
+	if got != wanted {
+		t.Errorf("group-by with windows got\n%s", got)
+	}
+
+	got = runBoth(t, csvRecords, "--csv", "-f", "path", "-n", "1", "--group-by", "host", "--time", "when",
+		"--window", "1m")
+	wanted = "2007-03-12T08:04:00Z to 2007-03-12T08:05:00Z\nb:\n2 /y\n\na:\n1 /x\n\n" +
+		"2007-03-12T08:05:00Z to 2007-03-12T08:06:00Z\na:\n2 /z\n"
+	if got != wanted {
+		t.Errorf("group-by text with windows got\n%s", got)
+	}
+}
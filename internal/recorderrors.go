@@ -0,0 +1,142 @@
+package topfew
+
+// Records that the key, or one of the other fields, can't be extracted from are dealt with as --on-error
+//  says: "warn", the default, reports each of them on stderr, or for library callers, to Options.Warnings, or
+//  only the first --max-warnings of them if that's set; "skip" quietly leaves them out, and "fail" stops the
+//  run with an error. Whichever it is, with --rejects, they're written to a file so they can be looked at
+//  later, in the order they were read within each segment, but not necessarily overall. All the segments
+//  share one recordErrors, so it's locked.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	onErrorWarn = iota
+	onErrorSkip
+	onErrorFail
+)
+
+// parseOnError turns the --on-error argument into one of the onErrorXxx constants
+func parseOnError(s string) (int, error) {
+	switch s {
+	case "", "warn":
+		return onErrorWarn, nil
+	case "skip":
+		return onErrorSkip, nil
+	case "fail":
+		return onErrorFail, nil
+	}
+	return 0, fmt.Errorf("--on-error must be one of skip, warn, or fail, not \"%s\"", s)
+}
+
+// recordErrors applies the --on-error policy; suppressed is how many warnings weren't printed because of
+// --max-warnings, and writeErr is the first error writing the --rejects file
+type recordErrors struct {
+	policy      int
+	maxWarnings int
+	warnings    int
+	suppressed  int
+	out         io.Writer
+	file        *os.File
+	rejects     *bufio.Writer
+	writeErr    error
+	lock        sync.Mutex
+}
+
+// newRecordErrors makes the recordErrors for a run, creating the --rejects file if there is one
+func (config *config) newRecordErrors() (*recordErrors, error) {
+	r := &recordErrors{policy: config.onError, maxWarnings: config.maxWarnings, out: config.warnings}
+	if config.rejects != "" {
+		file, err := os.Create(config.rejects)
+		if err != nil {
+			return nil, err
+		}
+		r.file = file
+		r.rejects = bufio.NewWriter(file)
+	}
+	return r, nil
+}
+
+// handle deals with a record whose key can't be extracted, returning an error if the run should stop. A nil
+// recordErrors, which only keyFinders made outside a run have, leaves the record out quietly.
+func (r *recordErrors) handle(record []byte, err error) error {
+	if r == nil {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.reject(record)
+	switch r.policy {
+	case onErrorFail:
+		return fmt.Errorf("can't extract key from %s: %w", bytes.TrimRight(record, "\r\n"), err)
+	case onErrorWarn:
+		if r.maxWarnings > 0 && r.warnings >= r.maxWarnings {
+			r.suppressed++
+			return nil
+		}
+		r.warnings++
+		_, _ = fmt.Fprintf(r.out, "Can't extract Key from %s\n", string(record))
+	}
+	return nil
+}
+
+// reject writes the record to the --rejects file, if there is one; the caller must hold the lock
+func (r *recordErrors) reject(record []byte) {
+	if r.rejects == nil || r.writeErr != nil {
+		return
+	}
+	_, r.writeErr = r.rejects.Write(record)
+	if r.writeErr == nil && (len(record) == 0 || record[len(record)-1] != '\n') {
+		r.writeErr = r.rejects.WriteByte('\n')
+	}
+}
+
+// sampled deals with a record whose key can't be extracted when it's being run through --sample, which
+// prints its own report of it, so there's no warning
+func (r *recordErrors) sampled(record []byte, err error) error {
+	if r == nil {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.reject(record)
+	if r.policy == onErrorFail {
+		return err
+	}
+	return nil
+}
+
+// close says how many warnings weren't printed, if any, and finishes off the --rejects file. It can be called
+// more than once.
+func (r *recordErrors) close() error {
+	if r == nil {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.suppressed > 0 {
+		_, _ = fmt.Fprintf(r.out, "... and %d more records the key can't be extracted from\n", r.suppressed)
+		r.suppressed = 0
+	}
+	if r.file == nil {
+		return nil
+	}
+	err := r.writeErr
+	if err == nil {
+		err = r.rejects.Flush()
+	}
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	r.file = nil
+	if err != nil {
+		return fmt.Errorf("can't write rejects file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package topfew
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestRecordErrorsPolicies(t *testing.T) {
+	records := [][]byte{[]byte("a\n"), []byte("b\n"), []byte("c\n")}
+	problem := errors.New("no key")
+
+	out := &bytes.Buffer{}
+	warn := &recordErrors{policy: onErrorWarn, maxWarnings: 2, out: out}
+	for _, record := range records {
+		if err := warn.handle(record, problem); err != nil {
+			t.Error("warn: " + err.Error())
+		}
+	}
+	if err := warn.close(); err != nil {
+		t.Error("close: " + err.Error())
+	}
+	wanted := "Can't extract Key from a\n\nCan't extract Key from b\n\n" +
+		"... and 1 more records the key can't be extracted from\n"
+	if out.String() != wanted {
+		t.Errorf("warnings %q", out.String())
+	}
+
+	out.Reset()
+	skip := &recordErrors{policy: onErrorSkip, out: out}
+	for _, record := range records {
+		if err := skip.handle(record, problem); err != nil {
+			t.Error("skip: " + err.Error())
+		}
+	}
+	if out.Len() != 0 {
+		t.Errorf("skip printed %q", out.String())
+	}
+
+	fail := &recordErrors{policy: onErrorFail, out: out}
+	err := fail.handle(records[0], problem)
+	if err == nil || !errors.Is(err, problem) || err.Error() != "can't extract key from a: no key" {
+		t.Errorf("fail got %v", err)
+	}
+
+	// an unterminated record gets a newline in the rejects file
+	config := &config{onError: onErrorSkip, rejects: filepath.Join(t.TempDir(), "rejects")}
+	rejects, err := config.newRecordErrors()
+	if err != nil {
+		t.Fatal("newRecordErrors: " + err.Error())
+	}
+	_ = rejects.handle([]byte("x\n"), problem)
+	_ = rejects.handle([]byte("y"), problem)
+	if err = rejects.close(); err != nil {
+		t.Error("close: " + err.Error())
+	}
+	if err = rejects.close(); err != nil {
+		t.Error("second close: " + err.Error())
+	}
+	var unset *recordErrors
+	if err = unset.close(); err != nil {
+		t.Error("nil close: " + err.Error())
+	}
+	written, err := os.ReadFile(config.rejects)
+	if err != nil || string(written) != "x\ny\n" {
+		t.Errorf("rejects %q, %v", string(written), err)
+	}
+}
+
+func TestOnError(t *testing.T) {
+	dir := t.TempDir()
+	records := "a 1\nb\nc 2\nd\ne 3\nf\n"
+	fname := filepath.Join(dir, "records")
+	if err := os.WriteFile(fname, []byte(records), 0o644); err != nil {
+		t.Fatal("write: " + err.Error())
+	}
+	rejects := filepath.Join(dir, "rejects")
+
+	for _, fnames := range [][]string{nil, {fname}} {
+		config, err := Configure([]string{"-f", "2", "--on-error", "skip", "--rejects", rejects, "-w", "3"})
+		if err != nil {
+			t.Fatal("configure: " + err.Error())
+		}
+		config.fnames = fnames
+		counts, stats, err := config.run(context.Background(), strings.NewReader(records))
+		if err != nil {
+			t.Fatal("run: " + err.Error())
+		}
+		if len(counts) != 3 || stats.KeyErrors != 3 {
+			t.Errorf("%v: %d counts, %d key errors", fnames, len(counts), stats.KeyErrors)
+		}
+		// the segments can be read in any order
+		written, err := os.ReadFile(rejects)
+		if err != nil {
+			t.Fatal("read rejects: " + err.Error())
+		}
+		lines := strings.Split(strings.TrimSuffix(string(written), "\n"), "\n")
+		sort.Strings(lines)
+		if strings.Join(lines, ",") != "b,d,f" {
+			t.Errorf("%v: rejects %q", fnames, string(written))
+		}
+
+		config, err = Configure([]string{"-f", "2", "--on-error", "fail", "-w", "3"})
+		if err != nil {
+			t.Fatal("configure: " + err.Error())
+		}
+		config.fnames = fnames
+		if _, _, err = config.run(context.Background(), strings.NewReader(records)); err == nil ||
+			!strings.HasPrefix(err.Error(), "can't extract key from ") {
+			t.Errorf("%v: fail got %v", fnames, err)
+		}
+	}
+
+	// --sample reports the records, and only stops if it's to fail, or if there's no --on-error
+	saveStdout := os.Stdout
+	defer func() { os.Stdout = saveStdout }()
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal("open: " + err.Error())
+	}
+	defer func() { _ = devNull.Close() }()
+	os.Stdout = devNull
+	for _, policy := range []string{"", "skip", "warn", "fail"} {
+		args := []string{"--sample", "-f", "2"}
+		if policy != "" {
+			args = append(args, "--on-error", policy)
+		}
+		config, err := Configure(args)
+		if err != nil {
+			t.Fatal("configure: " + err.Error())
+		}
+		_, _, err = config.run(context.Background(), strings.NewReader(records))
+		if (err != nil) != (policy == "fail" || policy == "") {
+			t.Errorf("sample with %s got %v", policy, err)
+		}
+	}
+
+	config, err := Configure([]string{"--rejects", filepath.Join(dir, "no", "such", "dir")})
+	if err != nil {
+		t.Fatal("configure: " + err.Error())
+	}
+	if _, _, err = config.run(context.Background(), strings.NewReader(records)); err == nil {
+		t.Error("no error creating rejects file in missing directory")
+	}
+}
@@ -1,39 +1,201 @@
 package topfew
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
+	"time"
 )
 
+// Run is the command-line entry point; it reports problems on the config's warnings writer, which Configure
+// makes stderr, as well as returning them, and with --stats, the statistics too.
 func Run(config *config, instream io.Reader) ([]*keyCount, error) {
 	// lifted out of main.go to facilitate testing
-	var kf = newKeyFinder(config.fields, config.fieldSeparator, config.quotedFields)
-	var topList []*keyCount
-	var err error
+	topList, stats, err := config.run(context.Background(), instream)
+	if err == nil && config.stats && stats != nil {
+		_ = config.writeStats(stats, config.warnings)
+	}
+	if err != nil {
+		switch len(config.fnames) {
+		case 0:
+			_, _ = fmt.Fprintf(config.warnings, "Error reading stream: %s\n", err.Error())
+		case 1:
+			_, _ = fmt.Fprintf(config.warnings, "Error processing %s: %s\n", config.fnames[0], err.Error())
+		default:
+			_, _ = fmt.Fprintf(config.warnings, "Error processing files: %s\n", err.Error())
+		}
+	}
+	return topList, err
+}
+
+// RunOptions is the entry point for library callers. If there are no fnames, records are read from instream,
+// otherwise the named files and directories are processed in parallel segments. It stops early and returns
+// ctx.Err() if ctx is cancelled. Along with the results, it returns statistics about the run.
+func RunOptions(ctx context.Context, opts *Options, fnames []string, instream io.Reader) ([]*keyCount, *Stats,
+	error) {
+	config, err := newConfig(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	config.fnames = fnames
+	return config.run(ctx, instream)
+}
+
+// run returns the results and the statistics; there aren't either with --sample
+func (config *config) run(ctx context.Context, instream io.Reader) ([]*keyCount, *Stats, error) {
+	if config.follow {
+		return config.runFollow(ctx, instream, os.Stdout)
+	}
+	began := time.Now()
+	kf, err := config.newRunKeyFinder()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() { _ = kf.onError.close() }()
 
-	if config.Fname == "" {
+	if len(config.fnames) == 0 {
+		instream, err := decompressStream(instream)
+		if err != nil {
+			return nil, nil, err
+		}
 		if config.sample {
 			for i, sed := range config.filter.seds {
 				fmt.Printf("SED %d: s/%s/%s/\n", i, sed.ReplaceThis, sed.WithThat)
 			}
-			err = sample(instream, &config.filter, kf)
-		} else {
-			topList, err = fromStream(instream, &config.filter, kf, config.size)
+			if err = sample(instream, &config.filter, kf); err != nil {
+				return nil, nil, err
+			}
+			return nil, nil, kf.onError.close()
 		}
-		if err != nil {
-			_, _ = fmt.Fprintf(os.Stderr, "Error reading stream: %s\n", err.Error())
-			return nil, err
+		counter := config.newCounter()
+		if err = countStreamInParallel(ctx, instream, &config.filter, kf, counter, config.width); err != nil {
+			return nil, nil, err
+		}
+		if err = kf.onError.close(); err != nil {
+			return nil, nil, err
 		}
+		return config.results(counter), config.finishStats(counter, began), nil
+	}
+
+	files, err := inputFiles(config.fnames, config.include, config.exclude)
+	if err != nil {
+		return nil, nil, err
+	}
+	counter := config.newCounter()
+	err = readFilesInSegments(ctx, files, &config.filter, counter, kf, config.width)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = kf.onError.close(); err != nil {
+		return nil, nil, err
+	}
+	return config.results(counter), config.finishStats(counter, began), nil
+}
+
+// newRunKeyFinder makes the keyFinder for a run, which deals with records it can't extract keys from as
+// --on-error says; the caller must close its onError
+func (config *config) newRunKeyFinder() (*keyFinder, error) {
+	kf := config.newKeyFinder()
+	onError, err := config.newRecordErrors()
+	if err != nil {
+		return nil, err
+	}
+	kf.onError = onError
+	return kf, nil
+}
+
+// newKeyFinder makes the keyFinder for the configured input format, with others to find the --sum, --time,
+// --group-by, --distinct, and --value fields
+func (config *config) newKeyFinder() *keyFinder {
+	var kf *keyFinder
+	if config.csv != nil {
+		kf = newCSVKeyFinder(config.csv.clone())
+	} else if config.jsonPaths != nil {
+		kf = newJSONKeyFinder(config.jsonPaths, config.missing)
+	} else if config.keyFormat != nil {
+		kf = newFormatKeyFinder(config.keyFormat)
 	} else {
-		counter := newCounter(config.size)
-		err = readFileInSegments(config.Fname, &config.filter, counter, kf, config.width)
-		if err != nil {
-			_, _ = fmt.Fprintf(os.Stderr, "Error processing %s: %s\n", config.Fname, err.Error())
-			return nil, err
+		kf = newRangeKeyFinder(config.fields, config.fieldSeparator, config.quotedFields)
+	}
+	// with --extract, it's the groups, not the fields, that the key is split into, and with --transform, the
+	//  fields are split apart to be transformed, then joined up again
+	joiner := byte(' ')
+	if config.splitsKeys() {
+		joiner = fieldJoiner
+	}
+	if config.transforms != nil {
+		kf.transform = newTransformer(config.transforms, joiner)
+		joiner = fieldJoiner
+	}
+	if config.extract != nil {
+		kf.extract = newExtractor(config.extract, joiner)
+	} else {
+		kf.joiner = joiner
+	}
+	// the --where clauses come first, so that the other fields aren't looked for in records they reject
+	for i, clause := range config.where {
+		kf.getters = append(kf.getters, config.newWhereFinder(clause, i))
+	}
+	if config.sum {
+		weight := &weightGetter{nonNumeric: config.nonNumeric, noNegatives: config.maxKeys > 0}
+		if config.sumCSV != nil {
+			weight.field = newCSVKeyFinder(config.sumCSV.clone())
+		} else if config.sumPath != nil {
+			weight.field = newJSONKeyFinder([][]jsonStep{config.sumPath}, config.missing)
+		} else if config.sumFormat != nil {
+			weight.field = newFormatKeyFinder(config.sumFormat)
+		} else {
+			weight.field = newRangeKeyFinder(config.sumFields, config.fieldSeparator, config.quotedFields)
 		}
-		topList = counter.getTop()
+		kf.getters = append(kf.getters, weight)
 	}
+	if config.groupBy != nil {
+		kf.getters = append(kf.getters, &groupGetter{field: config.newFieldFinder(config.groupBy)})
+	}
+	if config.distinct != nil {
+		kf.getters = append(kf.getters, &distinctGetter{field: config.newFieldFinder(config.distinct)})
+	}
+	if config.value != nil {
+		kf.getters = append(kf.getters, &valueGetter{field: config.newFieldFinder(config.value)})
+	}
+	if config.window > 0 {
+		pane := &paneGetter{field: config.newFieldFinder(config.time), format: config.timeFormat,
+			length: config.window}
+		if config.slide > 0 {
+			pane.length = config.slide
+		}
+		kf.getters = append(kf.getters, pane)
+	}
+	return kf
+}
 
-	return topList, err
+// newFieldFinder makes a keyFinder for a field other than the key
+func (config *config) newFieldFinder(fs *fieldSpec) *keyFinder {
+	if fs.csv != nil {
+		return newCSVKeyFinder(fs.csv.clone())
+	} else if fs.paths != nil {
+		return newJSONKeyFinder(fs.paths, config.missing)
+	} else if fs.format != nil {
+		return newFormatKeyFinder(fs.format)
+	}
+	return newRangeKeyFinder(fs.fields, config.fieldSeparator, config.quotedFields)
+}
+
+// newCounter makes a counter which sums weights if there's a --sum field, counts distinct values if there's
+// a --distinct field, and is approximate with --max-keys; with --bottom, it finds the lowest counts
+func (config *config) newCounter() *counter {
+	var counter *counter
+	switch {
+	case config.distinct != nil:
+		counter = newDistinctCounter(config.size)
+	case config.maxKeys > 0:
+		counter = newApproxCounter(config.size, config.maxKeys, config.sum)
+	case config.sum:
+		counter = newWeightedCounter(config.size)
+	default:
+		counter = newCounter(config.size)
+	}
+	counter.bottom = config.bottom
+	return counter
 }
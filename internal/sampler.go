@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strconv"
 )
 
 // sample prints out what amounts to a debugging feed, showing how the filtering and keyrewriting are working.
@@ -19,15 +20,53 @@ func sample(ioReader io.Reader, filters *filters, kf *keyFinder) error {
 			return err
 		}
 
-		if filters.filterRecord(record) {
-			fmt.Print("   ACCEPT: " + string(record))
-		} else {
+		if kf.csv != nil {
+			if csvQuoteOpen(record) {
+				record, err = readCSVContinuation(reader, record)
+				if err != nil && !errors.Is(err, io.EOF) {
+					return err
+				}
+			}
+			if kf.csv.awaitingHeader {
+				fmt.Print("   HEADER: " + string(record))
+				if err = kf.setCSVHeader(record); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		if kf.isDirective(record) {
+			fmt.Print("DIRECTIVE: " + string(record))
+			if err = kf.setDirective(record); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !filters.filterRecord(record) {
 			fmt.Print("   REJECT: " + string(record))
 			continue
 		}
-		keyBytes, err := kf.getKey(record)
-		if err != nil {
-			return err
+		fields, err := kf.getFields(record)
+		if _, rejected := err.(whereRejection); rejected {
+			fmt.Print("   REJECT: " + string(record))
+			continue
+		}
+		fmt.Print("   ACCEPT: " + string(record))
+		var keyBytes []byte
+		if err == nil {
+			keyBytes, err = kf.getKey(record)
+		}
+		if errors.Is(err, errSkipRecord) {
+			fmt.Println("  SKIPPED: no key")
+			continue
+		} else if err != nil {
+			if err = kf.onError.sampled(record, err); err != nil {
+				return err
+			}
+			fmt.Println("    ERROR: can't extract key")
+			continue
 		}
 
 		filtered := filters.filterField(keyBytes)
@@ -37,6 +76,9 @@ func sample(ioReader io.Reader, filters *filters, kf *keyFinder) error {
 			fmt.Printf("   KEY IN: %s\n", string(keyBytes))
 			fmt.Printf(" FILTERED: %s\n", string(filtered))
 		}
+		if fields.hasWeight {
+			fmt.Printf("   WEIGHT: %s\n", strconv.FormatFloat(fields.weight, 'f', -1, 64))
+		}
 	}
 	return nil
 }
@@ -2,83 +2,238 @@ package topfew
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"runtime"
+	"time"
 )
 
+// minCSVSegment is the smallest segment size used for CSV files, which need an extra pass over the data to
+// find where segments can safely end
+const minCSVSegment = 64 * 1024
+
 // segment represents a segment of a file. Is required to begin at the start of a line, i.e. start of file or
 // after a \n.
 type segment struct {
 	start int64
 	end   int64
-	file  *os.File
+	fname string
 }
 
-// readFileInSegments breaks the file up into multiple segments and then reads them in parallel. counter
-// will be updated with the resulting occurrence counts.
-func readFileInSegments(fname string, filter *filters, counter *counter, kf *keyFinder, width int) error {
-	// find file size
-	file, err := os.Open(fname)
-	if err != nil {
-		return err
-	}
-	info, _ := file.Stat() // can't fail I think
-	fileSize := info.Size()
-	_ = file.Close()
+// segmentJob reads one segment of a file, which is from start to end, and adds its counts to segCounter. If
+// release isn't nil, it has to be called once the job has been run, or if it isn't going to be.
+type segmentJob struct {
+	fname   string
+	start   int64
+	end     int64
+	read    func(segCounter segmentCounter) error
+	release func()
+}
 
+// readFilesInSegments breaks the files up into multiple segments and then reads them in parallel. counter
+// will be updated with the resulting occurrence counts. The segments are sized so that width of them would
+// cover all the files, and no more than width of them are read at once, so a big file gets divided up and
+// a lot of small files get read in parallel.
+func readFilesInSegments(ctx context.Context, fnames []string, filter *filters, counter *counter, kf *keyFinder,
+	width int) error {
 	// if user doesn't specify segment parallelism, we ask Go how many cores it thinks the CPU has and
 	//  assign one segment per CPU
-	var segSize int64
 	if width == 0 {
-		cores := runtime.NumCPU()
-		segSize = fileSize / int64(cores)
-	} else {
-		segSize = fileSize / int64(width)
+		width = runtime.NumCPU()
+	}
+	var totalSize int64
+	for _, fname := range fnames {
+		info, err := os.Stat(fname)
+		if err != nil {
+			return err
+		}
+		totalSize += info.Size()
 	}
+	segSize := totalSize / int64(width)
 
-	// compute segments and put them in a slice
-	var segments []*segment
-	base := int64(0)
-	for base < fileSize {
-		// each segment starts at the beginning of a line and ends after a newline (or at EOF)
-		segment, err := newSegment(fname, base, base+segSize)
+	// if one segment fails, there's no point in the others carrying on
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var jobs []segmentJob
+	for _, fname := range fnames {
+		fileJobs, err := segmentFile(ctx, fname, segSize, filter, kf)
 		if err != nil {
+			releaseJobs(jobs)
 			return err
 		}
-		segments = append(segments, segment)
-		base = segment.end
+		jobs = append(jobs, fileJobs...)
 	}
 
-	// Fire 'em off, wait for them to report back
-	ch := make(chan segmentResult)
-	for _, segment := range segments {
-		go readSegment(segment, filter, kf, ch)
+	// Fire 'em off, wait for them to report back. The channel is buffered so that if we bail out on an
+	//  error, the remaining segment readers can still report and exit.
+	ch := make(chan segmentResult, len(jobs))
+	queue := make(chan segmentJob, len(jobs))
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+	for i := 0; i < width && i < len(jobs); i++ {
+		go func() {
+			for job := range queue {
+				segCounter := counter.newSegmentCounter()
+				began := time.Now()
+				err := job.read(segCounter)
+				segCounter.stats.Segments = []SegmentStats{{File: job.fname, Start: job.start, End: job.end,
+					Records: segCounter.stats.Records, Bytes: segCounter.stats.Bytes, Elapsed: time.Since(began)}}
+				if job.release != nil {
+					job.release()
+				}
+				ch <- segmentResult{err: err, segCounter: segCounter}
+			}
+		}()
 	}
-	for done := 0; done < len(segments); done++ {
+	for done := 0; done < len(jobs); done++ {
 		res := <-ch
 		if res.err != nil {
-			return err
+			return res.err
 		}
 		counter.merge(res.segCounter)
 	}
 	return nil
 }
 
-// the start value is guaranteed to be at file start or after newline
-func newSegment(fname string, start int64, end int64) (*segment, error) {
+// releaseJobs releases jobs that aren't going to be run
+func releaseJobs(jobs []segmentJob) {
+	for _, job := range jobs {
+		if job.release != nil {
+			job.release()
+		}
+	}
+}
+
+// segmentFile divides a file into segments of about segSize bytes, and returns jobs to read them
+func segmentFile(ctx context.Context, fname string, segSize int64, filter *filters,
+	kf *keyFinder) ([]segmentJob, error) {
+	kind, err := fileCompression(fname)
+	if err != nil {
+		return nil, err
+	}
+	// like a CSV header, the directives at the start of the file apply to all its segments, unless there's
+	//  another #Fields further on, when the records after it have to be read knowing that
+	if kf.needsDirectives() {
+		kf = kf.clone()
+		later, err := readFileDirectives(fname, kf)
+		if err != nil {
+			return nil, err
+		}
+		if later {
+			info, err := os.Stat(fname)
+			if err != nil {
+				return nil, err
+			}
+			segSize = info.Size() + 1
+		}
+	}
+	if kind != uncompressed {
+		return compressedSegmentJobs(ctx, fname, kind, segSize, filter, kf)
+	}
+
+	info, err := os.Stat(fname)
+	if err != nil {
+		return nil, err
+	}
+	fileSize := info.Size()
+	mapped := mapFile(fname)
+	if mapped == nil {
+		return segmentJobs(ctx, fname, fileSize, nil, segSize, filter, kf)
+	}
+	jobs, err := segmentJobs(ctx, fname, int64(len(mapped.data)), mapped, segSize, filter, kf)
+	mapped.share(len(jobs))
+	return jobs, err
+}
+
+// segmentJobs is segmentFile for an uncompressed file, which is read from mapped if that isn't nil
+func segmentJobs(ctx context.Context, fname string, fileSize int64, mapped *mappedFile, segSize int64,
+	filter *filters, kf *keyFinder) ([]segmentJob, error) {
+	// compute segments and make jobs to read them
+	var err error
+	var jobs []segmentJob
+	base := int64(0)
+	var inQuotes []bool
+	if kf.csv != nil {
+		// each file has its own header, which may put the columns in different places, and is dealt with
+		//  before segmenting and isn't part of any segment
+		kf = kf.clone()
+		if kf.csv.awaitingHeader {
+			base, err = readCSVHeader(fname, kf)
+			if err != nil {
+				return nil, err
+			}
+		}
+		// newlines inside quoted fields don't end records, so we need to know, for each place we might
+		//  want to end a segment, whether it's inside quotes
+		if segSize < minCSVSegment {
+			segSize = minCSVSegment
+		}
+		inQuotes, err = csvBoundaryQuoting(fname, fileSize, segSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for base < fileSize {
+		// each segment starts at the beginning of a line and ends after a newline (or at EOF)
+		var segment *segment
+		if mapped != nil {
+			job := segmentJob{fname: fname, start: base, release: mapped.release}
+			if kf.csv == nil {
+				job.end = mapped.segmentEnd(base+segSize, false, false)
+			} else {
+				chunk := base/segSize + 1
+				job.end = mapped.segmentEnd(chunk*segSize, true, chunk < int64(len(inQuotes)) && inQuotes[chunk])
+			}
+			records := mapped.data[job.start:job.end]
+			job.read = func(segCounter segmentCounter) error {
+				return countChunk(ctx, records, filter, kf.clone(), segCounter)
+			}
+			jobs = append(jobs, job)
+			base = job.end
+			continue
+		}
+		if kf.csv == nil {
+			segment, err = newSegment(fname, base, base+segSize, false, false)
+		} else {
+			// CSV segments end at the first record boundary following a chunk boundary
+			chunk := base/segSize + 1
+			segment, err = newSegment(fname, base, chunk*segSize, true, chunk < int64(len(inQuotes)) && inQuotes[chunk])
+		}
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, segmentJob{fname: fname, start: segment.start, end: segment.end,
+			read: func(segCounter segmentCounter) error {
+				return readSegment(ctx, segment, filter, kf, segCounter)
+			}})
+		base = segment.end
+	}
+	return jobs, nil
+}
+
+// the start value is guaranteed to be at file start or after newline. For CSV files, the segment doesn't end
+// until a newline that's outside quotes; inQuotes says whether end is inside a quoted field.
+func newSegment(fname string, start int64, end int64, csv bool, inQuotes bool) (*segment, error) {
 	// All these "err != nil" tests on basic filesystem seek operations are probably superfluous and
 	// drive down the test coverage
 
 	// Get the file ready to go
-	file, _ := os.Open(fname) // can't fail, we just opened this in the parent func
-	info, _ := file.Stat()    // can't fail
+	file, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	// noinspection ALL
+	defer file.Close()
+	info, _ := file.Stat() // can't fail
 	fileSize := info.Size()
 	reader := bufio.NewReader(file)
 
-	var err error
 	var offset int64
 	if end >= fileSize {
 		end = fileSize
@@ -91,70 +246,137 @@ func newSegment(fname string, start int64, end int64) (*segment, error) {
 		if offset != end {
 			return nil, fmt.Errorf("tried to seek to %d, went to %d", end, offset)
 		}
-		tillNL, err := reader.ReadBytes('\n')
-		if err != nil && err != io.EOF {
-			return nil, err
+		if csv {
+			for {
+				tillNL, err := reader.ReadBytes('\n')
+				if err != nil && err != io.EOF {
+					return nil, err
+				}
+				end += int64(len(tillNL))
+				if csvQuoteOpen(tillNL) {
+					inQuotes = !inQuotes
+				}
+				if !inQuotes || err != nil {
+					break
+				}
+			}
+		} else {
+			tillNL, err := reader.ReadBytes('\n')
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			end += int64(len(tillNL))
 		}
-		end += int64(len(tillNL))
 	}
 
-	// now seek back to the beginning of the segment to get ready for reading
-	offset, err = file.Seek(start, 0)
-	if err != nil {
-		return nil, err
-	}
-	if offset != start {
-		return nil, fmt.Errorf("tried to seek to %d, went to %d", start, offset)
-	}
-	return &segment{start, end, file}, nil
+	return &segment{start, end, fname}, nil
 }
 
 type segmentResult struct {
-	// one of these will be set
+	// if err is set, segCounter is incomplete
 	err        error
 	segCounter segmentCounter
 }
 
-// we've already opened the file and seeked to the right place
-func readSegment(s *segment, filter *filters, kf *keyFinder, reportCh chan segmentResult) {
+// readSegment reads the records in a segment and adds their counts to segCounter
+func readSegment(ctx context.Context, s *segment, filter *filters, kf *keyFinder, segCounter recordCounter) error {
+	file, err := os.Open(s.fname)
+	if err != nil {
+		return err
+	}
 	// noinspection ALL
-	defer s.file.Close()
+	defer file.Close()
+	offset, err := file.Seek(s.start, 0)
+	if err != nil {
+		return err
+	}
+	if offset != s.start {
+		return fmt.Errorf("tried to seek to %d, went to %d", s.start, offset)
+	}
 
-	reader := bufio.NewReaderSize(s.file, 16*1024)
+	reader := bufio.NewReaderSize(file, 16*1024)
 	current := s.start
-	segCounter := newSegmentCounter()
 	kf = kf.clone()
+	done := ctx.Done()
 	for current < s.end {
-		// ReadSlice results are only valid until the next call to Read, so we need
-		// to be careful about how long we hang onto the record slice. The SegmentCounter
-		// is the only thing that holds onto data from record, and it has to make a copy
-		// anyway when it constructs its string Key. So this is safe.
-		record, err := reader.ReadSlice('\n')
-		// ReadSlice returns an error if a line doesn't fit in its buffer. We
-		// deal with that by switching to ReadBytes to get the remainder of the line.
-		if errors.Is(err, bufio.ErrBufferFull) {
-			// Copy record because ReadBytes is going to overwrite it, and it contains
-			// the start of the current line.
-			linestart := append([]byte(nil), record...)
-			record, err = reader.ReadBytes('\n')
-			record = append(linestart, record...)
+		select {
+		case <-done:
+			return ctx.Err()
+		default:
+		}
+		record, err := readLine(reader)
+		// a CSV record can go on past the end of the line; copy it because ReadSlice's buffer is about to
+		// be overwritten
+		if kf.csv != nil && err == nil && csvQuoteOpen(record) {
+			record, err = readCSVContinuation(reader, append([]byte(nil), record...))
 		}
 		// not smart enough to figure out how to test this
 		if (err != nil) && !errors.Is(err, io.EOF) {
-			reportCh <- segmentResult{err: fmt.Errorf("can't read segment: %w", err)}
-			return
+			return fmt.Errorf("can't read segment: %w", err)
 		}
 		current += int64(len(record))
-		if !filter.filterRecord(record) {
-			continue
-		}
-		keyBytes, err := kf.getKey(record)
-		if err != nil {
-			// bypass
-			_, _ = fmt.Fprintf(os.Stderr, "Can't extract Key from %s\n", string(record))
-			continue
+		if err := countRecord(record, filter, kf, segCounter); err != nil {
+			return err
 		}
-		segCounter.add(filter.filterField(keyBytes))
 	}
-	reportCh <- segmentResult{segCounter: segCounter}
+	return nil
+}
+
+// readLine reads the next line. ReadSlice results are only valid until the next call to Read, so we need
+// to be careful about how long we hang onto the record slice. The SegmentCounter is the only thing that holds
+// onto data from record, and it has to make a copy anyway when it constructs its string Key. So this is safe.
+func readLine(reader *bufio.Reader) ([]byte, error) {
+	record, err := reader.ReadSlice('\n')
+	// ReadSlice returns an error if a line doesn't fit in its buffer. We
+	// deal with that by switching to ReadBytes to get the remainder of the line.
+	if errors.Is(err, bufio.ErrBufferFull) {
+		// Copy record because ReadBytes is going to overwrite it, and it contains
+		// the start of the current line.
+		linestart := append([]byte(nil), record...)
+		record, err = reader.ReadBytes('\n')
+		record = append(linestart, record...)
+	}
+	return record, err
+}
+
+// countRecord applies the filters to a record and, if it passes, adds its key to the counts, unless it's the
+// CSV header or a log format directive. It returns an error if the header is bad, or the key can't be extracted
+// and --on-error says to stop.
+func countRecord(record []byte, filter *filters, kf *keyFinder, counts recordCounter) error {
+	if kf.csv != nil && kf.csv.awaitingHeader {
+		return kf.setCSVHeader(record)
+	}
+	if kf.isDirective(record) {
+		return kf.setDirective(record)
+	}
+	stats := counts.recordStats()
+	if !stats.admit(record, filter) {
+		return nil
+	}
+	fields, err := kf.getFields(record)
+	if rejection, ok := err.(whereRejection); ok {
+		stats.WhereRejects = countReject(stats.WhereRejects, int(rejection))
+		return nil
+	}
+	var keyBytes []byte
+	if err == nil {
+		keyBytes, err = kf.getKey(record)
+	}
+	if errors.Is(err, errSkipRecord) {
+		stats.Skipped++
+		return nil
+	} else if err != nil {
+		stats.KeyErrors++
+		return kf.onError.handle(record, err)
+	}
+	keyBytes = kf.partitionKey(fields, filter.filterField(keyBytes))
+	if fields.hasHash {
+		counts.addDistinct(keyBytes, fields.hash)
+	} else {
+		counts.addWeighted(keyBytes, fields.weight)
+	}
+	if fields.hasValue {
+		counts.addValue(keyBytes, fields.value)
+	}
+	return nil
 }
@@ -1,37 +1,25 @@
 package topfew
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
 
 func TestReadAll(t *testing.T) {
-	file, err := os.Open("../test/data/small")
-	if err != nil {
-		t.Error("Can't open file")
-		return
-	}
-	//noinspection ALL
-	defer file.Close()
-
-	offs, err := file.Seek(4176, 0)
-	if offs != 4176 || err != nil {
-		t.Error("OUCH")
-	}
-	s := segment{4176, 4951, file}
+	s := segment{4176, 4951, "../test/data/small"}
 	kf := newKeyFinder([]uint{7}, nil, false)
-	ch := make(chan segmentResult)
 	f := filters{nil, nil, nil}
-	go readSegment(&s, &f, kf, ch)
-
-	segres := <-ch
-	if segres.err != nil {
-		t.Fatalf("got error from segment reader %v", segres.err)
+	segCounter := newSegmentCounter()
+	err := readSegment(context.Background(), &s, &f, kf, segCounter)
+	if err != nil {
+		t.Fatalf("got error from segment reader %v", err)
 	}
 	counter := newCounter(10)
-	counter.merge(segres.segCounter)
+	counter.merge(segCounter)
 
 	res := counter.getTop()
 	var want = map[string]bool{
@@ -77,7 +65,7 @@ func TestReadSegmentFiltering(t *testing.T) {
 	_, _ = fmt.Fprint(tmpfile, input)
 	_ = tmpfile.Close()
 	counter := newCounter(10)
-	err = readFileInSegments(tmpName, &c.filter, counter, newKeyFinder(c.fields, nil, false), 1)
+	err = readFilesInSegments(context.Background(), []string{tmpName}, &c.filter, counter, newRangeKeyFinder(c.fields, nil, false), 1)
 	if err != nil {
 		t.Error("Run? " + err.Error())
 	}
@@ -110,14 +98,70 @@ func TestVeryLongLines(t *testing.T) {
 	}
 	_ = tmpfile.Close()
 	counter := newCounter(10)
-	err = readFileInSegments(tmpName, &filters{}, counter, newKeyFinder(nil, nil, false), 1)
+	err = readFilesInSegments(context.Background(), []string{tmpName}, &filters{}, counter, newKeyFinder(nil, nil, false), 1)
 	if err != nil {
 		t.Fatal("Failed to read long-lines file")
 	}
 	assertKeyCountsEqual(t,
 		[]*keyCount{
-			{a80k, pv(5)},
-			{c3, pv(3)},
-			{b30k, pv(2)}},
+			{Key: a80k, Count: pv(5)},
+			{Key: c3, Count: pv(3)},
+			{Key: b30k, Count: pv(2)}},
 		counter.getTop())
 }
+
+func TestMappedFiles(t *testing.T) {
+	defer func() { useMmap = true }()
+	dir := t.TempDir()
+	csv := filepath.Join(dir, "records.csv")
+	var records strings.Builder
+	records.WriteString("name,notes,country\n")
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&records, "n%d,\"a \"\"note\"\"\non two lines\",c%d\n", i, i%7)
+		fmt.Fprintf(&records, "n%d,plain,c%d\n", i, i%3)
+	}
+	if err := os.WriteFile(csv, []byte(records.String()), 0o644); err != nil {
+		t.Fatal("write: " + err.Error())
+	}
+	unterminated := filepath.Join(dir, "unterminated")
+	if err := os.WriteFile(unterminated, []byte("a\nb\na"), 0o644); err != nil {
+		t.Fatal("write: " + err.Error())
+	}
+
+	tests := [][]string{
+		{"-f", "1", "../test/data/small"},
+		{"-f", "7", "-g", "POST", "../test/data/small", "../test/data/10lines"},
+		{"--csv", "-f", "country", csv},
+		{unterminated},
+	}
+	for _, args := range tests {
+		var outputs []string
+		var stats []*Stats
+		for _, mapping := range []bool{true, false} {
+			useMmap = mapping
+			out, runStats := runSorted(t, nil, append([]string{"-w", "5", "-n", "100"}, args...)...)
+			outputs = append(outputs, out)
+			stats = append(stats, runStats)
+		}
+		if outputs[0] != outputs[1] || stats[0].Records != stats[1].Records || stats[0].Bytes != stats[1].Bytes ||
+			len(stats[0].Segments) != len(stats[1].Segments) {
+			t.Errorf("%v: mapped got %+v\n%s\nread got %+v\n%s", args, *stats[0], outputs[0], *stats[1], outputs[1])
+			continue
+		}
+		for i, segment := range stats[0].Segments {
+			if segment.Start != stats[1].Segments[i].Start || segment.End != stats[1].Segments[i].End {
+				t.Errorf("%v: mapped segment %+v, read %+v", args, segment, stats[1].Segments[i])
+			}
+		}
+	}
+
+	// directories and empty files aren't mapped
+	empty := filepath.Join(dir, "empty")
+	if err := os.WriteFile(empty, nil, 0o644); err != nil {
+		t.Fatal("write: " + err.Error())
+	}
+	useMmap = true
+	if mapFile(dir) != nil || mapFile(empty) != nil || mapFile(filepath.Join(dir, "nonexistent")) != nil {
+		t.Error("mapped something that isn't a regular file with data in it")
+	}
+}
@@ -0,0 +1,109 @@
+package topfew
+
+// A top list alone doesn't say whether its keys are most of the records or a sliver of them. With --percent,
+//  each result has its share of all the records, or with --sum, of the total, and with --cumulative, the
+//  running total of the shares. With --other, the list ends with an (other) row standing for all the keys
+//  that didn't make it in. When every key is counted, the (other) row is added up from their tallies, so it
+//  has everything a regular row does, including --distinct and --value figures. With --max-keys, the keys
+//  outside the list are gone, so its count and sum are what's left of the total, and the number of keys is
+//  estimated from their hashes.
+
+import (
+	"strconv"
+)
+
+// otherKey is the key of the (other) row
+const otherKey = "(other)"
+
+// shares adds the percentages and the (other) row, if they were asked for, to a top list from the counter
+func (config *config) shares(counter *counter, topList []*keyCount) []*keyCount {
+	if !config.percent && !config.cumulative && !config.other {
+		return topList
+	}
+	if config.other {
+		if other := otherRow(counter, topList); other != nil {
+			topList = append(topList, other)
+		}
+	}
+
+	// with --distinct, the shares are of the records, since the numbers of distinct values don't add up
+	total := float64(counter.total.count)
+	if counter.weighted {
+		total = counter.total.sum
+	}
+	running := 0.0
+	for _, kc := range topList {
+		share := float64(*kc.Count)
+		if kc.Sum != nil {
+			share = *kc.Sum
+		}
+		percent := 0.0
+		if total != 0 {
+			percent = 100 * share / total
+		}
+		running += percent
+		cumulative := running
+		if config.percent {
+			kc.Percent = &percent
+		}
+		if config.cumulative {
+			kc.Cumulative = &cumulative
+		}
+	}
+	return topList
+}
+
+// otherRow returns the (other) row for the keys that aren't in the top list, or nil if there aren't any
+func otherRow(counter *counter, topList []*keyCount) *keyCount {
+	listed := make(map[string]bool, len(topList))
+	var listedCount uint64
+	listedSum := 0.0
+	for _, kc := range topList {
+		listed[kc.Key] = true
+		listedCount += *kc.Count
+		if kc.Sum != nil {
+			listedSum += *kc.Sum
+		}
+	}
+
+	var other tally
+	var keys uint64
+	if counter.sketch == nil {
+		for key, count := range counter.counts {
+			if !listed[key] {
+				other.add(count)
+				keys++
+			}
+		}
+	} else {
+		// the listed counts may be too high, but not too low, so what's left may be too low, but not too high
+		if counter.total.count > listedCount {
+			other.count = counter.total.count - listedCount
+		}
+		other.sum = counter.total.sum - listedSum
+		// the estimate of the number of keys can be a little low, but there's at least one
+		keys = 1
+		if estimate := counter.distinctKeys(); estimate > uint64(len(topList))+1 {
+			keys = estimate - uint64(len(topList))
+		}
+	}
+	if other.count == 0 {
+		return nil
+	}
+
+	kc := &keyCount{Key: otherKey, Count: &other.count, Keys: &keys}
+	if counter.weighted {
+		kc.Sum = &other.sum
+	}
+	if other.distinct != nil {
+		distinct := other.distinct.cardinality()
+		kc.Distinct = &distinct
+	}
+	kc.Values = other.values.summary()
+	return kc
+}
+
+// formatPercent is how percentages are printed, to two decimal places
+func formatPercent(f float64) string {
+	return strconv.FormatFloat(f, 'f', 2, 64)
+}
@@ -0,0 +1,97 @@
+package topfew
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCounterTotals(t *testing.T) {
+	for _, maxKeys := range []int{0, 10} {
+		config, err := newConfig(&Options{Sum: "2", MaxKeys: maxKeys})
+		if err != nil {
+			t.Fatal("config: " + err.Error())
+		}
+		counter := config.newCounter()
+		for i := 0; i < 100; i++ {
+			segCounter := counter.newSegmentCounter()
+			for j := 0; j < 10; j++ {
+				segCounter.addWeighted([]byte(fmt.Sprintf("key %d", (i*10+j)%500)), 2)
+			}
+			counter.merge(segCounter)
+			counter.addWeighted([]byte("another key"), 1)
+		}
+		if counter.total.count != 1100 || counter.total.sum != 2100 {
+			t.Errorf("max-keys %d: total count %d sum %g", maxKeys, counter.total.count, counter.total.sum)
+		}
+		keys := counter.distinctKeys()
+		if maxKeys == 0 && keys != 501 || keys < 490 || keys > 510 {
+			t.Errorf("max-keys %d: %d keys", maxKeys, keys)
+		}
+	}
+}
+
+func TestShares(t *testing.T) {
+	records := "a 5\nb 3\na 5\nc 1\na 5\nb 3\nd 1\na 5\nc 1\nb 3\n"
+	got := runBoth(t, records, "-f", "1", "-n", "2", "--percent", "--cumulative", "--other")
+	wanted := "4 40.00% 40.00% a\n3 30.00% 70.00% b\n3 30.00% 100.00% (2 other keys)\n"
+	if got != wanted {
+		t.Errorf("text got\n%s", got)
+	}
+
+	// with --sum, the shares are of the total, and there's no (other) row if every key is listed
+	got = runBoth(t, records, "-f", "1", "--sum", "2", "--percent", "--other", "--output", "csv")
+	wanted = "count,sum,percent,keys,key\n4,20,62.50,,a\n3,9,28.12,,b\n2,2,6.25,,c\n1,1,3.12,,d\n"
+	if got != wanted {
+		t.Errorf("CSV got\n%s", got)
+	}
+
+	got = runBoth(t, "a b\na c\nd e\na b\n", "-f", "1,2", "-n", "1", "--cumulative", "--other", "--output",
+		"json")
+	wanted = "[\n{\"count\":2,\"cumulative\":50.00,\"key\":\"a b\",\"fields\":{\"field1\":\"a\",\"field2\":\"b\"}},\n" +
+		"{\"count\":2,\"cumulative\":100.00,\"keys\":2,\"key\":\"(other)\",\"fields\":{\"field1\":\"\",\"field2\":\"\"}}\n]\n"
+	if got != wanted {
+		t.Errorf("JSON got\n%s", got)
+	}
+
+	// the (other) row adds up the --value statistics and --distinct values of the keys that aren't listed
+	got = runBoth(t, "/a x 1\n/a y 2\n/a z 3\n/b x 4\n/c x 5\n/c w 6\n", "-f", "1", "-n", "1", "--distinct", "2",
+		"--value", "3", "--other")
+	wanted = "3 min=1 max=3 mean=2 total=6 p50=1.99 p90=1.99 p99=1.99 /a\n" +
+		"2 min=4 max=6 mean=5 total=15 p50=5 p90=5 p99=5 (2 other keys)\n"
+	if got != wanted {
+		t.Errorf("distinct got\n%s", got)
+	}
+
+	// each group's shares are of the group's total
+	got = runBoth(t, "h1 a\nh1 a\nh1 b\nh2 c\nh2 c\nh2 c\nh2 d\n", "-f", "2", "-n", "1", "--group-by", "1",
+		"--percent", "--other")
+	wanted = "h2:\n3 75.00% c\n1 25.00% (1 other keys)\n\nh1:\n2 66.67% a\n1 33.33% (1 other keys)\n"
+	if got != wanted {
+		t.Errorf("group-by got\n%s", got)
+	}
+}
+
+func TestApproxShares(t *testing.T) {
+	var records strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&records, "common\nkey%d\n", i%200)
+	}
+	got := runBoth(t, records.String(), "-n", "1", "--max-keys", "20", "--percent", "--other", "--output", "csv")
+	lines := strings.Split(got, "\n")
+	if len(lines) != 4 || lines[0] != "count,error,percent,keys,key" || lines[1] != "1000,0,50.00,,common" ||
+		!strings.HasPrefix(lines[2], "1000,,50.00,") || !strings.HasSuffix(lines[2], ",(other)") {
+		t.Errorf("got\n%s", got)
+	}
+	var keys int
+	if _, err := fmt.Sscanf(strings.Split(lines[2], ",")[3], "%d", &keys); err != nil || keys < 190 || keys > 210 {
+		t.Errorf("estimated %d other keys for 200", keys)
+	}
+
+	// the (other) row's count can only be too low, so it isn't given an error
+	got = runBoth(t, records.String(), "-n", "1", "--max-keys", "20", "--other")
+	lines = strings.Split(got, "\n")
+	if len(lines) != 3 || lines[0] != "1000±0 common" || !strings.HasPrefix(lines[1], "1000 (") {
+		t.Errorf("text got\n%s", got)
+	}
+}
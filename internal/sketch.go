@@ -0,0 +1,147 @@
+package topfew
+
+// With --max-keys, memory use is bounded by replacing the table of every key's count with the Space-Saving
+//  algorithm, from Metwally, Agrawal, and El Abbadi, "Efficient Computation of Frequent and Top-k Elements
+//  in Data Streams". It tracks no more than a fixed number of keys. When one that isn't tracked shows up and
+//  there's no room, it takes over the entry of the key with the lowest count, inheriting that count, which
+//  becomes its maximum error. So no count is ever too low, nor too high by more than its error, and any key
+//  which makes up more than 1/max-keys of the total is sure to be tracked. Segments each have their own
+//  sketch, and sketches are merged as described in Agarwal et al., "Mergeable Summaries".
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// sketchEntry is a tracked key; err is the most by which its sum may exceed the true value
+type sketchEntry struct {
+	key string
+	tally
+	err   float64
+	index int
+}
+
+// sketchHeap is a min-heap of entries by sum, so the one to evict is at the top
+type sketchHeap []*sketchEntry
+
+func (h sketchHeap) Len() int           { return len(h) }
+func (h sketchHeap) Less(i, j int) bool { return h[i].sum < h[j].sum }
+func (h sketchHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *sketchHeap) Push(x any) {
+	e := x.(*sketchEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *sketchHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// spaceSaving tracks the counts of at most capacity keys
+type spaceSaving struct {
+	capacity int
+	entries  map[string]*sketchEntry
+	heap     sketchHeap
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{
+		capacity: capacity,
+		entries:  make(map[string]*sketchEntry, capacity),
+		heap:     make(sketchHeap, 0, capacity),
+	}
+}
+
+// add one occurrence, with the supplied weight, which must not be negative, to the indicated key
+func (s *spaceSaving) add(key []byte, weight float64) {
+	e, ok := s.entries[string(key)]
+	if ok {
+		e.count++
+		e.sum += weight
+		heap.Fix(&s.heap, e.index)
+		return
+	}
+	if len(s.heap) < s.capacity {
+		e = &sketchEntry{key: string(key), tally: tally{count: 1, sum: weight}}
+		s.entries[e.key] = e
+		heap.Push(&s.heap, e)
+		return
+	}
+
+	// take over the entry with the lowest count
+	e = s.heap[0]
+	delete(s.entries, e.key)
+	e.key = string(key)
+	e.err = e.sum
+	e.count++
+	e.sum += weight
+	s.entries[e.key] = e
+	heap.Fix(&s.heap, 0)
+}
+
+// floor is the most that a key which isn't tracked could have had; zero unless the sketch is full
+func (s *spaceSaving) floor() tally {
+	if len(s.heap) < s.capacity {
+		return tally{}
+	}
+	return s.heap[0].tally
+}
+
+// merge adds the counts from another sketch, which should be discarded afterward. A key tracked by only one
+// of the sketches may have had as much as the other's floor in it, so that's added to both its count and
+// its error. Then the capacity highest counts are kept.
+func (s *spaceSaving) merge(other *spaceSaving) {
+	floor, otherFloor := s.floor(), other.floor()
+	for key, e := range s.entries {
+		if o, ok := other.entries[key]; ok {
+			e.count += o.count
+			e.sum += o.sum
+			e.err += o.err
+			delete(other.entries, key)
+		} else {
+			e.count += otherFloor.count
+			e.sum += otherFloor.sum
+			e.err += otherFloor.sum
+		}
+	}
+	merged := s.heap
+	for _, o := range other.entries {
+		o.count += floor.count
+		o.sum += floor.sum
+		o.err += floor.sum
+		s.entries[o.key] = o
+		merged = append(merged, o)
+	}
+
+	if len(merged) > s.capacity {
+		sortEntries(merged)
+		for _, e := range merged[s.capacity:] {
+			delete(s.entries, e.key)
+		}
+		merged = merged[:s.capacity]
+	}
+	s.heap = merged
+	for i, e := range s.heap {
+		e.index = i
+	}
+	heap.Init(&s.heap)
+}
+
+// sorted returns the entries in decreasing order of sum
+func (s *spaceSaving) sorted() []*sketchEntry {
+	entries := append([]*sketchEntry(nil), s.heap...)
+	sortEntries(entries)
+	return entries
+}
+
+func sortEntries(entries []*sketchEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].sum > entries[j].sum
+	})
+}
@@ -0,0 +1,120 @@
+package topfew
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// zipfKeys makes a stream of keys with a long tail, and returns it along with the true counts
+func zipfKeys(seed int64, n int) ([]string, map[string]uint64) {
+	z := rand.NewZipf(rand.New(rand.NewSource(seed)), 1.2, 1, 5000)
+	keys := make([]string, n)
+	truth := make(map[string]uint64)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("k%d", z.Uint64())
+		truth[keys[i]]++
+	}
+	return keys, truth
+}
+
+func assertSketchBounds(t *testing.T, label string, s *spaceSaving, truth map[string]uint64, total int) {
+	t.Helper()
+	tracked := make(map[string]bool)
+	for _, e := range s.sorted() {
+		tracked[e.key] = true
+		actual := float64(truth[e.key])
+		if e.sum < actual || e.sum-e.err > actual {
+			t.Errorf("%s: %s estimated %f±%f, actually %f", label, e.key, e.sum, e.err, actual)
+		}
+	}
+	if len(tracked) > s.capacity {
+		t.Errorf("%s: tracking %d keys, capacity %d", label, len(tracked), s.capacity)
+	}
+	for key, count := range truth {
+		if count > uint64(total/s.capacity) && !tracked[key] {
+			t.Errorf("%s: heavy hitter %s with %d isn't tracked", label, key, count)
+		}
+	}
+}
+
+func TestSpaceSaving(t *testing.T) {
+	keys, truth := zipfKeys(1, 100000)
+
+	exact := newSpaceSaving(len(truth))
+	for _, key := range keys {
+		exact.add([]byte(key), 1)
+	}
+	for _, e := range exact.sorted() {
+		if e.err != 0 || e.count != truth[e.key] || e.sum != float64(e.count) {
+			t.Errorf("with room for all keys, %s is %d±%f, actually %d", e.key, e.count, e.err, truth[e.key])
+		}
+	}
+
+	s := newSpaceSaving(100)
+	for _, key := range keys {
+		s.add([]byte(key), 1)
+	}
+	assertSketchBounds(t, "single", s, truth, len(keys))
+	sorted := s.sorted()
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].sum > sorted[i-1].sum {
+			t.Error("sorted isn't")
+		}
+	}
+
+	// split the stream unevenly, sketch each part, and merge them
+	merged := newSpaceSaving(100)
+	for _, part := range [][]string{keys[:100], keys[100:40000], keys[40000:41000], keys[41000:]} {
+		partSketch := newSpaceSaving(100)
+		for _, key := range part {
+			partSketch.add([]byte(key), 1)
+		}
+		merged.merge(partSketch)
+	}
+	assertSketchBounds(t, "merged", merged, truth, len(keys))
+	for _, e := range merged.heap {
+		if merged.entries[e.key] != e || merged.heap[e.index] != e {
+			t.Errorf("merged sketch's map and heap disagree about %s", e.key)
+		}
+	}
+}
+
+func TestApproxRun(t *testing.T) {
+	// with room for every key, the counts are exact
+	wanted := allCounts(t, "-f", "7", "../test/data/small")
+	for _, width := range []string{"1", "4"} {
+		approx := allCounts(t, "-f", "7", "-w", width, "--max-keys", "100000", "../test/data/small")
+		assertCountsMatch(t, "max-keys "+width, wanted, approx)
+	}
+
+	var b strings.Builder
+	keys, truth := zipfKeys(2, 50000)
+	for _, key := range keys {
+		b.WriteString(key + "\n")
+	}
+	c, err := Configure([]string{"-n", "5", "--max-keys", "50"})
+	if err != nil {
+		t.Fatal("config: " + err.Error())
+	}
+	top, err := Run(c, strings.NewReader(b.String()))
+	if err != nil || len(top) != 5 {
+		t.Fatalf("Run got %d results, %v", len(top), err)
+	}
+	for _, kc := range top {
+		if kc.Error == nil || kc.Sum != nil {
+			t.Fatal("approximate results should have errors but not sums")
+		}
+		if *kc.Count < truth[kc.Key] || float64(*kc.Count)-*kc.Error > float64(truth[kc.Key]) {
+			t.Errorf("%s counted %d±%f, actually %d", kc.Key, *kc.Count, *kc.Error, truth[kc.Key])
+		}
+	}
+
+	input := "a 3\nb 4\na 2.5\nc -1\n"
+	c, _ = Configure([]string{"-f", "1", "--sum", "2", "--max-keys", "10"})
+	top, err = Run(c, strings.NewReader(input))
+	if err != nil || len(top) != 2 || top[0].Key != "a" || *top[0].Sum != 5.5 || *top[0].Error != 0 {
+		t.Errorf("weighted approximate run got %v, %v", top, err)
+	}
+}
@@ -0,0 +1,161 @@
+package topfew
+
+// Every run keeps track of what happened to the records: how many there were, which filter threw them out,
+//  how many keys couldn't be extracted, and, when files are read in parallel segments, how long each
+//  segment took. Like the counts, the statistics are kept by each segment's segmentCounter and added up when
+//  it's merged, so keeping them costs a few increments per record. With --stats, they're printed on stderr
+//  after the run.
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Stats describes a run. Records and Bytes count everything read, except CSV headers. Each record is then
+// either rejected by one of the greps or vgreps, or --where expressions, in order, or has a key error because
+// its key or one of the other fields couldn't be extracted, or is skipped, as with --missing skip, or is
+// counted. Keys is how many different keys were counted, which is an estimate with --max-keys, and counts
+// each key separately in each window and group. Elapsed is how long the whole run took, and when files are
+// read in segments, Segments says how each went, in order of file name and offset.
+type Stats struct {
+	Records      uint64
+	Bytes        uint64
+	GrepRejects  []uint64
+	VgrepRejects []uint64
+	WhereRejects []uint64
+	KeyErrors    uint64
+	Skipped      uint64
+	Counted      uint64
+	Keys         uint64
+	Elapsed      time.Duration
+	Segments     []SegmentStats
+}
+
+// SegmentStats describes one segment of a file. Start and End are offsets in the file, which for compressed
+// files are in the compressed data, while Bytes is how much it decompressed to.
+type SegmentStats struct {
+	File    string
+	Start   int64
+	End     int64
+	Records uint64
+	Bytes   uint64
+	Elapsed time.Duration
+}
+
+// Throughput is the number of bytes read per second
+func (s *Stats) Throughput() float64 {
+	return throughput(s.Bytes, s.Elapsed)
+}
+
+// Throughput is the number of bytes read per second
+func (s *SegmentStats) Throughput() float64 {
+	return throughput(s.Bytes, s.Elapsed)
+}
+
+func throughput(bytes uint64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(bytes) / elapsed.Seconds()
+}
+
+// admit counts the record, and says whether it passes the filters, counting it against the one that
+// rejects it if it doesn't
+func (s *Stats) admit(record []byte, filter *filters) bool {
+	s.Records++
+	s.Bytes += uint64(len(record))
+	index, vgrep := filter.rejectedBy(record)
+	switch {
+	case index < 0:
+		return true
+	case vgrep:
+		s.VgrepRejects = countReject(s.VgrepRejects, index)
+	default:
+		s.GrepRejects = countReject(s.GrepRejects, index)
+	}
+	return false
+}
+
+// countReject adds one to rejects[index], growing rejects if necessary
+func countReject(rejects []uint64, index int) []uint64 {
+	for len(rejects) <= index {
+		rejects = append(rejects, 0)
+	}
+	rejects[index]++
+	return rejects
+}
+
+// addRejects adds up two lists of reject counts, which may be of different lengths
+func addRejects(rejects []uint64, other []uint64) []uint64 {
+	for len(rejects) < len(other) {
+		rejects = append(rejects, 0)
+	}
+	for i, count := range other {
+		rejects[i] += count
+	}
+	return rejects
+}
+
+// add puts other's counts into s
+func (s *Stats) add(other *Stats) {
+	s.Records += other.Records
+	s.Bytes += other.Bytes
+	s.GrepRejects = addRejects(s.GrepRejects, other.GrepRejects)
+	s.VgrepRejects = addRejects(s.VgrepRejects, other.VgrepRejects)
+	s.WhereRejects = addRejects(s.WhereRejects, other.WhereRejects)
+	s.KeyErrors += other.KeyErrors
+	s.Skipped += other.Skipped
+	s.Segments = append(s.Segments, other.Segments...)
+}
+
+// finishStats fills in what's only known at the end of a run, and returns the counter's statistics
+func (config *config) finishStats(counter *counter, began time.Time) *Stats {
+	stats := counter.stats
+	stats.GrepRejects = addRejects(make([]uint64, len(config.filter.greps)), stats.GrepRejects)
+	stats.VgrepRejects = addRejects(make([]uint64, len(config.filter.vgreps)), stats.VgrepRejects)
+	stats.WhereRejects = addRejects(make([]uint64, len(config.where)), stats.WhereRejects)
+	stats.Counted = counter.total.count
+	stats.Keys = counter.distinctKeys()
+	stats.Elapsed = time.Since(began)
+	sort.Slice(stats.Segments, func(i, j int) bool {
+		if stats.Segments[i].File != stats.Segments[j].File {
+			return stats.Segments[i].File < stats.Segments[j].File
+		}
+		return stats.Segments[i].Start < stats.Segments[j].Start
+	})
+	return &stats
+}
+
+// formatThroughput is how throughput is printed, in megabytes per second
+func formatThroughput(bytesPerSecond float64) string {
+	return fmt.Sprintf("%.1f MB/s", bytesPerSecond/1e6)
+}
+
+// writeStats prints the statistics for people, one per line
+func (config *config) writeStats(stats *Stats, w io.Writer) error {
+	var out strings.Builder
+	fmt.Fprintf(&out, "records: %d (%d bytes)\n", stats.Records, stats.Bytes)
+	for i, rejects := range stats.GrepRejects {
+		fmt.Fprintf(&out, "rejected by --grep %s: %d\n", config.filter.greps[i], rejects)
+	}
+	for i, rejects := range stats.VgrepRejects {
+		fmt.Fprintf(&out, "rejected by --vgrep %s: %d\n", config.filter.vgreps[i], rejects)
+	}
+	for i, rejects := range stats.WhereRejects {
+		fmt.Fprintf(&out, "rejected by --where %s: %d\n", config.where[i].text, rejects)
+	}
+	fmt.Fprintf(&out, "key errors: %d\n", stats.KeyErrors)
+	fmt.Fprintf(&out, "skipped: %d\n", stats.Skipped)
+	fmt.Fprintf(&out, "counted: %d\n", stats.Counted)
+	fmt.Fprintf(&out, "distinct keys: %d\n", stats.Keys)
+	fmt.Fprintf(&out, "elapsed: %s (%s)\n", stats.Elapsed, formatThroughput(stats.Throughput()))
+	for _, segment := range stats.Segments {
+		fmt.Fprintf(&out, "segment %s %d-%d: %d records, %d bytes, %s (%s)\n", segment.File, segment.Start,
+			segment.End, segment.Records, segment.Bytes, segment.Elapsed, formatThroughput(segment.Throughput()))
+	}
+	_, err := io.WriteString(w, out.String())
+	return err
+}
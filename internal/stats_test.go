@@ -0,0 +1,109 @@
+package topfew
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	records := `{"k":"a","n":1}
+{"k":"b","n":2}
+{"k":"a","n":"x"}
+{"n":3}
+garbage
+{"k":"c","n":4,"drop":true}
+{"k":"d","n":5}
+{"k":"a","n":6,"skip":1}
+`
+	fname := filepath.Join(t.TempDir(), "records")
+	if err := os.WriteFile(fname, []byte(records), 0o644); err != nil {
+		t.Fatal("write: " + err.Error())
+	}
+	config, err := Configure([]string{"-j", "-f", "k", "--missing", "skip", "--sum", "n", "--nonnumeric", "error",
+		"-g", "n", "-g", "k", "-v", "drop", "-v", "nothing", "-v", "skip", "-w", "3"})
+	if err != nil {
+		t.Fatal("configure: " + err.Error())
+	}
+	_, fromStream, err := config.run(context.Background(), strings.NewReader(records))
+	if err != nil {
+		t.Fatal("stream: " + err.Error())
+	}
+	config.fnames = []string{fname}
+	_, fromFile, err := config.run(context.Background(), nil)
+	if err != nil {
+		t.Fatal("file: " + err.Error())
+	}
+
+	for _, stats := range []*Stats{fromStream, fromFile} {
+		// "garbage" fails the first grep, {"n":3} the second; the "x" isn't a number, which is an error
+		if stats.Records != 8 || stats.Bytes != uint64(len(records)) || stats.KeyErrors != 1 ||
+			stats.Skipped != 0 || stats.Counted != 3 || stats.Keys != 3 {
+			t.Errorf("got %+v", *stats)
+		}
+		if len(stats.GrepRejects) != 2 || stats.GrepRejects[0] != 1 || stats.GrepRejects[1] != 1 {
+			t.Errorf("grep rejects %v", stats.GrepRejects)
+		}
+		if len(stats.VgrepRejects) != 3 || stats.VgrepRejects[0] != 1 || stats.VgrepRejects[1] != 0 ||
+			stats.VgrepRejects[2] != 1 {
+			t.Errorf("vgrep rejects %v", stats.VgrepRejects)
+		}
+	}
+
+	if len(fromStream.Segments) != 0 {
+		t.Errorf("stream has segments %v", fromStream.Segments)
+	}
+	// the segments are in order, cover the file, and add up to the totals
+	end := int64(0)
+	var segRecords, segBytes uint64
+	for _, segment := range fromFile.Segments {
+		if segment.File != fname || segment.Start != end || segment.Elapsed <= 0 {
+			t.Errorf("segment %+v after %d", segment, end)
+		}
+		end = segment.End
+		segRecords += segment.Records
+		segBytes += segment.Bytes
+	}
+	if len(fromFile.Segments) != 3 || end != int64(len(records)) || segRecords != 8 ||
+		segBytes != uint64(len(records)) {
+		t.Errorf("segments %+v", fromFile.Segments)
+	}
+
+	out := &bytes.Buffer{}
+	if err := config.writeStats(fromStream, out); err != nil {
+		t.Fatal("writeStats: " + err.Error())
+	}
+	for _, line := range []string{"records: 8 (", "rejected by --grep n: 1\n", "rejected by --vgrep nothing: 0\n",
+		"key errors: 1\n", "counted: 3\n", "distinct keys: 3\n", "elapsed: "} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("no %q in\n%s", line, out.String())
+		}
+	}
+
+	// records without the key are skipped on purpose, which isn't an error
+	config, err = Configure([]string{"-j", "-f", "k", "--missing", "skip"})
+	if err != nil {
+		t.Fatal("configure: " + err.Error())
+	}
+	_, stats, err := config.run(context.Background(), strings.NewReader(records))
+	if err != nil {
+		t.Fatal("stream: " + err.Error())
+	}
+	if stats.Skipped != 2 || stats.KeyErrors != 0 || stats.Counted != 6 {
+		t.Errorf("skipping got %+v", *stats)
+	}
+}
+
+func TestStatsAdd(t *testing.T) {
+	stats := Stats{Records: 1, GrepRejects: []uint64{1}}
+	stats.add(&Stats{Records: 2, Bytes: 10, GrepRejects: []uint64{1, 2}, VgrepRejects: []uint64{3}, KeyErrors: 4,
+		Skipped: 5, Segments: []SegmentStats{{File: "f"}}})
+	if stats.Records != 3 || stats.Bytes != 10 || len(stats.GrepRejects) != 2 || stats.GrepRejects[0] != 2 ||
+		stats.GrepRejects[1] != 2 || len(stats.VgrepRejects) != 1 || stats.VgrepRejects[0] != 3 ||
+		stats.KeyErrors != 4 || stats.Skipped != 5 || len(stats.Segments) != 1 {
+		t.Errorf("got %+v", stats)
+	}
+}
@@ -2,36 +2,246 @@ package topfew
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"errors"
-	"fmt"
 	"io"
-	"os"
+	"runtime"
 )
 
+// streamChunkSize is about how much of a stream is handed to each worker at a time when it's read in parallel
+var streamChunkSize = 1024 * 1024
+
 // fromStream reads a stream and hands each line to the top-occurrence counter. Currently only used on stdin.
-func fromStream(ioReader io.Reader, filters *filters, kf *keyFinder, size int) ([]*keyCount, error) {
+func fromStream(ctx context.Context, ioReader io.Reader, filters *filters, kf *keyFinder,
+	size int) ([]*keyCount, error) {
 	counter := newCounter(size)
+	if kf != nil && kf.weighted() {
+		counter = newWeightedCounter(size)
+	}
+	if err := countStream(ctx, ioReader, filters, kf, counter); err != nil {
+		return nil, err
+	}
+	return counter.getTop(), nil
+}
+
+// countStream is fromStream with a counter supplied by the caller
+func countStream(ctx context.Context, ioReader io.Reader, filters *filters, kf *keyFinder, counter *counter) error {
 	reader := bufio.NewReader(ioReader)
+	done := ctx.Done()
+	for {
+		select {
+		case <-done:
+			return ctx.Err()
+		default:
+		}
+		record, err := readStreamRecord(reader, kf)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		// the last line needn't end with a newline
+		if len(record) > 0 {
+			if err := countRecord(record, filters, kf, counter); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+// countStreamInParallel is countStream with the work spread over width goroutines. The stream itself has to
+// be read sequentially, but that's usually much quicker than filtering the records and extracting their keys, so
+// it's read in chunks which end at record boundaries, and the chunks are handed out to workers, each of which
+// counts into its own segmentCounter, as when a file is read in segments. The segment counters are merged into
+// counter at the end.
+func countStreamInParallel(ctx context.Context, ioReader io.Reader, filters *filters, kf *keyFinder,
+	counter *counter, width int) error {
+	if width == 0 {
+		width = runtime.NumCPU()
+	}
+	// a #Fields directive changes the fields for the records after it, so only one worker can read them
+	if width == 1 || kf.needsDirectives() {
+		return countStream(ctx, ioReader, filters, kf, counter)
+	}
+	reader := bufio.NewReaderSize(ioReader, 64*1024)
+
+	// the workers get copies of kf, so the CSV header has to be dealt with first
+	if kf.csv != nil && kf.csv.awaitingHeader {
+		header, err := readStreamRecord(reader, kf)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if len(header) == 0 {
+			return nil
+		}
+		if err := kf.setCSVHeader(header); err != nil {
+			return err
+		}
+	}
+
+	// if one worker fails, there's no point in the others or the reader carrying on
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// chunks are handed back on free once they've been counted, so that their buffers can be reused
+	chunks := make(chan []byte, width)
+	free := make(chan []byte, 2*width)
+	results := make(chan segmentResult, width)
+	for i := 0; i < width; i++ {
+		go func() {
+			segCounter := counter.newSegmentCounter()
+			kf := kf.clone()
+			var err error
+			for chunk := range chunks {
+				// once the run is stopping, the rest of the chunks are just drained
+				if err == nil && ctx.Err() == nil {
+					err = countChunk(ctx, chunk, filters, kf, segCounter)
+					if err != nil {
+						cancel()
+					}
+				}
+				select {
+				case free <- chunk[:0]:
+				default:
+				}
+			}
+			results <- segmentResult{err: err, segCounter: segCounter}
+		}()
+	}
+
+	readErr := readChunks(ctx, reader, kf.csv != nil, chunks, free)
+	close(chunks)
+	var err error
+	for i := 0; i < width; i++ {
+		res := <-results
+		if res.err != nil && err == nil {
+			err = res.err
+		}
+		counter.merge(res.segCounter)
+	}
+	// if a worker failed, the reader stopped because of that
+	if err != nil {
+		return err
+	}
+	if readErr != nil {
+		return readErr
+	}
+	return ctx.Err()
+}
+
+// readChunks reads the stream in chunks, sending them to chunks, until it ends. Buffers for the chunks are
+// taken from free, if there are any.
+func readChunks(ctx context.Context, reader *bufio.Reader, csv bool, chunks chan<- []byte, free <-chan []byte) error {
+	done := ctx.Done()
 	for {
-		record, err := reader.ReadBytes('\n')
+		var chunk []byte
+		select {
+		case chunk = <-free:
+		default:
+		}
+		chunk, err := readChunk(reader, chunk, csv)
+		if len(chunk) > 0 {
+			select {
+			case chunks <- chunk:
+			case <-done:
+				return ctx.Err()
+			}
+		}
 		if errors.Is(err, io.EOF) {
-			break
+			return nil
 		} else if err != nil {
-			return nil, err
+			return err
 		}
+	}
+}
 
-		if !filters.filterRecord(record) {
-			continue
+// readChunk reads streamChunkSize bytes, or what's left if there's less, into chunk, and then carries on to
+// the end of the record they finish in, which for CSV means a newline that isn't inside quotes. It returns
+// io.EOF when the stream has run out.
+func readChunk(reader *bufio.Reader, chunk []byte, csv bool) ([]byte, error) {
+	if cap(chunk) < streamChunkSize {
+		chunk = make([]byte, streamChunkSize)
+	}
+	n, err := io.ReadFull(reader, chunk[:streamChunkSize])
+	chunk = chunk[:n]
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	if err != nil {
+		return chunk, err
+	}
+	inQuotes := csv && csvQuoteOpen(chunk)
+	if n > 0 && chunk[n-1] == '\n' && !inQuotes {
+		return chunk, nil
+	}
+	for {
+		// ReadSlice's buffer is only good until the next read, but it's copied straight into the chunk
+		line, err := reader.ReadSlice('\n')
+		chunk = append(chunk, line...)
+		if csv && csvQuoteOpen(line) {
+			inQuotes = !inQuotes
 		}
-		keyBytes, err := kf.getKey(record)
-		if err != nil {
-			// bypass
-			_, _ = fmt.Fprintf(os.Stderr, "Can't extract Key from %s\n", string(record))
+		if errors.Is(err, bufio.ErrBufferFull) {
 			continue
 		}
-		keyBytes = filters.filterField(keyBytes)
+		if err != nil || !inQuotes {
+			return chunk, err
+		}
+	}
+}
 
-		counter.add(keyBytes)
+// countChunk filters the records in a chunk of a stream, or a segment of a mapped file, and adds their keys to
+// the segment's counts
+func countChunk(ctx context.Context, chunk []byte, filters *filters, kf *keyFinder, segCounter recordCounter) error {
+	done := ctx.Done()
+	for len(chunk) > 0 {
+		select {
+		case <-done:
+			return ctx.Err()
+		default:
+		}
+		var record []byte
+		record, chunk = nextRecord(chunk, kf.csv != nil)
+		if err := countRecord(record, filters, kf, segCounter); err != nil {
+			return err
+		}
 	}
-	return counter.getTop(), nil
+	return nil
+}
+
+// nextRecord splits the first record, including its newline, off the front of a chunk
+func nextRecord(chunk []byte, csv bool) ([]byte, []byte) {
+	end := 0
+	inQuotes := false
+	for end < len(chunk) {
+		lineEnd := bytes.IndexByte(chunk[end:], '\n') + 1
+		if lineEnd == 0 {
+			lineEnd = len(chunk) - end
+		}
+		if csv && csvQuoteOpen(chunk[end:end+lineEnd]) {
+			inQuotes = !inQuotes
+		}
+		end += lineEnd
+		if !inQuotes {
+			break
+		}
+	}
+	// the record can't have room to grow, because appending to it would write over the next one, or into a
+	//  mapped file
+	return chunk[:end:end], chunk[end:]
+}
+
+// readStreamRecord reads the next record, which is normally a line, but CSV records can span lines
+func readStreamRecord(reader *bufio.Reader, kf *keyFinder) ([]byte, error) {
+	record, err := reader.ReadBytes('\n')
+	if err == nil && kf.csv != nil && csvQuoteOpen(record) {
+		record, err = readCSVContinuation(reader, record)
+		if errors.Is(err, io.EOF) {
+			// the last record is unterminated, but it's complete, so count it
+			err = nil
+		}
+	}
+	return record, err
 }
@@ -2,6 +2,7 @@ package topfew
 
 import (
 	"bufio"
+	"context"
 	"os"
 	"strings"
 	"testing"
@@ -14,7 +15,7 @@ func TestBadStreamReader(t *testing.T) {
 		t.Error("config!")
 	}
 	cer := newCER("testing stream")
-	_, err = fromStream(cer, &c.filter, nil, c.size)
+	_, err = fromStream(context.Background(), cer, &c.filter, nil, c.size)
 	if err == nil {
 		t.Error("survived err from Read")
 	}
@@ -50,7 +51,7 @@ func Test1KLinesStream(t *testing.T) {
 
 	kf := newKeyFinder([]uint{1}, nil, false)
 	f := filters{nil, nil, nil}
-	x, err := fromStream(file, &f, kf, 5)
+	x, err := fromStream(context.Background(), file, &f, kf, 5)
 	if err != nil {
 		t.Error("OUCH: " + err.Error())
 	}
@@ -72,3 +73,81 @@ func Test1KLinesStream(t *testing.T) {
 		}
 	}
 }
+
+func TestStreamInParallel(t *testing.T) {
+	// small chunks, so that there are lots of them and they often end mid-line
+	saveChunkSize := streamChunkSize
+	defer func() { streamChunkSize = saveChunkSize }()
+
+	small, err := os.ReadFile("../test/data/small")
+	if err != nil {
+		t.Fatal("read: " + err.Error())
+	}
+	csv := "name,notes,country\n" +
+		"a,\"one\nline\",CA\n" +
+		"b,\"two\n\"\"lines\"\"\n\",US\n" +
+		"c,plain,CA\n" +
+		"d,\"\",CA\n" +
+		"e,\"x,\ny\",MX\n" +
+		"f,,US"
+	tests := []struct {
+		records string
+		args    []string
+	}{
+		{string(small), []string{"-f", "1", "-n", "1000"}},
+		{string(small), []string{"-f", "7", "-g", "POST", "-n", "1000"}},
+		{"a\nb\na\nc\nb\na", []string{}},
+		{csv, []string{"--csv", "-f", "country"}},
+	}
+	for _, test := range tests {
+		for _, size := range []int{1, 7, 100, 1024 * 1024} {
+			streamChunkSize = size
+			var outputs []string
+			var stats []*Stats
+			for _, width := range []string{"1", "4"} {
+				out, runStats := runSorted(t, strings.NewReader(test.records), append(test.args, "-w", width)...)
+				outputs = append(outputs, out)
+				stats = append(stats, runStats)
+			}
+			if outputs[0] != outputs[1] || stats[0].Records != stats[1].Records || stats[0].Bytes != stats[1].Bytes {
+				t.Errorf("%v chunk %d: sequential got %+v\n%s\nparallel got %+v\n%s", test.args, size,
+					*stats[0], outputs[0], *stats[1], outputs[1])
+			}
+		}
+	}
+
+	// a failure in one worker stops the run
+	streamChunkSize = 10
+	config, _ := Configure([]string{"-f", "2", "--on-error", "fail", "-w", "4"})
+	_, _, err = config.run(context.Background(), strings.NewReader(strings.Repeat("a b\n", 1000)+"c\n"+
+		strings.Repeat("a b\n", 1000)))
+	if err == nil || err.Error() != "can't extract key from c: not enough bytes in record" {
+		t.Errorf("fail got %v", err)
+	}
+
+	// as does the reader failing
+	config, _ = Configure([]string{"-w", "4"})
+	cer := newCER("testing parallel stream")
+	if _, _, err = config.run(context.Background(), cer); err == nil || err.Error() != cer.nonce {
+		t.Errorf("bad reader got %v", err)
+	}
+}
+
+// TestStreamCountsUnterminatedLastLine checks that a stream's last record is counted even though there's no
+// newline after it, whether the stream is read sequentially or in parallel
+func TestStreamCountsUnterminatedLastLine(t *testing.T) {
+	for _, args := range [][]string{{"-w", "1"}, {"-w", "4"}, {"--csv", "-w", "1"}, {"--csv", "-w", "4"}} {
+		config, err := Configure(args)
+		if err != nil {
+			t.Fatal("configure: " + err.Error())
+		}
+		counts, stats, err := config.run(context.Background(), strings.NewReader("a\nb\na\nc\na"))
+		if err != nil {
+			t.Fatal("run: " + err.Error())
+		}
+		if len(counts) != 3 || counts[0].Key != "a" || *counts[0].Count != 3 || stats.Records != 5 {
+			t.Errorf("%v: got %d keys, first %s=%d, %d records", args, len(counts), counts[0].Key,
+				*counts[0].Count, stats.Records)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package topfew
+
+// With --window, each record's time is taken from its --time field, and there's a top list for each window
+//  of time rather than one for the whole input. Time is divided into panes, which are as long as --slide if
+//  there is one, or the window otherwise, aligned to the Unix epoch. Each pane is a partition, see
+//  partition.go. A tumbling window is a single pane; a sliding window adds up the counts from the panes it
+//  covers.
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how timestamps are written
+const (
+	timeLayout    = iota // a Go time layout
+	timeApache           // [12/Mar/2007:08:04:39 -0800], with or without the brackets and zone
+	timeUnix             // seconds since 1970, possibly with a fraction
+	timeUnixMilli        // milliseconds since 1970
+	timeSyslog           // Mar  1 12:34:56, in the current year, or RFC 3339
+)
+
+const syslogLayout = "Jan _2 15:04:05"
+
+const apacheLayout = "02/Jan/2006:15:04:05 -0700"
+
+type timeFormat struct {
+	kind   int
+	layout string
+}
+
+// parseTimeFormat turns the --time-format argument into a timeFormat. Anything other than the names of the
+// built-in formats is taken to be a Go time layout, which has to contain at least one of its elements.
+func parseTimeFormat(s string) (timeFormat, error) {
+	switch s {
+	case "", "rfc3339":
+		return timeFormat{kind: timeLayout, layout: time.RFC3339Nano}, nil
+	case "apache", "clf":
+		return timeFormat{kind: timeApache}, nil
+	case "unix":
+		return timeFormat{kind: timeUnix}, nil
+	case "unixms":
+		return timeFormat{kind: timeUnixMilli}, nil
+	case "syslog":
+		return timeFormat{kind: timeSyslog}, nil
+	}
+	if time.Unix(0, 0).UTC().Format(s) == s {
+		return timeFormat{}, fmt.Errorf("--time-format \"%s\" isn't a known format or a Go time layout", s)
+	}
+	return timeFormat{kind: timeLayout, layout: s}, nil
+}
+
+// parse reads a timestamp; if it doesn't say what time zone it's in, it's taken to be UTC
+func (tf timeFormat) parse(field []byte) (time.Time, error) {
+	s := string(field)
+	switch tf.kind {
+	case timeApache:
+		s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+		if strings.IndexByte(s, ' ') == -1 {
+			return time.Parse(apacheLayout[:len(apacheLayout)-6], s)
+		}
+		return time.Parse(apacheLayout, s)
+	case timeUnix, timeUnixMilli:
+		value, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if tf.kind == timeUnixMilli {
+			value /= 1000
+		}
+		seconds := int64(value)
+		return time.Unix(seconds, int64((value-float64(seconds))*1e9)), nil
+	case timeSyslog:
+		if s != "" && s[0] >= '0' && s[0] <= '9' {
+			return time.Parse(time.RFC3339Nano, s)
+		}
+		t, err := time.Parse(syslogLayout, s)
+		return t.AddDate(time.Now().Year(), 0, 0), err
+	}
+	return time.Parse(tf.layout, s)
+}
+
+// paneGetter gets the start of the pane the --time field falls in; panes are as long as the --window, or the
+// --slide if there is one
+type paneGetter struct {
+	field  *keyFinder
+	format timeFormat
+	length time.Duration
+}
+
+func (p *paneGetter) get(record []byte, fields *recordFields) error {
+	pane, err := p.getPane(record)
+	fields.pane, fields.hasPane = pane, true
+	return err
+}
+
+func (p *paneGetter) finders() []*keyFinder {
+	return []*keyFinder{p.field}
+}
+
+func (p *paneGetter) clone() fieldGetter {
+	return &paneGetter{field: p.field.clone(), format: p.format, length: p.length}
+}
+
+// getPane returns the start of the pane that the record's time falls in, in nanoseconds since 1970
+func (p *paneGetter) getPane(record []byte) (int64, error) {
+	field, err := p.field.getKey(record)
+	if err != nil {
+		return 0, err
+	}
+	t, err := p.format.parse(field)
+	if err != nil {
+		return 0, fmt.Errorf("can't read time \"%s\"", field)
+	}
+	nanos := t.UnixNano()
+	length := int64(p.length)
+	start := nanos - nanos%length
+	if nanos < 0 && start != nanos {
+		start -= length
+	}
+	return start, nil
+}
+
+// parseWindow sets up the --time field and checks the --window and --slide durations
+func (config *config) parseWindow(opts *Options) error {
+	var err error
+	// a --format says where the time is and how it's written
+	timeSpec, timeFormat := opts.Time, opts.TimeFormat
+	if config.format != nil {
+		if timeSpec == "" && opts.Window != 0 {
+			timeSpec = config.format.timeField
+		}
+		if timeFormat == "" {
+			timeFormat = config.format.timeFormat
+		}
+	}
+	switch {
+	case opts.Window < 0 || opts.Slide < 0:
+		return errors.New("--window and --slide must be positive")
+	case timeSpec == "" || opts.Window == 0:
+		return errors.New("--time and --window must be used together")
+	case opts.Slide > opts.Window || (opts.Slide > 0 && opts.Window%opts.Slide != 0):
+		return errors.New("--window must be a multiple of --slide")
+	case opts.MaxKeys > 0:
+		return errors.New("--window may not be combined with --max-keys")
+	}
+	config.window = opts.Window
+	config.slide = opts.Slide
+	config.timeFormat, err = parseTimeFormat(timeFormat)
+	if err != nil {
+		return err
+	}
+	config.time, err = config.parseFieldSpec(timeSpec, opts)
+	return err
+}
@@ -0,0 +1,131 @@
+package topfew
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeFormats(t *testing.T) {
+	cases := []struct {
+		format string
+		field  string
+		wanted string
+	}{
+		{"", "2007-03-12T08:04:39Z", "2007-03-12T08:04:39Z"},
+		{"rfc3339", "2007-03-12T08:04:39.25-08:00", "2007-03-12T16:04:39.25Z"},
+		{"apache", "[12/Mar/2007:08:04:39 -0800]", "2007-03-12T16:04:39Z"},
+		{"apache", "12/Mar/2007:08:04:39 +0100", "2007-03-12T07:04:39Z"},
+		{"clf", "[12/Mar/2007:08:04:39", "2007-03-12T08:04:39Z"},
+		{"unix", "1173686679", "2007-03-12T08:04:39Z"},
+		{"unix", "1173686679.5", "2007-03-12T08:04:39.5Z"},
+		{"unixms", "1173686679500", "2007-03-12T08:04:39.5Z"},
+		{"2006-01-02 15:04", "2007-03-12 08:04", "2007-03-12T08:04:00Z"},
+	}
+	for _, c := range cases {
+		tf, err := parseTimeFormat(c.format)
+		if err != nil {
+			t.Errorf("format %s: %s", c.format, err.Error())
+			continue
+		}
+		parsed, err := tf.parse([]byte(c.field))
+		if err != nil {
+			t.Errorf("%s as %s: %s", c.field, c.format, err.Error())
+			continue
+		}
+		if got := parsed.UTC().Format(time.RFC3339Nano); got != c.wanted {
+			t.Errorf("%s as %s: got %s wanted %s", c.field, c.format, got, c.wanted)
+		}
+	}
+
+	if _, err := parseTimeFormat("yesterday"); err == nil {
+		t.Error("accepted bogus format")
+	}
+	tf, _ := parseTimeFormat("apache")
+	for _, bad := range []string{"", "12/Mar/2007", "[12/Foo/2007:08:04:39 -0800]"} {
+		if _, err := tf.parse([]byte(bad)); err == nil {
+			t.Errorf("parsed bogus time %s", bad)
+		}
+	}
+}
+
+func TestPanes(t *testing.T) {
+	pg := &paneGetter{field: newKeyFinder([]uint{1}, nil, false), format: timeFormat{kind: timeUnix},
+		length: time.Minute}
+	cases := map[string]int64{"0": 0, "59.9": 0, "60": 60, "119": 60, "-1": -60, "-60": -60, "-61": -120}
+	for record, wanted := range cases {
+		pane, err := pg.getPane([]byte(record + "\n"))
+		if err != nil {
+			t.Errorf("%s: %s", record, err.Error())
+		} else if pane != wanted*int64(time.Second) {
+			t.Errorf("%s: got pane %d wanted %ds", record, pane, wanted)
+		}
+	}
+}
+
+func TestWindows(t *testing.T) {
+	records := `1.1.1.1 - - [12/Mar/2007:08:04:39 -0800] "GET /a HTTP/1.1" 200 10
+2.2.2.2 - - [12/Mar/2007:08:14:39 -0800] "GET /a HTTP/1.1" 200 10
+2.2.2.2 - - [12/Mar/2007:08:24:39 -0800] "GET /b HTTP/1.1" 200 10
+1.1.1.1 - - [12/Mar/2007:09:04:39 -0800] "GET /b HTTP/1.1" 200 30
+3.3.3.3 - - [12/Mar/2007:09:30:00 -0800] "GET /c HTTP/1.1" 200 10
+3.3.3.3 - - [12/Mar/2007:09:59:59 -0800] "GET /c HTTP/1.1" 200 10
+3.3.3.3 - - [12/Mar/2007:10:00:00 -0800] "GET /c HTTP/1.1" 200 15
+3.3.3.3 - - [12/Mar/2007:11:30:00 -0800] "GET /c HTTP/1.1" 200 10
+1.1.1.1 - - [not a time] "GET /c HTTP/1.1" 200 10
+`
+	got := runBoth(t, records, "-f", "1", "--time", "4,5", "--time-format", "apache", "--window", "1h")
+	wanted := `2007-03-12T16:00:00Z to 2007-03-12T17:00:00Z
+2 2.2.2.2
+1 1.1.1.1
+
+2007-03-12T17:00:00Z to 2007-03-12T18:00:00Z
+2 3.3.3.3
+1 1.1.1.1
+
+2007-03-12T18:00:00Z to 2007-03-12T19:00:00Z
+1 3.3.3.3
+
+2007-03-12T19:00:00Z to 2007-03-12T20:00:00Z
+1 3.3.3.3
+`
+	if got != wanted {
+		t.Errorf("tumbling windows got\n%s", got)
+	}
+
+	got = runBoth(t, records, "-f", "1", "-n", "1", "--time", "4,5", "--time-format", "apache",
+		"--window", "2h", "--slide", "1h", "--sum", "10")
+	wanted = `2007-03-12T15:00:00Z to 2007-03-12T17:00:00Z
+20 2.2.2.2
+
+2007-03-12T16:00:00Z to 2007-03-12T18:00:00Z
+40 1.1.1.1
+
+2007-03-12T17:00:00Z to 2007-03-12T19:00:00Z
+35 3.3.3.3
+
+2007-03-12T18:00:00Z to 2007-03-12T20:00:00Z
+25 3.3.3.3
+
+2007-03-12T19:00:00Z to 2007-03-12T21:00:00Z
+10 3.3.3.3
+`
+	if got != wanted {
+		t.Errorf("sliding windows got\n%s", got)
+	}
+
+	csvRecords := "when,who\n2007-03-12T08:04:39Z,a\n2007-03-12T08:05:00Z,b\n2007-03-12T08:05:59Z,b\n"
+	got = runBoth(t, csvRecords, "--csv", "-f", "who", "--time", "when", "--window", "1m", "--output", "csv")
+	wanted = "window,count,key\n2007-03-12T08:04:00Z,1,a\n2007-03-12T08:05:00Z,2,b\n"
+	if got != wanted {
+		t.Errorf("CSV windows got\n%s", got)
+	}
+
+	jsonRecords := "{\"t\":1173686679,\"k\":\"a\"}\n{\"t\":1173686700,\"k\":\"b\"}\n"
+	got = runBoth(t, jsonRecords, "-j", "-f", "k", "--time", "t", "--time-format", "unix", "--window", "1m",
+		"--output", "json")
+	wanted = "[\n{\"window\":\"2007-03-12T08:04:00Z\",\"count\":1,\"key\":\"a\"},\n" +
+		"{\"window\":\"2007-03-12T08:05:00Z\",\"count\":1,\"key\":\"b\"}\n]\n"
+	if got != wanted {
+		t.Errorf("JSON windows got\n%s", got)
+	}
+}
@@ -0,0 +1,280 @@
+package topfew
+
+// --transform rewrites the fields of the key before they're counted, so that, for example, IP addresses can be
+//  counted by subnet, or URLs without their query strings. Each --transform is a field from the field list, or a
+//  --extract group, then =, then a comma-separated pipeline of named transforms, as in path=urlpath,lower;
+//  without a field, the pipeline applies to every field. The transforms are applied after --extract and before
+//  --sed. To tell where the fields are, the keyFinder joins them with fieldJoiner, and the transformer rejoins
+//  them with the joiner the key would otherwise have had. A value a transform doesn't apply to, like an IP
+//  address that isn't one, is left as it is.
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// keyTransform appends a transformed field to dst, which won't overlap field
+type keyTransform func(dst, field []byte) []byte
+
+// transformNames are the transforms --transform knows, for error messages
+const transformNames = "lower, upper, trim, urlpath, urlhost, ipmask:bits, truncate:length, or hash"
+
+// parseKeyTransform turns a transform like ipmask:24 into a keyTransform
+func parseKeyTransform(s string) (keyTransform, error) {
+	name, arg, hasArg := strings.Cut(s, ":")
+	var transform keyTransform
+	switch name {
+	case "lower":
+		transform = func(dst, field []byte) []byte { return append(dst, bytes.ToLower(field)...) }
+	case "upper":
+		transform = func(dst, field []byte) []byte { return append(dst, bytes.ToUpper(field)...) }
+	case "trim":
+		transform = func(dst, field []byte) []byte { return append(dst, bytes.TrimSpace(field)...) }
+	case "urlpath":
+		transform = urlPath
+	case "urlhost":
+		transform = urlHost
+	case "hash":
+		transform = hashField
+	case "ipmask":
+		return parseIPMask(arg)
+	case "truncate":
+		length, err := strconv.Atoi(arg)
+		if err != nil || length < 1 {
+			return nil, fmt.Errorf("truncate needs a positive length, not \"%s\"", arg)
+		}
+		return func(dst, field []byte) []byte { return append(dst, truncateField(field, length)...) }, nil
+	default:
+		return nil, fmt.Errorf("unknown transform \"%s\", must be one of %s", s, transformNames)
+	}
+	if hasArg {
+		return nil, fmt.Errorf("transform %s doesn't take an argument", name)
+	}
+	return transform, nil
+}
+
+// parseIPMask sets up ipmask:bits, which replaces an IPv4 address with its subnet of that many bits, as in
+// 192.0.2.0/24; ipmask:bits:bits6 also gives the bits for IPv6 addresses, which are otherwise 64
+func parseIPMask(arg string) (keyTransform, error) {
+	v4, v6, hasV6 := strings.Cut(arg, ":")
+	bits4, err := strconv.Atoi(v4)
+	if err != nil || bits4 < 0 || bits4 > 32 {
+		return nil, fmt.Errorf("ipmask needs an IPv4 prefix length from 0 to 32, not \"%s\"", v4)
+	}
+	bits6 := 64
+	if hasV6 {
+		bits6, err = strconv.Atoi(v6)
+		if err != nil || bits6 < 0 || bits6 > 128 {
+			return nil, fmt.Errorf("ipmask needs an IPv6 prefix length from 0 to 128, not \"%s\"", v6)
+		}
+	}
+	return func(dst, field []byte) []byte {
+		addr, err := netip.ParseAddr(string(field))
+		if err != nil {
+			return append(dst, field...)
+		}
+		addr = addr.Unmap()
+		bits := bits6
+		if addr.Is4() {
+			bits = bits4
+		}
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			return append(dst, field...)
+		}
+		return prefix.AppendTo(dst)
+	}, nil
+}
+
+// urlPath is the path of a URL, which may be absolute, without its query or fragment
+func urlPath(dst, field []byte) []byte {
+	if start, end := urlAuthority(field); start >= 0 {
+		field = field[end:]
+		if len(field) == 0 || field[0] != '/' {
+			return append(dst, '/')
+		}
+	}
+	if end := bytes.IndexAny(field, "?#"); end >= 0 {
+		field = field[:end]
+	}
+	return append(dst, field...)
+}
+
+// urlHost is the host of an absolute URL, in lower case, without any user or port
+func urlHost(dst, field []byte) []byte {
+	start, end := urlAuthority(field)
+	if start < 0 {
+		return append(dst, field...)
+	}
+	host := field[start:end]
+	if at := bytes.LastIndexByte(host, '@'); at >= 0 {
+		host = host[at+1:]
+	}
+	if len(host) > 0 && host[0] == '[' {
+		if end := bytes.IndexByte(host, ']'); end > 0 {
+			host = host[1:end]
+		}
+	} else if colon := bytes.LastIndexByte(host, ':'); colon >= 0 {
+		host = host[:colon]
+	}
+	return append(dst, bytes.ToLower(host)...)
+}
+
+// urlAuthority returns where the part between the // and the path of an absolute URL like http://example.com/
+// starts and ends, or -1, -1 if it isn't one
+func urlAuthority(field []byte) (int, int) {
+	start := bytes.Index(field, []byte("//"))
+	if start < 0 || bytes.IndexAny(field[:start], "/?#") >= 0 {
+		return -1, -1
+	}
+	start += 2
+	end := bytes.IndexAny(field[start:], "/?#")
+	if end < 0 {
+		end = len(field)
+	} else {
+		end += start
+	}
+	if end == start {
+		return -1, -1
+	}
+	return start, end
+}
+
+// hashField replaces a field with the hex of its 64-bit FNV-1a hash, which is the same from run to run, so keys
+// can be anonymized and still compared
+func hashField(dst, field []byte) []byte {
+	h := fnv.New64a()
+	_, _ = h.Write(field)
+	var sum [8]byte
+	return append(dst, hex.EncodeToString(h.Sum(sum[:0]))...)
+}
+
+// truncateField returns the first length characters of a field
+func truncateField(field []byte, length int) []byte {
+	end := 0
+	for i := 0; i < length && end < len(field); i++ {
+		_, size := utf8.DecodeRune(field[end:])
+		end += size
+	}
+	return field[:end]
+}
+
+// parseTransforms turns the --transform arguments into a pipeline for each field of the key, which are named
+// by names, the fields in the field list as given and as they're named in the output
+func parseTransforms(specs []string, names [][]string) ([][]keyTransform, error) {
+	parts := len(names)
+	if parts == 0 {
+		parts = 1
+	}
+	pipelines := make([][]keyTransform, parts)
+	for _, spec := range specs {
+		field, list := "", spec
+		if equals := strings.LastIndexByte(spec, '='); equals == 0 {
+			return nil, fmt.Errorf("invalid --transform %s: no field before =", spec)
+		} else if equals > 0 {
+			field, list = spec[:equals], spec[equals+1:]
+		}
+		var transforms []keyTransform
+		for _, name := range strings.Split(list, ",") {
+			transform, err := parseKeyTransform(name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid --transform %s: %w", spec, err)
+			}
+			transforms = append(transforms, transform)
+		}
+		if field == "" {
+			for part := range pipelines {
+				pipelines[part] = append(pipelines[part], transforms...)
+			}
+			continue
+		}
+		part := transformField(field, names)
+		if part < 0 {
+			return nil, fmt.Errorf("invalid --transform %s: \"%s\" isn't one of the key's fields", spec, field)
+		}
+		pipelines[part] = append(pipelines[part], transforms...)
+	}
+	return pipelines, nil
+}
+
+// keyFieldNames gives the names each field of the key can be called by in a --transform: the --extract group
+// names if there's a regexp, otherwise the field as it's given in the field list, and as it's named in the
+// output, so 3 or field3
+func keyFieldNames(spec string, extract *regexp.Regexp) [][]string {
+	var names [][]string
+	if extract != nil {
+		for _, name := range extractFieldNames(extract) {
+			names = append(names, []string{name})
+		}
+		return names
+	}
+	if spec == "" {
+		return nil
+	}
+	outputNames := outputFieldNames(spec)
+	for i, field := range strings.Split(spec, ",") {
+		names = append(names, []string{field, outputNames[i]})
+	}
+	return names
+}
+
+// transformField returns the position in the key of the field a --transform names, or -1
+func transformField(field string, names [][]string) int {
+	for part, aliases := range names {
+		for _, name := range aliases {
+			if name == field {
+				return part
+			}
+		}
+	}
+	return -1
+}
+
+// transformer applies the --transform pipelines to the fields of keys, which are joined with fieldJoiner, and
+// joins the results with joiner; like keyFinder, it reuses its storage, so isn't thread-safe
+type transformer struct {
+	pipelines [][]keyTransform
+	joiner    byte
+	key       []byte
+	buffers   [2][]byte
+}
+
+func newTransformer(pipelines [][]keyTransform, joiner byte) *transformer {
+	return &transformer{pipelines: pipelines, joiner: joiner, key: make([]byte, 0, 128)}
+}
+
+func (t *transformer) clone() *transformer {
+	return newTransformer(t.pipelines, t.joiner)
+}
+
+// transform applies each field's pipeline; if the key has more fields than there are pipelines, the extra
+// ones are part of the last field, as they are in the output
+func (t *transformer) transform(key []byte) []byte {
+	t.key = t.key[:0]
+	for part, pipeline := range t.pipelines {
+		field := key
+		if part < len(t.pipelines)-1 {
+			if end := bytes.IndexByte(key, fieldJoiner); end >= 0 {
+				field, key = key[:end], key[end+1:]
+			} else {
+				key = nil
+			}
+		}
+		if part > 0 {
+			t.key = append(t.key, t.joiner)
+		}
+		for i, transform := range pipeline {
+			t.buffers[i%2] = transform(t.buffers[i%2][:0], field)
+			field = t.buffers[i%2]
+		}
+		t.key = append(t.key, field...)
+	}
+	return t.key
+}
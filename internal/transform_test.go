@@ -0,0 +1,103 @@
+package topfew
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestKeyTransforms(t *testing.T) {
+	tests := []struct {
+		transform string
+		field     string
+		wanted    string
+	}{
+		{"lower", "GET /Ünïcode", "get /ünïcode"},
+		{"upper", "get", "GET"},
+		{"trim", " \tx y \r", "x y"},
+		{"urlpath", "/a/b?c=d#e", "/a/b"},
+		{"urlpath", "https://user@example.com:8443/a/b/?q", "/a/b/"},
+		{"urlpath", "https://example.com?q", "/"},
+		{"urlpath", "-", "-"},
+		{"urlpath", "/redirect?to=http://x.com/", "/redirect"},
+		{"urlhost", "https://user@Example.COM:8443/a", "example.com"},
+		{"urlhost", "http://[2001:db8::1]:8080/", "2001:db8::1"},
+		{"urlhost", "//cdn.example.com/x.js", "cdn.example.com"},
+		{"urlhost", "/a/b?c=http://x.com", "/a/b?c=http://x.com"},
+		{"urlhost", "-", "-"},
+		{"ipmask:24", "192.0.2.77", "192.0.2.0/24"},
+		{"ipmask:16", "::ffff:192.0.2.77", "192.0.0.0/16"},
+		{"ipmask:24", "2001:db8:1:2:3::4", "2001:db8:1:2::/64"},
+		{"ipmask:24:32", "2001:db8:1:2:3::4", "2001:db8::/32"},
+		{"ipmask:32", "unknown", "unknown"},
+		{"truncate:3", "abcdef", "abc"},
+		{"truncate:3", "ab", "ab"},
+		{"truncate:2", "éèê", "éè"},
+		{"hash", "192.0.2.77", "50c45982dc13b867"},
+	}
+	for _, test := range tests {
+		transform, err := parseKeyTransform(test.transform)
+		if err != nil {
+			t.Fatalf("%s: %s", test.transform, err.Error())
+		}
+		// appended to what's already there
+		got := string(transform([]byte("x"), []byte(test.field)))
+		if got != "x"+test.wanted {
+			t.Errorf("%s %q: got %q", test.transform, test.field, got)
+		}
+	}
+
+	for _, bad := range []string{"", "nope", "lower:1", "ipmask", "ipmask:33", "ipmask:24:129", "ipmask:x",
+		"truncate", "truncate:0", "truncate:x"} {
+		if _, err := parseKeyTransform(bad); err == nil {
+			t.Errorf("accepted %s", bad)
+		}
+	}
+}
+
+func TestTransformPipelines(t *testing.T) {
+	names := keyFieldNames("1,path,3-4", nil)
+	pipelines, err := parseTransforms([]string{"path=urlpath,upper", "field3-4=truncate:3", "1=lower", "trim"}, names)
+	if err != nil {
+		t.Fatal("parse: " + err.Error())
+	}
+	tr := newTransformer(pipelines, ' ')
+	key := []byte("A B\x1f /x/y?z \x1fabcdef")
+	if got := string(tr.transform(key)); got != "a b /X/Y abc" {
+		t.Errorf("got %q", got)
+	}
+	if got := string(tr.clone().transform([]byte("C\x1f/\x1f"))); got != "c / " {
+		t.Errorf("clone got %q", got)
+	}
+
+	// the whole record is one field, and --extract groups are named
+	pipelines, _ = parseTransforms([]string{"lower"}, keyFieldNames("", nil))
+	if got := string(newTransformer(pipelines, ' ').transform([]byte("X\x1fY"))); got != "x\x1fy" {
+		t.Errorf("record got %q", got)
+	}
+	names = keyFieldNames("2", regexp.MustCompile(`(?P<dir>/\w+)(/\w+)`))
+	if len(names) != 1 || names[0][0] != "dir" {
+		t.Errorf("extract names %v", names)
+	}
+
+	for _, bad := range [][]string{{"4=lower"}, {"=lower"}, {"path=lower,"}, {"field2=lower"}} {
+		if _, err := parseTransforms(bad, keyFieldNames("1,path,3-4", nil)); err == nil {
+			t.Errorf("accepted %v", bad)
+		}
+	}
+}
+
+func TestTransformRuns(t *testing.T) {
+	records := `1.1.1.1 - - [12/Mar/2007:08:04:39 -0800] "GET /a?x=1 HTTP/1.1" 200 10 "http://A.com/p" "curl"
+1.1.1.9 - - [12/Mar/2007:08:04:40 -0800] "GET /a?x=2 HTTP/1.1" 200 10 "http://a.com/q" "curl"
+1.1.2.9 - - [12/Mar/2007:08:04:41 -0800] "GET /b HTTP/1.1" 200 10 "-" "curl"
+`
+	if got := runBoth(t, records, "--format", "nginx", "-f", "ip,path", "--transform", "ip=ipmask:24",
+		"--transform", "path=urlpath"); got != "2 1.1.1.0/24 /a\n1 1.1.2.0/24 /b\n" {
+		t.Errorf("ip and path got\n%s", got)
+	}
+	// --sed sees the transformed key
+	if got := runBoth(t, records, "-q", "-f", "9", "--transform", "urlhost", "-s", "^-$", "none"); got !=
+		"2 a.com\n1 none\n" {
+		t.Errorf("referer got\n%s", got)
+	}
+}
@@ -0,0 +1,205 @@
+package topfew
+
+// With --value, each key's tally also summarizes the numeric values of another field, for example response
+//  times: the minimum, maximum, mean, and total exactly, and the 50th, 90th, and 99th percentiles from a
+//  quantileSketch. The sketch follows DDSketch: each value goes into a bucket whose bounds are successive
+//  powers of gamma, so any value in a bucket is within 1% of the bucket's midpoint. There are only a few
+//  hundred buckets between a millisecond and an hour, and sketches are merged by adding up their buckets,
+//  so segments are counted in parallel just as usual.
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+// quantileAccuracy is how close, relatively, the percentiles are to values that were actually seen
+const quantileAccuracy = 0.01
+
+var (
+	quantileGamma    = (1 + quantileAccuracy) / (1 - quantileAccuracy)
+	quantileLogGamma = math.Log(quantileGamma)
+)
+
+// ValueStats summarizes the values of the --value field in the records with a key. N is how many there
+// were, not counting any that weren't numbers. The percentiles are within 1% of values that were seen.
+type ValueStats struct {
+	N     uint64
+	Min   float64
+	Max   float64
+	Mean  float64
+	Total float64
+	P50   float64
+	P90   float64
+	P99   float64
+}
+
+// valueStats accumulates the ValueStats for a key
+type valueStats struct {
+	n         uint64
+	min       float64
+	max       float64
+	total     float64
+	quantiles *quantileSketch
+}
+
+// quantileSketch counts values in buckets by the logarithm of their magnitude
+type quantileSketch struct {
+	positive map[int]uint64
+	negative map[int]uint64
+	zeros    uint64
+}
+
+func newValueStats() *valueStats {
+	return &valueStats{
+		min:       math.Inf(1),
+		max:       math.Inf(-1),
+		quantiles: &quantileSketch{positive: make(map[int]uint64), negative: make(map[int]uint64)},
+	}
+}
+
+// valueGetter gets the --value field's value, if it's a number
+type valueGetter struct {
+	field *keyFinder
+}
+
+func (v *valueGetter) get(record []byte, fields *recordFields) error {
+	field, err := v.field.getKey(record)
+	if err != nil {
+		return err
+	}
+	value, err := strconv.ParseFloat(string(field), 64)
+	if err == nil && !math.IsNaN(value) && !math.IsInf(value, 0) {
+		fields.value, fields.hasValue = value, true
+	}
+	return nil
+}
+
+func (v *valueGetter) finders() []*keyFinder {
+	return []*keyFinder{v.field}
+}
+
+func (v *valueGetter) clone() fieldGetter {
+	return &valueGetter{field: v.field.clone()}
+}
+
+func (v *valueStats) add(value float64) {
+	v.n++
+	v.total += value
+	if value < v.min {
+		v.min = value
+	}
+	if value > v.max {
+		v.max = value
+	}
+	v.quantiles.add(value)
+}
+
+func (v *valueStats) merge(other *valueStats) {
+	v.n += other.n
+	v.total += other.total
+	if other.min < v.min {
+		v.min = other.min
+	}
+	if other.max > v.max {
+		v.max = other.max
+	}
+	v.quantiles.merge(other.quantiles)
+}
+
+// clone returns a copy of v which can be changed without affecting it
+func (v *valueStats) clone() *valueStats {
+	clone := newValueStats()
+	clone.merge(v)
+	return clone
+}
+
+// summary returns the ValueStats, or nil if there weren't any numeric values
+func (v *valueStats) summary() *ValueStats {
+	if v == nil || v.n == 0 {
+		return nil
+	}
+	return &ValueStats{
+		N:     v.n,
+		Min:   v.min,
+		Max:   v.max,
+		Mean:  v.total / float64(v.n),
+		Total: v.total,
+		P50:   v.quantile(0.5),
+		P90:   v.quantile(0.9),
+		P99:   v.quantile(0.99),
+	}
+}
+
+// quantile estimates the value which the fraction q of the values are below; the estimate can't be outside
+// the range of the values that were seen
+func (v *valueStats) quantile(q float64) float64 {
+	estimate := v.quantiles.quantile(q, v.n)
+	return math.Max(v.min, math.Min(v.max, estimate))
+}
+
+func bucketIndex(magnitude float64) int {
+	return int(math.Ceil(math.Log(magnitude) / quantileLogGamma))
+}
+
+// bucketValue is the midpoint of a bucket, in the sense that it's within quantileAccuracy of both ends
+func bucketValue(index int) float64 {
+	return 2 * math.Pow(quantileGamma, float64(index)) / (quantileGamma + 1)
+}
+
+func (s *quantileSketch) add(value float64) {
+	switch {
+	case value > 0:
+		s.positive[bucketIndex(value)]++
+	case value < 0:
+		s.negative[bucketIndex(-value)]++
+	default:
+		s.zeros++
+	}
+}
+
+func (s *quantileSketch) merge(other *quantileSketch) {
+	for index, count := range other.positive {
+		s.positive[index] += count
+	}
+	for index, count := range other.negative {
+		s.negative[index] += count
+	}
+	s.zeros += other.zeros
+}
+
+// quantile walks through the buckets from the most negative to the most positive, until it has passed the
+// fraction q of the n values
+func (s *quantileSketch) quantile(q float64, n uint64) float64 {
+	rank := uint64(q * float64(n-1))
+	seen := uint64(0)
+
+	negatives := sortedBuckets(s.negative)
+	for i := len(negatives) - 1; i >= 0; i-- {
+		seen += s.negative[negatives[i]]
+		if seen > rank {
+			return -bucketValue(negatives[i])
+		}
+	}
+	seen += s.zeros
+	if seen > rank {
+		return 0
+	}
+	positives := sortedBuckets(s.positive)
+	for _, index := range positives {
+		seen += s.positive[index]
+		if seen > rank {
+			return bucketValue(index)
+		}
+	}
+	return math.Inf(1)
+}
+
+func sortedBuckets(buckets map[int]uint64) []int {
+	indexes := make([]int, 0, len(buckets))
+	for index := range buckets {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
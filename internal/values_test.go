@@ -0,0 +1,106 @@
+package topfew
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// assertQuantiles checks the sketch's percentiles against the exact ones
+func assertQuantiles(t *testing.T, v *valueStats, values []float64, what string) {
+	t.Helper()
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	for _, q := range []float64{0, 0.01, 0.25, 0.5, 0.9, 0.99, 1} {
+		exact := sorted[int(q*float64(len(sorted)-1))]
+		got := v.quantile(q)
+		if math.Abs(got-exact) > quantileAccuracy*math.Abs(exact)+1e-12 {
+			t.Errorf("%s: quantile %g got %g wanted %g", what, q, got, exact)
+		}
+	}
+}
+
+func TestValueStats(t *testing.T) {
+	random := rand.New(rand.NewSource(14))
+	distributions := map[string]func() float64{
+		"uniform":     func() float64 { return random.Float64() * 1000 },
+		"exponential": func() float64 { return random.ExpFloat64() / 20 },
+		"mixed signs": func() float64 { return math.Round(random.NormFloat64()*100) / 10 },
+		"constant":    func() float64 { return 42 },
+	}
+	for name, next := range distributions {
+		var values []float64
+		whole, part1, part2 := newValueStats(), newValueStats(), newValueStats()
+		for i := 0; i < 20000; i++ {
+			value := next()
+			values = append(values, value)
+			whole.add(value)
+			if i%3 == 0 {
+				part1.add(value)
+			} else {
+				part2.add(value)
+			}
+		}
+		assertQuantiles(t, whole, values, name)
+		merged := part1.clone()
+		merged.merge(part2)
+		assertQuantiles(t, merged, values, name+" merged")
+
+		summary := merged.summary()
+		sorted := append([]float64(nil), values...)
+		sort.Float64s(sorted)
+		total := 0.0
+		for _, value := range values {
+			total += value
+		}
+		if summary.N != 20000 || summary.Min != sorted[0] || summary.Max != sorted[len(sorted)-1] ||
+			math.Abs(summary.Total-total) > 1e-6*math.Abs(total)+1e-6 ||
+			math.Abs(summary.Mean-total/20000) > 1e-6*math.Abs(total/20000)+1e-9 {
+			t.Errorf("%s: summary %v", name, summary)
+		}
+		if part1.summary().N+part2.summary().N != 20000 {
+			t.Errorf("%s: merging changed the parts", name)
+		}
+	}
+
+	if newValueStats().summary() != nil {
+		t.Error("summary of no values")
+	}
+}
+
+func TestValue(t *testing.T) {
+	records := "/a 10\n/a 20\n/b 5\n/a 30\n/b -\n/a 40\n/c x\n/b 15\n/d\n"
+	// the percentiles are within 1% of values that were seen
+	got := runBoth(t, records, "-f", "1", "--value", "2")
+	wanted := "4 min=10 max=40 mean=25 total=100 p50=19.9 p90=30.3 p99=30.3 /a\n" +
+		"3 min=5 max=15 mean=10 total=20 p50=5 p90=5 p99=5 /b\n" +
+		"1 /c\n"
+	if got != wanted {
+		t.Errorf("text got\n%s", got)
+	}
+
+	got = runBoth(t, records, "-f", "1", "--value", "2", "--output", "csv", "-n", "3")
+	wanted = "count,n,min,max,mean,total,p50,p90,p99,key\n" +
+		"4,4,10,40,25,100,19.9,30.3,30.3,/a\n" +
+		"3,2,5,15,10,20,5,5,5,/b\n" +
+		"1,,,,,,,,,/c\n"
+	if got != wanted {
+		t.Errorf("CSV got\n%s", got)
+	}
+
+	// the mean is rounded, so isn't 1.6666666666666667
+	got = runBoth(t, "/a 1\n/a 2\n/a 2\n", "-f", "1", "--value", "2")
+	if got != "3 min=1 max=2 mean=1.66667 total=5 p50=1.99 p90=1.99 p99=1.99 /a\n" {
+		t.Errorf("rounded mean got\n%s", got)
+	}
+
+	got = runBoth(t, "{\"u\":\"/a\",\"ms\":1.5}\n{\"u\":\"/a\",\"ms\":2.5}\n", "-j", "-f", "u", "--value", "ms",
+		"--output", "json")
+	// the percentiles are only within 1%
+	if !strings.HasPrefix(got, "[\n{\"count\":2,\"values\":{\"n\":2,\"min\":1.5,\"max\":2.5,\"mean\":2,\"total\":4,") ||
+		!strings.HasSuffix(got, "},\"key\":\"/a\"}\n]\n") {
+		t.Errorf("JSON got\n%s", got)
+	}
+}
@@ -0,0 +1,85 @@
+package topfew
+
+// With --sum, each record is counted with the weight given by the numeric value of one of its fields, and
+//  keys are ranked by the total. The field is found by a keyFinder of its own, so it can be specified in the
+//  same way as the key fields in any of the input formats.
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// what to do when the --sum field isn't a number, for example the "-" Apache writes when no bytes were sent
+const (
+	nonNumericZero  = iota // count the record with a weight of zero
+	nonNumericSkip         // quietly ignore the record
+	nonNumericError        // report the record as one we can't extract a key from
+)
+
+// parseNonNumeric turns the --nonnumeric argument into one of the nonNumericXxx constants
+func parseNonNumeric(s string) (int, error) {
+	switch s {
+	case "", "zero":
+		return nonNumericZero, nil
+	case "skip":
+		return nonNumericSkip, nil
+	case "error":
+		return nonNumericError, nil
+	}
+	return 0, fmt.Errorf("--nonnumeric must be one of zero, skip, or error, not \"%s\"", s)
+}
+
+// weightGetter gets the value of the --sum field, which is the record's weight. Approximate counting can't
+// cope with negative weights, so noNegatives makes them an error.
+type weightGetter struct {
+	field       *keyFinder
+	nonNumeric  int
+	noNegatives bool
+}
+
+func (w *weightGetter) get(record []byte, fields *recordFields) error {
+	weight, err := w.getWeight(record)
+	fields.weight, fields.hasWeight = weight, true
+	return err
+}
+
+func (w *weightGetter) finders() []*keyFinder {
+	return []*keyFinder{w.field}
+}
+
+func (w *weightGetter) clone() fieldGetter {
+	return &weightGetter{field: w.field.clone(), nonNumeric: w.nonNumeric, noNegatives: w.noNegatives}
+}
+
+// weighted says whether the records are weighted with --sum
+func (kf *keyFinder) weighted() bool {
+	for _, getter := range kf.getters {
+		if _, ok := getter.(*weightGetter); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// getWeight returns the record's weight
+func (w *weightGetter) getWeight(record []byte) (float64, error) {
+	field, err := w.field.getKey(record)
+	if err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseFloat(string(field), 64)
+	if err == nil && !math.IsNaN(value) && !math.IsInf(value, 0) {
+		if value < 0 && w.noNegatives {
+			return 0, fmt.Errorf("negative value \"%s\" for --sum with --max-keys", field)
+		}
+		return value, nil
+	}
+	switch w.nonNumeric {
+	case nonNumericZero:
+		return 0, nil
+	case nonNumericSkip:
+		return 0, errSkipRecord
+	}
+	return 0, fmt.Errorf("non-numeric value \"%s\" for --sum", field)
+}
@@ -0,0 +1,141 @@
+package topfew
+
+import (
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestGetWeight(t *testing.T) {
+	wg := &weightGetter{field: newKeyFinder([]uint{2}, nil, false)}
+	goods := map[string]float64{
+		"a 3\n": 3, "a -2": -2, "a 1.5": 1.5, "a 1e3": 1000, "a 007": 7,
+	}
+	for record, wanted := range goods {
+		weight, err := wg.getWeight([]byte(record))
+		if err != nil || weight != wanted {
+			t.Errorf("weight of %q is %f, %v; wanted %f", record, weight, err, wanted)
+		}
+	}
+
+	nonNumerics := []string{"a -\n", "a x", "a NaN", "a Inf", "a 3x", "a \"\""}
+	for _, record := range nonNumerics {
+		wg.nonNumeric = nonNumericZero
+		weight, err := wg.getWeight([]byte(record))
+		if err != nil || weight != 0 {
+			t.Errorf("zero: weight of %q is %f, %v", record, weight, err)
+		}
+		wg.nonNumeric = nonNumericSkip
+		if _, err = wg.getWeight([]byte(record)); err != errSkipRecord {
+			t.Errorf("skip: weight of %q gave %v", record, err)
+		}
+		wg.nonNumeric = nonNumericError
+		if _, err = wg.getWeight([]byte(record)); err == nil || err == errSkipRecord {
+			t.Errorf("error: weight of %q gave %v", record, err)
+		}
+	}
+
+	if _, err := wg.getWeight([]byte("a\n")); err == nil {
+		t.Error("accepted record without weight field")
+	}
+	unweighted := newKeyFinder(nil, nil, false)
+	if fields, err := unweighted.getFields([]byte("a\n")); err != nil || fields.weight != 1 || fields.hasWeight {
+		t.Errorf("unweighted record has weight %f, %v", fields.weight, err)
+	}
+}
+
+// sums runs topfew on the input, both as a stream and a file, and returns the sums if they agree
+func sums(t *testing.T, input string, args ...string) map[string]float64 {
+	t.Helper()
+	c, err := Configure(append([]string{"-n", "1000"}, args...))
+	if err != nil {
+		t.Fatal("config: " + err.Error())
+	}
+	fromStream, err := Run(c, strings.NewReader(input))
+	if err != nil {
+		t.Fatal("Run: " + err.Error())
+	}
+	fname := writeTemp(t, "sum", []byte(input))
+	defer func() { _ = os.Remove(fname) }()
+	c.fnames = []string{fname}
+	c.width = 3
+	fromFile, err := Run(c, nil)
+	if err != nil {
+		t.Fatal("Run file: " + err.Error())
+	}
+
+	results := make(map[string]float64)
+	for _, kc := range fromStream {
+		if kc.Sum == nil {
+			t.Fatal("no sum for " + kc.Key)
+		}
+		results[kc.Key] = *kc.Sum
+	}
+	if len(fromFile) != len(fromStream) {
+		t.Errorf("%d results from file, %d from stream", len(fromFile), len(fromStream))
+	}
+	for _, kc := range fromFile {
+		if math.Abs(results[kc.Key]-*kc.Sum) > 1e-9 {
+			t.Errorf("sum for %s is %f from file, %f from stream", kc.Key, *kc.Sum, results[kc.Key])
+		}
+	}
+	return results
+}
+
+func assertSums(t *testing.T, label string, wanted map[string]float64, got map[string]float64) {
+	t.Helper()
+	if len(got) != len(wanted) {
+		t.Errorf("%s: got %d sums, wanted %d", label, len(got), len(wanted))
+	}
+	for key, sum := range wanted {
+		if math.Abs(got[key]-sum) > 1e-9 {
+			t.Errorf("%s: sum for %s is %f, wanted %f", label, key, got[key], sum)
+		}
+	}
+}
+
+func TestSum(t *testing.T) {
+	var b strings.Builder
+	for i := 0; i < 1000; i++ {
+		b.WriteString("a 1.5\nb 2\nc -\nd x\n")
+	}
+	input := b.String()
+	assertSums(t, "zero", map[string]float64{"a": 1500, "b": 2000, "c": 0, "d": 0},
+		sums(t, input, "-f", "1", "--sum", "2"))
+	assertSums(t, "skip", map[string]float64{"a": 1500, "b": 2000},
+		sums(t, input, "-f", "1", "--sum", "2", "--nonnumeric", "skip"))
+	assertSums(t, "grep", map[string]float64{"a": 1500, "b": 2000},
+		sums(t, input, "-f", "1", "--sum", "2", "--nonnumeric", "error", "-g", "^[ab]"))
+
+	// negative numbers mean the top of the list can change after it looks settled
+	b.Reset()
+	for i := 0; i < 100; i++ {
+		b.WriteString("big 10\n")
+	}
+	for i := 0; i < 100; i++ {
+		b.WriteString("k" + string(rune('a'+i%20)) + " 1\nbig -10\n")
+	}
+	got := sums(t, b.String(), "-f", "1", "--sum", "2")
+	if got["big"] != 0 || got["ka"] != 5 || len(got) != 21 {
+		t.Errorf("with negatives got %v", got)
+	}
+	c, _ := Configure([]string{"-n", "3", "-f", "1", "--sum", "2"})
+	top, _ := Run(c, strings.NewReader(b.String()))
+	if len(top) != 3 || *top[2].Sum != 5 {
+		t.Errorf("with negatives top 3 is %v", top)
+	}
+
+	json := `{"ip": "a", "bytes": 100}
+{"ip": "b", "bytes": "250"}
+{"ip": "a", "bytes": 1.5}
+{"ip": "b"}
+`
+	assertSums(t, "json", map[string]float64{"a": 101.5, "b": 250},
+		sums(t, json, "-j", "-f", "ip", "--sum", "bytes", "--missing", "skip"))
+
+	csv := "ip,\"bytes sent\"\na,100\nb,\"2,5\"\na,7\n"
+	assertSums(t, "csv", map[string]float64{"a": 107, "b": 0}, sums(t, csv, "--csv", "-f", "1", "--sum", "bytes sent"))
+	assertSums(t, "csv numbers", map[string]float64{"a": 107, "b": 0},
+		sums(t, csv, "--csv", "--header", "-f", "ip", "--sum", "2"))
+}
@@ -0,0 +1,427 @@
+package topfew
+
+// --where only counts records that satisfy an expression made of predicates on fields, like status>=500,
+//  method==POST, or path~^/api/, which, unlike --grep, look at just the one field. The field is given in the
+//  same way as those in the field list; without one, as in ~regexp, the predicate is about the whole record,
+//  without its line ending. If the value is a number, they're compared as numbers, so status>=500 is true of
+//  503 but not of 60, and a field that isn't a number only satisfies !=; otherwise they're compared as strings.
+//  ~ and !~ match the field against a regexp. A record that doesn't have the field doesn't satisfy the
+//  predicate, whatever the operator.
+//
+// Predicates are combined with and, or, and not, or &&, || and !, and parentheses, so
+//  "(status>=500 or time-taken>2000) and not ua~HealthCheck" works; not binds tightest, then and, then or.
+//  A value ends at an and or an or, or at a ) that doesn't close a ( in the value, so \.(png|jpg)$ can be
+//  written as it is, and it can be quoted, with ' or ", to include those. Expressions are parsed once, when the
+//  config is set up, and evaluated from left to right, stopping as soon as the result is known, so it's
+//  cheaper to put the predicates that decide most records first. --where may be given more than once, and a
+//  record has to satisfy all of them; the records that don't are counted, in the Stats, against the first
+//  one they fail.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	whereEqual = iota
+	whereNotEqual
+	whereLess
+	whereLessOrEqual
+	whereGreater
+	whereGreaterOrEqual
+	whereMatch
+	whereNotMatch
+)
+
+// whereOperators are tried in order, so the two-character ones come before their prefixes
+var whereOperators = []struct {
+	symbol string
+	op     int
+}{
+	{"==", whereEqual}, {"!=", whereNotEqual}, {"<=", whereLessOrEqual}, {">=", whereGreaterOrEqual},
+	{"!~", whereNotMatch}, {"<", whereLess}, {">", whereGreater}, {"~", whereMatch}, {"=", whereEqual},
+}
+
+// whereOperatorChars are the characters operators are made of, which end a field
+const whereOperatorChars = "=!<>~"
+
+// predicate is one comparison in a --where; field is nil if it's about the whole record, and index is where
+// its field's keyFinder is in a whereFinder. number is the value if numeric says it's a number, and re is the
+// regexp for ~ and !~.
+type predicate struct {
+	field   *fieldSpec
+	index   int
+	op      int
+	value   []byte
+	number  float64
+	numeric bool
+	re      *regexp.Regexp
+}
+
+const (
+	exprPredicate = iota
+	exprAnd
+	exprOr
+	exprNot
+)
+
+// whereExpr is a node in a parsed --where: a predicate, or and, or, or not of its operands
+type whereExpr struct {
+	op        int
+	predicate *predicate
+	operands  []*whereExpr
+}
+
+// whereClause is a parsed --where argument, whose predicates are numbered by their index
+type whereClause struct {
+	text       string
+	expr       *whereExpr
+	predicates []*predicate
+}
+
+// whereParser is a recursive-descent parser for --where expressions; at is how far it's got in s
+type whereParser struct {
+	config     *config
+	opts       *Options
+	s          string
+	at         int
+	predicates []*predicate
+}
+
+// parseWhere parses a --where argument
+func (config *config) parseWhere(s string, opts *Options) (*whereClause, error) {
+	p := &whereParser{config: config, opts: opts, s: s}
+	expr, err := p.parseOr()
+	if err == nil {
+		p.skipSpace()
+		if p.at < len(s) {
+			err = fmt.Errorf("unexpected \"%s\"", s[p.at:])
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid --where %s: %w", s, err)
+	}
+	return &whereClause{text: s, expr: expr, predicates: p.predicates}, nil
+}
+
+// parseOr parses operands separated by or
+func (p *whereParser) parseOr() (*whereExpr, error) {
+	return p.parseOperands(exprOr, "or", "||", p.parseAnd)
+}
+
+// parseAnd parses operands separated by and
+func (p *whereParser) parseAnd() (*whereExpr, error) {
+	return p.parseOperands(exprAnd, "and", "&&", p.parseNot)
+}
+
+// parseOperands parses operands separated by the word or symbol for op; if there's only one, that's
+// what's returned
+func (p *whereParser) parseOperands(op int, word string, symbol string,
+	parseOperand func() (*whereExpr, error)) (*whereExpr, error) {
+	var operands []*whereExpr
+	for {
+		operand, err := parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, operand)
+		if !p.keyword(word, symbol) {
+			break
+		}
+	}
+	if len(operands) == 1 {
+		return operands[0], nil
+	}
+	return &whereExpr{op: op, operands: operands}, nil
+}
+
+// parseNot parses a predicate or an expression in parentheses, either of which may be negated
+func (p *whereParser) parseNot() (*whereExpr, error) {
+	p.skipSpace()
+	rest := p.s[p.at:]
+	// != and !~ are operators, for a predicate about the whole record, rather than negation
+	negated := strings.HasPrefix(rest, "!") && !strings.HasPrefix(rest, "!=") && !strings.HasPrefix(rest, "!~")
+	if negated {
+		p.at++
+	}
+	if negated || p.keyword("not", "") {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &whereExpr{op: exprNot, operands: []*whereExpr{operand}}, nil
+	}
+	if strings.HasPrefix(rest, "(") {
+		p.at++
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if !strings.HasPrefix(p.s[p.at:], ")") {
+			return nil, errors.New("missing )")
+		}
+		p.at++
+		return expr, nil
+	}
+	return p.parsePredicate()
+}
+
+// parsePredicate parses a field, an operator, and a value; there may be spaces around the operator
+func (p *whereParser) parsePredicate() (*whereExpr, error) {
+	if p.at >= len(p.s) {
+		return nil, errors.New("expected a predicate at the end")
+	}
+	spec := p.word(whereOperatorChars)
+	p.skipSpace()
+	pred := &predicate{index: len(p.predicates)}
+	found := false
+	for _, operator := range whereOperators {
+		if strings.HasPrefix(p.s[p.at:], operator.symbol) {
+			pred.op = operator.op
+			p.at += len(operator.symbol)
+			found = true
+			break
+		}
+	}
+	if !found {
+		if spec == "" {
+			return nil, fmt.Errorf("expected a predicate at \"%s\"", p.s[p.at:])
+		}
+		return nil, fmt.Errorf("no operator after %s, must be one of == != < <= > >= ~ !~", spec)
+	}
+	p.skipSpace()
+	value, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	pred.value = []byte(value)
+	switch pred.op {
+	case whereMatch, whereNotMatch:
+		pred.re, err = regexp.Compile(value)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		pred.number, err = strconv.ParseFloat(value, 64)
+		pred.numeric = err == nil && !math.IsNaN(pred.number)
+	}
+	if spec != "" {
+		pred.field, err = p.config.parseFieldSpec(spec, p.opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	p.predicates = append(p.predicates, pred)
+	return &whereExpr{op: exprPredicate, predicate: pred}, nil
+}
+
+// keyword consumes symbol, or word, which has to be followed by white space, a parenthesis, !, or the end,
+// if either is next
+func (p *whereParser) keyword(word string, symbol string) bool {
+	p.skipSpace()
+	rest := p.s[p.at:]
+	if symbol != "" && strings.HasPrefix(rest, symbol) {
+		p.at += len(symbol)
+		return true
+	}
+	if len(rest) < len(word) || !strings.EqualFold(rest[:len(word)], word) {
+		return false
+	}
+	if len(rest) > len(word) && strings.IndexByte(" \t()!", rest[len(word)]) < 0 {
+		return false
+	}
+	p.at += len(word)
+	return true
+}
+
+// value reads a value, which is either quoted or goes on, spaces and all, until an and or or, && or ||, or an
+// unmatched ), that isn't inside parentheses in the value, or the end; white space at the end isn't part of it
+func (p *whereParser) value() (string, error) {
+	rest := p.s[p.at:]
+	if strings.HasPrefix(rest, "'") || strings.HasPrefix(rest, "\"") {
+		end := strings.IndexByte(rest[1:], rest[0])
+		if end < 0 {
+			return "", fmt.Errorf("no closing %c", rest[0])
+		}
+		p.at += end + 2
+		return rest[1 : end+1], nil
+	}
+	start, end := p.at, p.at
+	depth := 0
+	for p.at < len(p.s) {
+		c := p.s[p.at]
+		switch {
+		case depth == 0 && (strings.HasPrefix(p.s[p.at:], "&&") || strings.HasPrefix(p.s[p.at:], "||")):
+			p.at = end
+			return p.s[start:end], nil
+		case depth == 0 && (c == ' ' || c == '\t'):
+			// keyword skips the white space, which is only part of the value if more of it follows
+			if p.keyword("and", "") || p.keyword("or", "") {
+				p.at = end
+				return p.s[start:end], nil
+			}
+			continue
+		case c == '(':
+			depth++
+		case c == ')':
+			if depth == 0 {
+				p.at = end
+				return p.s[start:end], nil
+			}
+			depth--
+		}
+		p.at++
+		end = p.at
+	}
+	return p.s[start:end], nil
+}
+
+// word reads up to white space, an unmatched ), or any of stops
+func (p *whereParser) word(stops string) string {
+	start := p.at
+	depth := 0
+	for ; p.at < len(p.s); p.at++ {
+		c := p.s[p.at]
+		if c == ' ' || c == '\t' || strings.IndexByte(stops, c) >= 0 {
+			break
+		}
+		if c == '(' {
+			depth++
+		} else if c == ')' {
+			if depth == 0 {
+				break
+			}
+			depth--
+		}
+	}
+	return p.s[start:p.at]
+}
+
+func (p *whereParser) skipSpace() {
+	for p.at < len(p.s) && (p.s[p.at] == ' ' || p.s[p.at] == '\t') {
+		p.at++
+	}
+}
+
+// matches says whether a field's value satisfies the predicate
+func (pred *predicate) matches(field []byte) bool {
+	var comparison int
+	switch {
+	case pred.re != nil:
+		return pred.re.Match(field) == (pred.op == whereMatch)
+	case pred.numeric:
+		number, err := strconv.ParseFloat(string(field), 64)
+		if err != nil || math.IsNaN(number) {
+			// a field that isn't a number can only be unequal to one
+			return pred.op == whereNotEqual
+		}
+		switch {
+		case number < pred.number:
+			comparison = -1
+		case number > pred.number:
+			comparison = 1
+		}
+	default:
+		comparison = bytes.Compare(field, pred.value)
+	}
+	switch pred.op {
+	case whereEqual:
+		return comparison == 0
+	case whereNotEqual:
+		return comparison != 0
+	case whereLess:
+		return comparison < 0
+	case whereLessOrEqual:
+		return comparison <= 0
+	case whereGreater:
+		return comparison > 0
+	}
+	return comparison >= 0
+}
+
+// eval says whether a record satisfies the expression, finding the predicates' fields with fields
+func (e *whereExpr) eval(record []byte, fields []*keyFinder) bool {
+	switch e.op {
+	case exprAnd:
+		for _, operand := range e.operands {
+			if !operand.eval(record, fields) {
+				return false
+			}
+		}
+		return true
+	case exprOr:
+		for _, operand := range e.operands {
+			if operand.eval(record, fields) {
+				return true
+			}
+		}
+		return false
+	case exprNot:
+		return !e.operands[0].eval(record, fields)
+	}
+	pred := e.predicate
+	if pred.field == nil {
+		return pred.matches(bytes.TrimRight(record, "\r\n"))
+	}
+	field, err := fields[pred.index].getKey(record)
+	return err == nil && pred.matches(field)
+}
+
+// whereFinder evaluates a --where, the index-th, with a keyFinder for each of its predicates' fields, or nil
+// for those about the whole record
+type whereFinder struct {
+	clause *whereClause
+	index  int
+	fields []*keyFinder
+}
+
+// whereRejection is the error for a record that doesn't satisfy a --where; it's which one
+type whereRejection int
+
+func (w whereRejection) Error() string {
+	return fmt.Sprintf("rejected by --where %d", int(w)+1)
+}
+
+// newWhereFinder sets up the keyFinders for a --where
+func (config *config) newWhereFinder(clause *whereClause, index int) *whereFinder {
+	w := &whereFinder{clause: clause, index: index, fields: make([]*keyFinder, len(clause.predicates))}
+	for i, pred := range clause.predicates {
+		if pred.field != nil {
+			w.fields[i] = config.newFieldFinder(pred.field)
+		}
+	}
+	return w
+}
+
+func (w *whereFinder) get(record []byte, _ *recordFields) error {
+	if !w.clause.expr.eval(record, w.fields) {
+		return whereRejection(w.index)
+	}
+	return nil
+}
+
+func (w *whereFinder) finders() []*keyFinder {
+	var finders []*keyFinder
+	for _, field := range w.fields {
+		if field != nil {
+			finders = append(finders, field)
+		}
+	}
+	return finders
+}
+
+func (w *whereFinder) clone() fieldGetter {
+	clone := &whereFinder{clause: w.clause, index: w.index, fields: make([]*keyFinder, len(w.fields))}
+	for i, field := range w.fields {
+		if field != nil {
+			clone.fields[i] = field.clone()
+		}
+	}
+	return clone
+}
@@ -0,0 +1,175 @@
+package topfew
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestPredicates(t *testing.T) {
+	config := &config{}
+	tests := []struct {
+		where  string
+		field  string
+		wanted bool
+	}{
+		{"7>=500", "503", true},
+		{"7>=500", "60", false},
+		{"7 >= 500", "500", true},
+		{"7>500", "500.5", true},
+		{"7<500", "404", true},
+		{"7<=500", "1e3", false},
+		{"7==200", "200.0", true},
+		{"7=200", "200", true},
+		{"7!=200", "404", true},
+		{"7!=200", "-", true},
+		{"7==200", "-", false},
+		{"7<500", "-", false},
+		{"1==POST", "POST", true},
+		{"1==POST", "post", false},
+		{"1!=POST", "GET", true},
+		{"1<m", "GET", true},
+		{"1>=M", "POST", true},
+		{"1==", "", true},
+		{"2~^/api/", "/api/v1", true},
+		{"2~^/api/", "/web/api/", false},
+		{"2!~\\.(png|jpg)$", "/a.html", true},
+		{"2!~\\.(png|jpg)$", "/a.png", false},
+		{"2~a=b", "xa=by", true},
+	}
+	for _, test := range tests {
+		clause, err := config.parseWhere(test.where, &Options{})
+		if err != nil {
+			t.Fatalf("%s: %s", test.where, err.Error())
+		}
+		if len(clause.predicates) != 1 || clause.predicates[0].matches([]byte(test.field)) != test.wanted {
+			t.Errorf("%s %q: wanted %v", test.where, test.field, test.wanted)
+		}
+	}
+
+	for _, bad := range []string{"", "7", "7!200", "7~(", "x==1", "0>1", "(1==a", "1==a)", "1==a and",
+		"or 1==a", "not", "1=='a", "1==a &&& 2==b", "()"} {
+		if _, err := config.parseWhere(bad, &Options{}); err == nil {
+			t.Errorf("accepted %s", bad)
+		}
+	}
+}
+
+func TestWhereExpressions(t *testing.T) {
+	config := &config{}
+	record := []byte("GET /api/v1 503 2500 HealthCheck/1.0\r\n")
+	tests := []struct {
+		where  string
+		wanted bool
+	}{
+		{"3>=500 or 4>2000", true},
+		{"3>=500 and 4>3000", false},
+		{"(3>=500 or 4>2000) and not 5~^HealthCheck", false},
+		{"(3>=500 || 4>2000) && !5~^Health", false},
+		{"(3>=500 OR 4>2000) AND NOT 5~^Browser", true},
+		{"3<500 or 4>2000 and 1==GET", true},
+		{"3<500 or 4>2000 and 1==POST", false},
+		{"not 3<500 and not(1==POST)", true},
+		{"!!1==GET", true},
+		{"not not not 1==GET", false},
+		{"((1==GET))", true},
+		{"2~^/api/(v1|v2)$ and 1 == GET", true},
+		{"(2~^/api/(v1|v2)$)", true},
+		{"~^GET /api/", true},
+		{"!~Health", false},
+		{"~'Check/1.0$' and !=GET", true},
+		{"~^GET /api/v2 503 and ~HealthCheck", false},
+		{"~^GET /api/v1 503 and ~HealthCheck", true},
+		{"2==/api/v1&&3==503", true},
+		{"(~^GET (/api|/web) and 3>=500)", true},
+		{"~(and|or) || 1==GET", true},
+		{"~(GET /a)", true},
+		{"1 ~ (GET /a)", false},
+		{"(~(GET /b) or 2~(/api/v1 )?)", true},
+		{"5=='HealthCheck/1.0' and 6==''", false},
+		{"6!=x or 6==x", false},
+	}
+	for _, test := range tests {
+		clause, err := config.parseWhere(test.where, &Options{})
+		if err != nil {
+			t.Fatalf("%s: %s", test.where, err.Error())
+		}
+		kf := newKeyFinder(nil, nil, false)
+		kf.getters = []fieldGetter{config.newWhereFinder(clause, 0)}
+		kf = kf.clone()
+		if _, err := kf.getFields(record); (err == nil) != test.wanted {
+			t.Errorf("%s: wanted %v", test.where, test.wanted)
+		}
+	}
+
+	// and, or, and not are only keywords on their own
+	clause, err := config.parseWhere("note==1 or notes!=1 and order>2", &Options{JSON: true})
+	if err != nil {
+		t.Fatal("parse: " + err.Error())
+	}
+	if clause.expr.op != exprOr || len(clause.expr.operands) != 2 || clause.expr.operands[1].op != exprAnd ||
+		len(clause.predicates) != 3 {
+		t.Errorf("parsed %+v", clause.expr)
+	}
+}
+
+func TestWhere(t *testing.T) {
+	records := `1.1.1.1 - - [12/Mar/2007:08:04:39 -0800] "GET /api/a HTTP/1.1" 500 10
+1.1.1.1 - - [12/Mar/2007:08:04:40 -0800] "POST /api/a HTTP/1.1" 503 500
+2.2.2.2 - - [12/Mar/2007:08:04:41 -0800] "GET /api/b HTTP/1.1" 502 20
+2.2.2.2 - - [12/Mar/2007:08:04:42 -0800] "GET /web/500 HTTP/1.1" 200 500
+3.3.3.3 - - [12/Mar/2007:08:04:43 -0800] "GET /api/c HTTP/1.1" 404 30
+2.2.2.2 - - [12/Mar/2007:08:04:44 -0800] "GET /api/d HTTP/1.1" 404 40
+4.4.4.4 - - [12/Mar/2007:08:04:44 -0800] short
+`
+	// unlike -g 500, the status field is the only one looked at
+	if got := runBoth(t, records, "--format", "apache-common", "-f", "ip", "--where", "status>=500"); got !=
+		"2 1.1.1.1\n1 2.2.2.2\n" {
+		t.Errorf("status got\n%s", got)
+	}
+	if got := runBoth(t, records, "-q", "-f", "1", "--where", "6~^GET /api/", "--where", "7!=500"); got !=
+		"2 2.2.2.2\n1 3.3.3.3\n" {
+		t.Errorf("-q got\n%s", got)
+	}
+
+	if got := runBoth(t, records, "--format", "apache-common", "-f", "ip", "--where",
+		"(status>=500 or bytes>=500) and not path~^/web/"); got != "2 1.1.1.1\n1 2.2.2.2\n" {
+		t.Errorf("expression got\n%s", got)
+	}
+
+	config, err := Configure([]string{"--format", "apache-common", "--where", "method==GET", "--where", "status>=500",
+		"-g", "api"})
+	if err != nil {
+		t.Fatal("configure: " + err.Error())
+	}
+	_, stats, err := config.run(context.Background(), strings.NewReader(records))
+	if err != nil {
+		t.Fatal("run: " + err.Error())
+	}
+	if stats.Records != 7 || stats.GrepRejects[0] != 2 || stats.WhereRejects[0] != 1 || stats.WhereRejects[1] != 2 ||
+		stats.Counted != 2 {
+		t.Errorf("stats %+v", stats)
+	}
+	var out strings.Builder
+	_ = config.writeStats(stats, &out)
+	if !strings.Contains(out.String(), "rejected by --where method==GET: 1\nrejected by --where status>=500: 2\n") {
+		t.Errorf("stats got\n%s", out.String())
+	}
+
+	// CSV columns, JSON paths, and W3C fields named in a directive
+	csv := "status,path\n500,/a\n200,/b\n501,/a\n"
+	if got := runBoth(t, csv, "--csv", "-f", "path", "--where", "status>=500"); got != "2 /a\n" {
+		t.Errorf("csv got\n%s", got)
+	}
+	json := `{"s":500,"p":"/a"}
+{"s":200,"p":"/b"}
+{"p":"/c"}
+`
+	if got := runBoth(t, json, "-j", "-f", "p", "--where", "s<300", "--missing", "skip"); got != "1 /b\n" {
+		t.Errorf("json got\n%s", got)
+	}
+	w3c := "#Fields: cs-method cs-uri-stem sc-status\n" + "GET /a 500\nGET /b 200\nGET /a 503\n"
+	if got := runBoth(t, w3c, "--format", "w3c", "-f", "path", "--where", "status>=500"); got != "2 /a\n" {
+		t.Errorf("w3c got\n%s", got)
+	}
+}
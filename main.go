@@ -19,7 +19,8 @@ func main() {
 	if err != nil {
 		os.Exit(1)
 	}
-	for _, kc := range counts {
-		fmt.Printf("%d %s\n", *kc.Count, kc.Key)
+	if err = topfew.Output(config, counts, os.Stdout); err != nil {
+		fmt.Println("Problem writing output: " + err.Error())
+		os.Exit(1)
 	}
 }
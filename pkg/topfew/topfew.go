@@ -0,0 +1,148 @@
+// Package topfew finds the most common values of a field or combination of fields in line-structured
+// input, and is what the topfew command uses to do its work. It is for Go programs which want to do
+// top-few counting in-process rather than running the command.
+package topfew
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	tf "github.com/timbray/topfew/internal"
+)
+
+// Options describes what a run should do; its fields correspond to the command-line options, which are
+// described in the README.
+type Options = tf.Options
+
+// Substitution is a sed(1)-style edit applied to extracted keys, as with --sed.
+type Substitution = tf.Substitution
+
+// ValueStats summarizes the numeric values of the Options.Value field for a key.
+type ValueStats = tf.ValueStats
+
+// KeyCount is one of the results: a key and how many times it occurred. If Options.Sum is set, Sum is the
+// total of that field over the records with the key, which are ranked by it. If Options.MaxKeys is set, the
+// results are approximate, and Error is the most by which Sum, or Count if there's no Sum, may be too high.
+// If Options.Window is set, there's a ranked list for each window, in order of time, and Window is the start
+// of the one the result belongs to. Similarly, if Options.GroupBy is set, there's a list for each group, and
+// Group is its value. If Options.Distinct is set, Distinct is how many different values of that field
+// occurred with the key, and the results are ranked by it. If Options.Value is set, Values summarizes that
+// field's numeric values in the records with the key, and is nil if there weren't any. If Options.Percent or
+// Options.Cumulative is set, Percent is the key's share of all the records, or of the total of the Sum field,
+// and Cumulative the running total of the shares. If Options.Other is set, each list can end with a result
+// whose Key is "(other)" and Other is set, which stands for all the keys not in the list; Keys is how many.
+type KeyCount struct {
+	Key        string
+	Count      uint64
+	Sum        float64
+	Error      float64
+	Window     time.Time
+	Group      string
+	Distinct   uint64
+	Values     *ValueStats
+	Percent    float64
+	Cumulative float64
+	Other      bool
+	Keys       uint64
+}
+
+// Stats describes what happened to the records in a run: how many there were and how many bytes, how many
+// each of the Options.Grep and Options.Vgrep filters rejected, how many keys couldn't be extracted from, and
+// how many were counted, with how many different keys. Elapsed is how long the run took, and when files are
+// read in parallel segments, Segments says how long each took.
+type Stats = tf.Stats
+
+// SegmentStats describes one of the segments a file was divided into.
+type SegmentStats = tf.SegmentStats
+
+// Result is what a run found: the results, as Run returns them, and statistics about it.
+type Result struct {
+	Counts []KeyCount
+	Stats  Stats
+}
+
+// Run reads records from r and returns the most common keys, in decreasing order of occurrence count, or of
+// Sum if Options.Sum is set. If Options.Bottom is set, it returns the least common keys in increasing order.
+// A nil opts is the same as the zero Options. Run returns ctx.Err() if ctx is cancelled before it finishes.
+func Run(ctx context.Context, opts *Options, r io.Reader) ([]KeyCount, error) {
+	return run(ctx, opts, nil, r)
+}
+
+// RunFile is like Run, but reads the named file, dividing it into segments which are processed in parallel.
+func RunFile(ctx context.Context, opts *Options, fname string) ([]KeyCount, error) {
+	return run(ctx, opts, []string{fname}, nil)
+}
+
+// RunFiles is like RunFile, but counts the records in all the named files together. Directories are searched
+// recursively, subject to the Include and Exclude globs in opts.
+func RunFiles(ctx context.Context, opts *Options, fnames ...string) ([]KeyCount, error) {
+	if len(fnames) == 0 {
+		return nil, errors.New("no files to read")
+	}
+	return run(ctx, opts, fnames, nil)
+}
+
+// RunWithStats is like Run, but returns statistics about the run along with the results.
+func RunWithStats(ctx context.Context, opts *Options, r io.Reader) (*Result, error) {
+	return runWithStats(ctx, opts, nil, r)
+}
+
+// RunFilesWithStats is like RunFiles, but returns statistics about the run along with the results.
+func RunFilesWithStats(ctx context.Context, opts *Options, fnames ...string) (*Result, error) {
+	if len(fnames) == 0 {
+		return nil, errors.New("no files to read")
+	}
+	return runWithStats(ctx, opts, fnames, nil)
+}
+
+func run(ctx context.Context, opts *Options, fnames []string, r io.Reader) ([]KeyCount, error) {
+	result, err := runWithStats(ctx, opts, fnames, r)
+	if err != nil {
+		return nil, err
+	}
+	return result.Counts, nil
+}
+
+func runWithStats(ctx context.Context, opts *Options, fnames []string, r io.Reader) (*Result, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	counts, stats, err := tf.RunOptions(ctx, opts, fnames, r)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]KeyCount, 0, len(counts))
+	for _, kc := range counts {
+		result := KeyCount{Key: kc.Key, Count: *kc.Count}
+		if kc.Sum != nil {
+			result.Sum = *kc.Sum
+		}
+		if kc.Error != nil {
+			result.Error = *kc.Error
+		}
+		if kc.Window != nil {
+			result.Window = *kc.Window
+		}
+		if kc.Group != nil {
+			result.Group = *kc.Group
+		}
+		if kc.Distinct != nil {
+			result.Distinct = *kc.Distinct
+		}
+		result.Values = kc.Values
+		if kc.Percent != nil {
+			result.Percent = *kc.Percent
+		}
+		if kc.Cumulative != nil {
+			result.Cumulative = *kc.Cumulative
+		}
+		if kc.Keys != nil {
+			result.Other = true
+			result.Keys = *kc.Keys
+		}
+		results = append(results, result)
+	}
+	return &Result{Counts: results, Stats: *stats}, nil
+}
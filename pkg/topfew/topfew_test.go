@@ -0,0 +1,254 @@
+package topfew
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRunFileAndStream(t *testing.T) {
+	opts := &Options{Number: 5, Fields: "1"}
+	wanted := map[string]uint64{
+		"96.48.229.116":   74,
+		"71.227.232.164":  24,
+		"122.169.54.96":   13,
+		"185.156.175.199": 13,
+		"203.189.152.127": 13,
+	}
+
+	fromFile, err := RunFile(context.Background(), opts, "../../test/data/small")
+	if err != nil {
+		t.Fatal("RunFile: " + err.Error())
+	}
+	f, err := os.Open("../../test/data/small")
+	if err != nil {
+		t.Fatal("Open: " + err.Error())
+	}
+	//noinspection ALL
+	defer f.Close()
+	fromStream, err := Run(context.Background(), opts, f)
+	if err != nil {
+		t.Fatal("Run: " + err.Error())
+	}
+
+	for _, results := range [][]KeyCount{fromFile, fromStream} {
+		if len(results) != len(wanted) {
+			t.Errorf("got %d results, wanted %d", len(results), len(wanted))
+		}
+		for _, kc := range results {
+			if kc.Count != wanted[kc.Key] {
+				t.Errorf("count for %s is %d, wanted %d", kc.Key, kc.Count, wanted[kc.Key])
+			}
+		}
+	}
+}
+
+func TestRunFiles(t *testing.T) {
+	opts := &Options{Number: 1, Fields: "1"}
+	results, err := RunFiles(context.Background(), opts, "../../test/data/small", "../../test/data/small-multi.bz2")
+	if err != nil {
+		t.Fatal("RunFiles: " + err.Error())
+	}
+	if len(results) != 1 || results[0] != (KeyCount{Key: "96.48.229.116", Count: 148}) {
+		t.Errorf("RunFiles got %v", results)
+	}
+
+	opts.Include = []string{"*.csv"}
+	results, err = RunFiles(context.Background(), opts, "../../test/data")
+	if err != nil || len(results) != 1 {
+		t.Errorf("RunFiles with include got %v, %v", results, err)
+	}
+
+	if _, err = RunFiles(context.Background(), opts); err == nil {
+		t.Error("RunFiles accepted no files")
+	}
+}
+
+func TestRunSum(t *testing.T) {
+	input := "a 10\nb 3\nb 4\nc -\na 0.5\n"
+	results, err := Run(context.Background(), &Options{Fields: "1", Sum: "2"}, strings.NewReader(input))
+	if err != nil {
+		t.Fatal("Run: " + err.Error())
+	}
+	wanted := []KeyCount{{Key: "a", Count: 2, Sum: 10.5}, {Key: "b", Count: 2, Sum: 7}, {Key: "c", Count: 1, Sum: 0}}
+	if len(results) != len(wanted) {
+		t.Fatalf("got %d results, wanted %d", len(results), len(wanted))
+	}
+	for i, kc := range results {
+		if kc != wanted[i] {
+			t.Errorf("at %d got %v wanted %v", i, kc, wanted[i])
+		}
+	}
+}
+
+func TestRunApproximate(t *testing.T) {
+	opts := &Options{Number: 2, Fields: "1", MaxKeys: 2}
+	results, err := Run(context.Background(), opts, strings.NewReader("a\na\nb\nc\na\n"))
+	if err != nil {
+		t.Fatal("Run: " + err.Error())
+	}
+	// c takes over b's entry, so its count could be b's as well as its own
+	wanted := []KeyCount{{Key: "a", Count: 3}, {Key: "c", Count: 2, Error: 1}}
+	if len(results) != len(wanted) || results[0] != wanted[0] || results[1] != wanted[1] {
+		t.Errorf("got %v wanted %v", results, wanted)
+	}
+}
+
+func TestRunGroups(t *testing.T) {
+	input := "a.com /x\nb.com /y\nb.com /y\nb.com /z\na.com /z\n"
+	opts := &Options{Number: 1, Fields: "2", GroupBy: "1", Groups: 1}
+	results, err := Run(context.Background(), opts, strings.NewReader(input))
+	if err != nil {
+		t.Fatal("Run: " + err.Error())
+	}
+	if len(results) != 1 || results[0] != (KeyCount{Key: "/y", Count: 2, Group: "b.com"}) {
+		t.Errorf("got %v", results)
+	}
+}
+
+func TestRunDistinct(t *testing.T) {
+	input := "1.1.1.1 /x\n1.1.1.1 /x\n1.1.1.1 /x\n2.2.2.2 /y\n3.3.3.3 /y\n"
+	opts := &Options{Number: 1, Fields: "2", Distinct: "1"}
+	results, err := Run(context.Background(), opts, strings.NewReader(input))
+	if err != nil {
+		t.Fatal("Run: " + err.Error())
+	}
+	if len(results) != 1 || results[0] != (KeyCount{Key: "/y", Count: 2, Distinct: 2}) {
+		t.Errorf("got %v", results)
+	}
+}
+
+func TestRunBottom(t *testing.T) {
+	opts := &Options{Number: 2, Bottom: true}
+	results, err := Run(context.Background(), opts, strings.NewReader("c\na\nb\nb\na\nd\n"))
+	if err != nil {
+		t.Fatal("Run: " + err.Error())
+	}
+	wanted := []KeyCount{{Key: "c", Count: 1}, {Key: "d", Count: 1}}
+	if len(results) != len(wanted) || results[0] != wanted[0] || results[1] != wanted[1] {
+		t.Errorf("got %v wanted %v", results, wanted)
+	}
+}
+
+func TestRunOptions(t *testing.T) {
+	input := "a x\nb y\nb z\nc y\nc y\nc z\n"
+	opts := &Options{
+		Fields: "2",
+		Vgrep:  []string{"^a"},
+		Sed:    []Substitution{{ReplaceThis: "y", WithThat: "why"}},
+	}
+	results, err := Run(context.Background(), opts, strings.NewReader(input))
+	if err != nil {
+		t.Fatal("Run: " + err.Error())
+	}
+	wanted := []KeyCount{{Key: "why", Count: 3}, {Key: "z", Count: 2}}
+	if len(results) != len(wanted) {
+		t.Fatalf("got %d results, wanted %d", len(results), len(wanted))
+	}
+	for i, kc := range results {
+		if kc != wanted[i] {
+			t.Errorf("at %d got %v wanted %v", i, kc, wanted[i])
+		}
+	}
+
+	results, err = Run(context.Background(), nil, strings.NewReader(input))
+	if err != nil || len(results) != 5 || results[0] != (KeyCount{Key: "c y", Count: 2}) {
+		t.Errorf("nil options: %v %v", results, err)
+	}
+
+	bads := []*Options{
+		{Number: -1}, {Width: -2}, {Fields: "3-1"}, {FieldSeparator: "a["},
+		{FieldSeparator: ",", QuotedFields: true}, {Grep: []string{"("}}, {Vgrep: []string{"["}}, {Where: []string{"1~["}},
+		{Sed: []Substitution{{ReplaceThis: "*"}}}, {Sum: "x"}, {NonNumeric: "zero"},
+		{MaxKeys: -1}, {MaxKeys: 5},
+	}
+	for i, bad := range bads {
+		_, err = Run(context.Background(), bad, strings.NewReader(input))
+		if err == nil {
+			t.Errorf("accepted bad options at %d", i)
+		}
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := RunFile(ctx, &Options{Fields: "1"}, "../../test/data/small")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("RunFile with cancelled context returned %v", err)
+	}
+	_, err = Run(ctx, nil, strings.NewReader("a\nb\n"))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Run with cancelled context returned %v", err)
+	}
+}
+
+func TestRunValues(t *testing.T) {
+	input := "/x 10\n/x 30\n/y 5\n/x -\n"
+	opts := &Options{Number: 2, Fields: "1", Value: "2"}
+	results, err := Run(context.Background(), opts, strings.NewReader(input))
+	if err != nil {
+		t.Fatal("Run: " + err.Error())
+	}
+	if len(results) != 2 || results[0].Key != "/x" || results[0].Count != 3 || results[0].Values == nil {
+		t.Fatalf("got %v", results)
+	}
+	values := *results[0].Values
+	if values.N != 2 || values.Min != 10 || values.Max != 30 || values.Mean != 20 || values.Total != 40 {
+		t.Errorf("got %+v", values)
+	}
+}
+
+func TestRunShares(t *testing.T) {
+	opts := &Options{Number: 1, Percent: true, Cumulative: true, Other: true}
+	results, err := Run(context.Background(), opts, strings.NewReader("a\nb\na\nc\n"))
+	if err != nil {
+		t.Fatal("Run: " + err.Error())
+	}
+	wanted := []KeyCount{
+		{Key: "a", Count: 2, Percent: 50, Cumulative: 50},
+		{Key: "(other)", Count: 2, Percent: 50, Cumulative: 100, Other: true, Keys: 2},
+	}
+	if len(results) != len(wanted) || results[0] != wanted[0] || results[1] != wanted[1] {
+		t.Errorf("got %v", results)
+	}
+}
+
+func TestRunWithStats(t *testing.T) {
+	opts := &Options{Fields: "1", Grep: []string{"a|b"}, Vgrep: []string{"c"}}
+	result, err := RunWithStats(context.Background(), opts, strings.NewReader("a\nb\nc x\nac\nd\na\n"))
+	if err != nil {
+		t.Fatal("RunWithStats: " + err.Error())
+	}
+	stats := result.Stats
+	if len(result.Counts) != 2 || stats.Records != 6 || stats.Bytes != 15 || stats.Counted != 3 || stats.Keys != 2 ||
+		len(stats.GrepRejects) != 1 || stats.GrepRejects[0] != 2 || len(stats.VgrepRejects) != 1 ||
+		stats.VgrepRejects[0] != 1 {
+		t.Errorf("got %v %+v", result.Counts, stats)
+	}
+
+	result, err = RunFilesWithStats(context.Background(), &Options{Width: 2}, "../../test/data/small")
+	if err != nil {
+		t.Fatal("RunFilesWithStats: " + err.Error())
+	}
+	if result.Stats.Records != 1000 || len(result.Stats.Segments) != 2 || result.Stats.Throughput() <= 0 {
+		t.Errorf("got %+v", result.Stats)
+	}
+	if _, err = RunFilesWithStats(context.Background(), nil); err == nil {
+		t.Error("no error without files")
+	}
+}
+
+func TestRunWarnings(t *testing.T) {
+	warnings := &strings.Builder{}
+	opts := &Options{Fields: "2", Warnings: warnings}
+	results, err := Run(context.Background(), opts, strings.NewReader("a 1\nb\nc 1\n"))
+	if err != nil {
+		t.Fatal("Run: " + err.Error())
+	}
+	if len(results) != 1 || results[0].Count != 2 || !strings.HasPrefix(warnings.String(), "Can't extract Key from b\n") {
+		t.Errorf("got %v, warned %q", results, warnings.String())
+	}
+}